@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ルートにマッチしなかったリクエストのメトリクスのラベル。パスをそのまま使うとラベルの種類が増え続けるため。
+const unmatchedRoute = "unmatched"
+
+type accessLogRouteKey struct{}
+
+// リクエスト毎に、メソッド・パス・ステータスコード・処理時間・レスポンスのバイト数を記録するハンドラーを返す。
+// 処理時間とバイト数はルートのテンプレート毎にPrometheusのヒストグラムに記録する。
+// loggerがnilでなければ、アクセスログとしてInfoレベルで出力する。
+// ルートにマッチしなかった404や405も記録するため、ルーターではなくその外側に設定し、
+// ルートのテンプレートはルーターに設定したaccessLogRouteMiddlewareから受け取る。
+// Server-Sent EventsのFlushとWebSocketのHijackは、statusRecorderが元のResponseWriterに委譲する。
+func AccessLogHandler(next http.Handler, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		var route string
+		next.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), accessLogRouteKey{}, &route)))
+		elapsed := time.Since(start)
+
+		if route == "" {
+			route = unmatchedRoute
+		}
+		httpRequestDuration.WithLabelValues(req.Method, route, strconv.Itoa(sw.status)).Observe(elapsed.Seconds())
+		httpResponseSize.WithLabelValues(req.Method, route).Observe(float64(sw.bytes))
+
+		if logger != nil {
+			logger.InfoContext(req.Context(), "http request",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"route", route,
+				"status", sw.status,
+				"duration", elapsed,
+				"bytes", sw.bytes,
+			)
+		}
+	})
+}
+
+// マッチしたルートのテンプレートを、外側のAccessLogHandlerへ渡すミドルウェア。
+func accessLogRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if route, ok := req.Context().Value(accessLogRouteKey{}).(*string); ok {
+			*route = routeTemplate(req)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	router := mux.NewRouter()
+	router.Use(accessLogRouteMiddleware)
+	router.HandleFunc("/test/access/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	before := testutil.CollectAndCount(httpRequestDuration)
+
+	w := httptest.NewRecorder()
+	AccessLogHandler(router, logger).ServeHTTP(w, httptest.NewRequest("GET", "/test/access/1", nil))
+
+	var entry struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+		Route  string `json:"route"`
+		Status int    `json:"status"`
+		Bytes  int64  `json:"bytes"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("should write a JSON log entry, but result is %q: %s", buf.String(), err)
+	}
+	if entry.Method != "GET" || entry.Path != "/test/access/1" || entry.Route != "/test/access/{id}" ||
+		entry.Status != http.StatusCreated || entry.Bytes != 5 {
+		t.Errorf("should log the request, but result is %+v", entry)
+	}
+	// パス毎ではなく、ルートのテンプレート毎に記録する
+	if n := testutil.CollectAndCount(httpRequestDuration); n != before+1 {
+		t.Errorf("should add 1 series, but %d series were added", n-before)
+	}
+}
+
+func TestAccessLogMiddlewareFlush(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(accessLogRouteMiddleware)
+	router.HandleFunc("/test/access/events", func(w http.ResponseWriter, req *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("should implement http.Flusher")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		f.Flush()
+	})
+
+	w := httptest.NewRecorder()
+	AccessLogHandler(router, nil).ServeHTTP(w, httptest.NewRequest("GET", "/test/access/events", nil))
+	if !w.Flushed {
+		t.Error("should flush the underlying ResponseWriter")
+	}
+}
+
+func TestAccessLogHandlerUnmatched(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	router := mux.NewRouter()
+	router.Use(accessLogRouteMiddleware)
+	router.HandleFunc("/test/access/unmatched", func(w http.ResponseWriter, req *http.Request) {}).Methods("GET")
+	handler := AccessLogHandler(router, logger)
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/test/access/missing", http.StatusNotFound},
+		{"POST", "/test/access/unmatched", http.StatusMethodNotAllowed},
+	} {
+		buf.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil))
+
+		var entry struct {
+			Route  string `json:"route"`
+			Status int    `json:"status"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s %s: should write a JSON log entry, but result is %q: %s", c.method, c.path, buf.String(), err)
+		}
+		if entry.Route != unmatchedRoute || entry.Status != c.status {
+			t.Errorf("%s %s: should log %d as %s, but result is %+v", c.method, c.path, c.status, unmatchedRoute, entry)
+		}
+	}
+}
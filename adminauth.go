@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	// 管理者用トークンを受け取るヘッダー。Authorizationヘッダーを使えないクライアント向け。
+	ADMIN_TOKEN_HEADER = "X-Admin-Token"
+)
+
+// 管理者用APIの認証の設定。
+// TokenとUser/Passwordの両方を設定した場合は、どちらで認証しても許可する。
+type AdminAuthConfig struct {
+	// Bearerトークン。"Authorization: Bearer <token>"またはX-Admin-Tokenヘッダーで受け付ける。
+	Token string
+	// Basic認証のユーザー名とパスワード。Passwordが空の場合はBasic認証を使用しない。
+	User     string
+	Password string
+}
+
+// 長さ以外の情報が処理時間から漏れないように比較する。
+func secureEqual(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// リクエストのBearerトークンまたはX-Admin-Tokenヘッダーの値を返す。どちらもない場合は空文字列を返す。
+func adminToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return req.Header.Get(ADMIN_TOKEN_HEADER)
+}
+
+// リクエストが管理者として認証されているかどうかを返す。
+// 認証情報が1つも設定されていない場合は、常にfalseを返す。
+func (c AdminAuthConfig) authorized(req *http.Request) bool {
+	if c.Token != "" {
+		if given := adminToken(req); given != "" && secureEqual(given, c.Token) {
+			return true
+		}
+	}
+	if c.Password != "" {
+		user, password, ok := req.BasicAuth()
+		// ユーザー名とパスワードのどちらが誤っていたかを区別できないように、両方を比較する
+		userOK := secureEqual(user, c.User)
+		passwordOK := secureEqual(password, c.Password)
+		if ok && userOK && passwordOK {
+			return true
+		}
+	}
+	return false
+}
+
+// 管理者として認証されていないリクエストに401を返すハンドラーを返す。
+func (c AdminAuthConfig) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !c.authorized(req) {
+			logRequestf(req, "WARN: unauthorized access to admin API")
+			if c.Password != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="temvote admin", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="temvote admin"`)
+			}
+			writeError(w, req, http.StatusUnauthorized, nil)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := AdminAuthConfig{
+		Token:    "secret-token",
+		User:     "admin",
+		Password: "secret-password",
+	}.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, c := range []struct {
+		name   string
+		set    func(req *http.Request)
+		status int
+	}{
+		{"none", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret-token") }, http.StatusNoContent},
+		{"wrong bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"header", func(req *http.Request) { req.Header.Set(ADMIN_TOKEN_HEADER, "secret-token") }, http.StatusNoContent},
+		{"basic", func(req *http.Request) { req.SetBasicAuth("admin", "secret-password") }, http.StatusNoContent},
+		{"wrong user", func(req *http.Request) { req.SetBasicAuth("user", "secret-password") }, http.StatusUnauthorized},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/admin/things", nil)
+		c.set(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: should return %d, but status is %d", c.name, c.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: should set WWW-Authenticate", c.name)
+		}
+	}
+
+	// 認証情報が設定されていない場合は、空のトークンやパスワードでも許可しない
+	h = AdminAuthConfig{}.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest("GET", "/api/v1/admin/things", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	req.SetBasicAuth("", "")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("should reject all requests without configured credentials, but status is %d", w.Code)
+	}
+}
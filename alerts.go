@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// 部屋の投票の過半数が暑いまたは寒いのまま、この時間が経過したら通知する
+	ALERT_DURATION = 30 * time.Minute
+	// 通知の対象とする部屋の、最小の投票数
+	ALERT_MIN_VOTES = 3
+	// センサーの接続状態の変化を通知するまでの猶予期間
+	SENSOR_ALERT_GRACE_PERIOD = 5 * time.Minute
+)
+
+// 部屋が不快な状態のまま続いていることを表す通知。
+// 通知した後、部屋の投票の過半数が快適に戻ると、Statusが"resolved"の通知を送信する。
+type ComfortAlert struct {
+	// "firing"または"resolved"
+	Status string     `json:"status"`
+	RoomID RoomID     `json:"roomId"`
+	Choice VoteChoice `json:"choice"`
+	// 不快な状態が始まった時刻と、通知時点までの継続時間
+	Since           time.Time `json:"since"`
+	DurationSeconds int64     `json:"durationSeconds"`
+}
+
+// 部屋毎の通知の状態。cacheUpdaterからのみアクセスする。
+type roomAlertState struct {
+	choice VoteChoice
+	since  time.Time
+	fired  bool
+}
+
+// 投票の過半数を占める選択肢を返す。とても暑いは暑いに、とても寒いは寒いに含める。
+// 過半数を占める選択肢がない場合は空文字列を返す。
+func dominantChoice(rs *RoomStatus) VoteChoice {
+	switch {
+	case rs.Total == 0:
+		return ""
+	case (rs.VeryHot+rs.Hot)*2 > rs.Total:
+		return Hot
+	case (rs.VeryCold+rs.Cold)*2 > rs.Total:
+		return Cold
+	case rs.Comfort*2 > rs.Total:
+		return Comfort
+	}
+	return ""
+}
+
+// すべての部屋の投票を評価し、不快な状態がAlertDurationを超えて続いている部屋を通知する。
+// 同じ状態が続いている間は、再度通知しない。
+func (rsm *RoomStatusManager) evaluateAlerts(ctx context.Context) error {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rst := &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+	}
+	statuses, err := rst.getRoomStatuses(ctx, `1=1`)
+	if err != nil {
+		return err
+	}
+	tx.Rollback()
+
+	now := time.Now()
+	seen := map[RoomID]struct{}{}
+	for _, rs := range statuses {
+		seen[rs.RoomID] = struct{}{}
+		state := rsm.alertStates[rs.RoomID]
+		choice := dominantChoice(rs)
+		if rs.Total < uint64(rsm.config.AlertMinVotes) {
+			choice = ""
+		}
+
+		switch choice {
+		case Hot, Cold:
+			if state == nil || state.choice != choice {
+				if state != nil && state.fired {
+					rsm.sendAlert(ctx, "resolved", rs.RoomID, state, now)
+				}
+				rsm.alertStates[rs.RoomID] = &roomAlertState{choice: choice, since: now}
+				continue
+			}
+			if !state.fired && now.Sub(state.since) >= rsm.config.AlertDuration {
+				// 送信に失敗した場合は、次の周期に再送する
+				state.fired = rsm.sendAlert(ctx, "firing", rs.RoomID, state, now)
+			}
+		case Comfort:
+			if state != nil && state.fired {
+				rsm.sendAlert(ctx, "resolved", rs.RoomID, state, now)
+			}
+			delete(rsm.alertStates, rs.RoomID)
+		default:
+			// 過半数を占める選択肢がなくなった場合、不快な状態が途切れたとみなす。
+			// ただし通知済みの場合は、快適に戻るまで通知を解除しない。
+			if state != nil && !state.fired {
+				delete(rsm.alertStates, rs.RoomID)
+			}
+		}
+	}
+	// 削除された部屋の状態を破棄する
+	for id := range rsm.alertStates {
+		if _, ok := seen[id]; !ok {
+			delete(rsm.alertStates, id)
+		}
+	}
+	return nil
+}
+
+// 通知をWebhookへ送信し、成功したかどうかを返す。
+func (rsm *RoomStatusManager) sendAlert(ctx context.Context, status string, id RoomID, state *roomAlertState, now time.Time) bool {
+	alert := ComfortAlert{
+		Status:          status,
+		RoomID:          id,
+		Choice:          state.choice,
+		Since:           state.since,
+		DurationSeconds: int64(now.Sub(state.since).Seconds()),
+	}
+	if err := postWebhook(ctx, rsm.config.AlertWebhookURL, &alert); err != nil {
+		rsm.config.Logger.Error("failed to send comfort alert", "error", err, "room_id", id, "status", status)
+		return false
+	}
+	rsm.config.Logger.Info("sent comfort alert", "room_id", id, "status", status, "choice", state.choice)
+	return true
+}
+
+// センサーの接続状態が変化したことを表す通知。
+// TextはSlackのIncoming Webhookでそのまま表示できるように付与する。
+type SensorAlert struct {
+	Text string `json:"text"`
+	// "disconnected"または"connected"
+	Status      string    `json:"status"`
+	RoomID      RoomID    `json:"roomId"`
+	ThingName   ThingName `json:"thingName"`
+	LastUpdated int64     `json:"lastUpdated"`
+	// 接続状態が変化した時刻
+	Since time.Time `json:"since"`
+}
+
+// センサー毎の接続状態。connLockで保護する。
+type connState struct {
+	// 直近に観測した接続状態と、その状態になった時刻
+	connected bool
+	since     time.Time
+	// 最後に通知した接続状態
+	reported    bool
+	lastUpdated int64
+}
+
+// センサーの接続状態を記録する。最初の観測は基準とし、通知しない。
+func (rsm *RoomStatusManager) observeConnection(id RoomID, name ThingName, connected bool, lastUpdated int64) {
+	if rsm.config.SensorWebhookURL == "" {
+		return
+	}
+	rsm.connLock.Lock()
+	defer rsm.connLock.Unlock()
+
+	key := sensorKey{id, name}
+	state, ok := rsm.connStates[key]
+	if !ok {
+		rsm.connStates[key] = &connState{
+			connected:   connected,
+			since:       time.Now(),
+			reported:    connected,
+			lastUpdated: lastUpdated,
+		}
+		return
+	}
+	if state.connected != connected {
+		state.connected = connected
+		state.since = time.Now()
+	}
+	state.lastUpdated = lastUpdated
+}
+
+// 接続状態がSensorAlertGracePeriod以上続いているセンサーのうち、
+// 最後に通知した状態と異なるものを通知する。猶予期間内に元に戻った場合は通知しない。
+func (rsm *RoomStatusManager) notifyConnectionChanges(ctx context.Context) {
+	now := time.Now()
+	var alerts []SensorAlert
+	rsm.connLock.Lock()
+	for key, state := range rsm.connStates {
+		if state.connected == state.reported || now.Sub(state.since) < rsm.config.SensorAlertGracePeriod {
+			continue
+		}
+		alert := SensorAlert{
+			Status:      "disconnected",
+			RoomID:      key.RoomID,
+			ThingName:   key.ThingName,
+			LastUpdated: state.lastUpdated,
+			Since:       state.since,
+		}
+		alert.Text = fmt.Sprintf("Sensor %s in room %d is disconnected", key.ThingName, key.RoomID)
+		if state.connected {
+			alert.Status = "connected"
+			alert.Text = fmt.Sprintf("Sensor %s in room %d is connected again", key.ThingName, key.RoomID)
+		}
+		alerts = append(alerts, alert)
+	}
+	rsm.connLock.Unlock()
+
+	for _, alert := range alerts {
+		if err := postWebhook(ctx, rsm.config.SensorWebhookURL, &alert); err != nil {
+			// 通知済みにしないことで、次の周期に再送する
+			rsm.config.Logger.Error("failed to send sensor alert", "error", err, "thing_name", alert.ThingName, "room_id", alert.RoomID)
+			continue
+		}
+		rsm.config.Logger.Info("sent sensor alert", "thing_name", alert.ThingName, "room_id", alert.RoomID, "status", alert.Status)
+
+		rsm.connLock.Lock()
+		if state, ok := rsm.connStates[sensorKey{alert.RoomID, alert.ThingName}]; ok {
+			state.reported = alert.Status == "connected"
+		}
+		rsm.connLock.Unlock()
+	}
+}
+
+// Thingの接続状態の記録を、すべての部屋から削除する。
+func (rsm *RoomStatusManager) forgetConnection(name ThingName) {
+	rsm.connLock.Lock()
+	defer rsm.connLock.Unlock()
+	for key := range rsm.connStates {
+		if key.ThingName == name {
+			delete(rsm.connStates, key)
+		}
+	}
+}
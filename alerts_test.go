@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDominantChoice(t *testing.T) {
+	cases := []struct {
+		rs   *RoomStatus
+		want VoteChoice
+	}{
+		{&RoomStatus{}, ""},
+		{&RoomStatus{VeryHot: 1, Hot: 1, Comfort: 1, Total: 3}, Hot},
+		{&RoomStatus{VeryCold: 2, Comfort: 1, Total: 3}, Cold},
+		{&RoomStatus{Comfort: 3, Hot: 1, Total: 4}, Comfort},
+		{&RoomStatus{Hot: 1, Cold: 1, Total: 2}, ""},
+	}
+	for _, c := range cases {
+		if got := dominantChoice(c.rs); got != c.want {
+			t.Errorf("dominantChoice(%d/%d/%d/%d/%d) = %q, want %q", c.rs.VeryHot, c.rs.Hot, c.rs.Comfort, c.rs.Cold, c.rs.VeryCold, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateAlerts(t *testing.T) {
+	var lock sync.Mutex
+	var alerts []ComfortAlert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var a ComfortAlert
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		alerts = append(alerts, a)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.AlertWebhookURL = ts.URL
+	rsm.config.AlertDuration = time.Millisecond
+	rsm.config.AlertMinVotes = 2
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1);
+		INSERT INTO session (session_id, secret_sha256, expire) VALUES (1, '', datetime('now', '+1 day'));
+		INSERT INTO session (session_id, secret_sha256, expire) VALUES (2, '', datetime('now', '+1 day'));
+		INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (1, 1, 'hot', datetime('now'));
+		INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (2, 1, 'very_hot', datetime('now'));
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	// 1回目は不快な状態の開始を記録するだけで、通知しない
+	if err := rsm.evaluateAlerts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("alerts = %+v, want none", alerts)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := rsm.evaluateAlerts(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(alerts) != 1 || alerts[0].Status != "firing" || alerts[0].RoomID != 1 || alerts[0].Choice != Hot {
+		t.Fatalf("alerts = %+v, want one firing alert for room 1", alerts)
+	}
+
+	if _, err := rsm.db.Exec(`UPDATE vote SET choice='comfort'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.evaluateAlerts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 || alerts[1].Status != "resolved" || alerts[1].Choice != Hot {
+		t.Fatalf("alerts = %+v, want a resolved alert", alerts)
+	}
+	if len(rsm.alertStates) != 0 {
+		t.Errorf("alertStates = %+v, want empty", rsm.alertStates)
+	}
+}
+
+func TestEvaluateAlertsMinVotes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("unexpected alert")
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.AlertWebhookURL = ts.URL
+	rsm.config.AlertDuration = time.Millisecond
+	rsm.config.AlertMinVotes = 2
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1);
+		INSERT INTO session (session_id, secret_sha256, expire) VALUES (1, '', datetime('now', '+1 day'));
+		INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (1, 1, 'cold', datetime('now'));
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := rsm.evaluateAlerts(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(rsm.alertStates) != 0 {
+		t.Errorf("alertStates = %+v, want empty", rsm.alertStates)
+	}
+}
+
+func TestNotifyConnectionChanges(t *testing.T) {
+	var lock sync.Mutex
+	var alerts []SensorAlert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var a SensorAlert
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		alerts = append(alerts, a)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.SensorWebhookURL = ts.URL
+	rsm.config.SensorAlertGracePeriod = 10 * time.Millisecond
+	ctx := context.Background()
+
+	// 最初の観測は通知しない
+	rsm.observeConnection(1, "thing", true, 0)
+	rsm.notifyConnectionChanges(ctx)
+	if len(alerts) != 0 {
+		t.Fatalf("alerts = %+v, want none", alerts)
+	}
+
+	// 猶予期間内に復帰した場合は通知しない
+	rsm.observeConnection(1, "thing", false, 0)
+	rsm.notifyConnectionChanges(ctx)
+	rsm.observeConnection(1, "thing", true, 0)
+	time.Sleep(20 * time.Millisecond)
+	rsm.notifyConnectionChanges(ctx)
+	if len(alerts) != 0 {
+		t.Fatalf("alerts = %+v, want none", alerts)
+	}
+
+	rsm.observeConnection(1, "thing", false, 42)
+	time.Sleep(20 * time.Millisecond)
+	rsm.notifyConnectionChanges(ctx)
+	rsm.notifyConnectionChanges(ctx)
+	if len(alerts) != 1 || alerts[0].Status != "disconnected" || alerts[0].ThingName != "thing" || alerts[0].LastUpdated != 42 || alerts[0].Text == "" {
+		t.Fatalf("alerts = %+v, want one disconnected alert", alerts)
+	}
+
+	rsm.observeConnection(1, "thing", true, 43)
+	time.Sleep(20 * time.Millisecond)
+	rsm.notifyConnectionChanges(ctx)
+	if len(alerts) != 2 || alerts[1].Status != "connected" {
+		t.Fatalf("alerts = %+v, want a connected alert", alerts)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// 設定を読み込む環境変数の接頭辞。(ex: TEMVOTE_DB_URL)
+	ENV_PREFIX = "TEMVOTE"
+)
+
+// 設定の不備を表すエラー。未設定の必須項目と、不正な値の項目をすべて列挙する。
+type ConfigError struct {
+	// 未設定の必須項目の環境変数名
+	Missing []string
+	// 不正な値の項目の説明
+	Invalid []string
+}
+
+func (e *ConfigError) Error() string {
+	var msgs []string
+	if len(e.Missing) > 0 {
+		msgs = append(msgs, "missing required environment variables: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		msgs = append(msgs, "invalid environment variables: "+strings.Join(e.Invalid, "; "))
+	}
+	return "config: " + strings.Join(msgs, "; ")
+}
+
+// 環境変数から設定を読み込み、検証する。
+// 省略可能な項目は、使用する側(getRouterやRSMConfig.withDefaults)でデフォルト値を補う。
+func LoadConfigFromEnv() (RouterOption, error) {
+	var opt RouterOption
+	if err := envconfig.Process(ENV_PREFIX, &opt); err != nil {
+		return opt, fmt.Errorf("config: %w", err)
+	}
+	if err := opt.Validate(); err != nil {
+		return opt, err
+	}
+	return opt, nil
+}
+
+// 必須の項目が設定されていて、各項目の値が妥当かどうかを検証する。
+// 問題がある場合は、すべての問題を含む*ConfigErrorを返す。
+func (opt RouterOption) Validate() error {
+	env := func(name string) string {
+		return ENV_PREFIX + "_" + name
+	}
+	cerr := &ConfigError{}
+
+	for _, r := range []struct {
+		name  string
+		value string
+	}{
+		{"DB_DRIVER", opt.DBDriver},
+		{"DB_URL", opt.DBUrl},
+		{"THINGWORX_URL", opt.ThingWorxURL},
+	} {
+		// シミュレーションではThingWorxに接続しない
+		if r.name == "THINGWORX_URL" && opt.Simulate {
+			continue
+		}
+		if strings.TrimSpace(r.value) == "" {
+			cerr.Missing = append(cerr.Missing, env(r.name))
+		}
+	}
+
+	if opt.CORSAllowCredentials {
+		for _, o := range opt.CORSAllowedOrigins {
+			if o == "*" {
+				// 任意のサイトからCookie付きで読み出せると、CSRFトークンも読み出せてしまう
+				cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: can not contain \"*\" when %s is set", env("CORS_ALLOWED_ORIGINS"), env("CORS_ALLOW_CREDENTIALS")))
+				break
+			}
+		}
+	}
+
+	if opt.Simulate && opt.ThingWorxURL != "" {
+		// 本番環境の設定のままシミュレーションを有効にしても、起動しないようにする
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: can not be used with %s", env("SIMULATE"), env("THINGWORX_URL")))
+	}
+
+	if err := ValidatePropertiesPathTemplate(opt.ThingWorxPropertiesPath); err != nil {
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: must contain %s", env("THINGWORX_PROPERTIES_PATH"), ThingNamePlaceholder))
+	}
+
+	if err := ValidateBaseURL(opt.PublicBaseURL); err != nil {
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: %s", env("PUBLIC_BASE_URL"), err))
+	}
+
+	switch opt.DBDriver {
+	case "", "mysql", "postgres", "sqlite3":
+	default:
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: unsupported driver %q", env("DB_DRIVER"), opt.DBDriver))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"SENSOR_REFRESH_INTERVAL", opt.SensorRefreshInterval},
+		{"SENSOR_CACHE_EXPIRE", opt.SensorCacheExpire},
+		{"SENSOR_MIN_REFRESH_GAP", opt.SensorMinRefreshGap},
+		{"SENSOR_STALE_RETENTION", opt.SensorStaleRetention},
+		{"SENSOR_CONNECTED_THRESHOLD", opt.SensorConnectedThreshold},
+		{"SENSOR_HISTORY_RETENTION", opt.SensorHistoryRetention},
+		{"VOTE_TTL", opt.VoteTTL},
+		{"MIN_VOTE_INTERVAL", opt.MinVoteInterval},
+		{"VOTE_EVENT_RETENTION", opt.VoteEventRetention},
+		{"SESSION_TTL", opt.SessionTTL},
+		{"ALERT_DURATION", opt.AlertDuration},
+		{"SENSOR_ALERT_GRACE_PERIOD", opt.SensorAlertGracePeriod},
+		{"ROOM_INFO_TTL", opt.RoomInfoTTL},
+		{"INTEGRITY_SWEEP_INTERVAL", opt.IntegritySweepInterval},
+		{"ROOM_REFRESH_INTERVAL", opt.RoomRefreshInterval},
+		{"DB_QUERY_TIMEOUT", opt.DBQueryTimeout},
+		{"SIMULATE_VOTE_INTERVAL", opt.SimulateVoteInterval},
+	} {
+		if d.value < 0 {
+			cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: must not be negative", env(d.name)))
+		}
+	}
+
+	for _, r := range []struct {
+		min, max string
+		value    ValueRange
+	}{
+		{"SENSOR_MIN_TEMPERATURE", "SENSOR_MAX_TEMPERATURE", DefaultTemperatureRange.Override(opt.SensorMinTemperature, opt.SensorMaxTemperature)},
+		{"SENSOR_MIN_HUMIDITY", "SENSOR_MAX_HUMIDITY", DefaultHumidityRange.Override(opt.SensorMinHumidity, opt.SensorMaxHumidity)},
+	} {
+		if r.value.Min > r.value.Max {
+			cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: must not be greater than %s", env(r.min), env(r.max)))
+		}
+	}
+
+	if opt.SensorSmoothingAlpha < 0 || opt.SensorSmoothingAlpha > 1 {
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: must be between 0 and 1", env("SENSOR_SMOOTHING_ALPHA")))
+	}
+
+	if sameSite, err := ParseSameSite(opt.CookieSameSite); err != nil {
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: %s", env("COOKIE_SAME_SITE"), err))
+	} else if sameSite == http.SameSiteNoneMode && opt.CookieInsecure {
+		// ブラウザはSecure属性のないSameSite=NoneのCookieを拒否する
+		cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: none requires secure cookies, but %s is set", env("COOKIE_SAME_SITE"), env("COOKIE_INSECURE")))
+	}
+
+	if opt.LogLevel != "" {
+		var lv slog.Level
+		if err := lv.UnmarshalText([]byte(opt.LogLevel)); err != nil {
+			cerr.Invalid = append(cerr.Invalid, fmt.Sprintf("%s: unknown level %q", env("LOG_LEVEL"), opt.LogLevel))
+		}
+	}
+
+	if len(cerr.Missing) == 0 && len(cerr.Invalid) == 0 {
+		return nil
+	}
+	return cerr
+}
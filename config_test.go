@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "sqlite3")
+	t.Setenv("TEMVOTE_DB_URL", "./temvote.db")
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	t.Setenv("TEMVOTE_SENSOR_REFRESH_INTERVAL", "30s")
+	t.Setenv("TEMVOTE_SESSION_TTL", "720h")
+	t.Setenv("TEMVOTE_CORS_ALLOWED_ORIGINS", "https://a.example.com,https://b.example.com")
+
+	opt, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.DBDriver != "sqlite3" || opt.DBUrl != "./temvote.db" || opt.ThingWorxURL != "https://example.com/Thingworx" {
+		t.Errorf("should read required values, but result is %+v", opt)
+	}
+	if opt.SensorRefreshInterval != 30*time.Second || opt.SessionTTL != 720*time.Hour {
+		t.Errorf("should parse durations, but result is %v and %v", opt.SensorRefreshInterval, opt.SessionTTL)
+	}
+	if len(opt.CORSAllowedOrigins) != 2 {
+		t.Errorf("should split comma separated values, but result is %v", opt.CORSAllowedOrigins)
+	}
+}
+
+func TestLoadConfigFromEnvMissing(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "")
+	t.Setenv("TEMVOTE_DB_URL", "")
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	t.Setenv("TEMVOTE_VOTE_TTL", "-1h")
+	t.Setenv("TEMVOTE_LOG_LEVEL", "verbose")
+	t.Setenv("TEMVOTE_THINGWORX_PROPERTIES_PATH", "/Things/Properties/")
+
+	_, err := LoadConfigFromEnv()
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("should return *ConfigError, but result is %v", err)
+	}
+	if strings.Join(cerr.Missing, ",") != "TEMVOTE_DB_DRIVER,TEMVOTE_DB_URL" {
+		t.Errorf("should list all missing values, but result is %v", cerr.Missing)
+	}
+	if len(cerr.Invalid) != 3 {
+		t.Errorf("should list invalid VOTE_TTL, LOG_LEVEL and THINGWORX_PROPERTIES_PATH, but result is %v", cerr.Invalid)
+	}
+	if !strings.Contains(err.Error(), "TEMVOTE_DB_URL") {
+		t.Errorf("should mention missing values in the message, but result is %q", err.Error())
+	}
+}
+
+func TestLoadConfigFromEnvParseError(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "sqlite3")
+	t.Setenv("TEMVOTE_DB_URL", "./temvote.db")
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	t.Setenv("TEMVOTE_SESSION_TTL", "ten minutes")
+
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Error("should return an error for unparsable duration")
+	}
+}
+
+func TestLoadConfigFromEnvCORSWildcardCredentials(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "sqlite3")
+	t.Setenv("TEMVOTE_DB_URL", "./temvote.db")
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	t.Setenv("TEMVOTE_CORS_ALLOWED_ORIGINS", "*")
+	t.Setenv("TEMVOTE_CORS_ALLOW_CREDENTIALS", "true")
+
+	_, err := LoadConfigFromEnv()
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || len(cerr.Invalid) != 1 || !strings.Contains(cerr.Invalid[0], "TEMVOTE_CORS_ALLOWED_ORIGINS") {
+		t.Errorf("should reject a wildcard origin with credentials, but result is %v", err)
+	}
+}
+
+func TestLoadConfigFromEnvSensorRange(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "sqlite3")
+	t.Setenv("TEMVOTE_DB_URL", "./temvote.db")
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	t.Setenv("TEMVOTE_SENSOR_MAX_TEMPERATURE", "40")
+	t.Setenv("TEMVOTE_SENSOR_MIN_HUMIDITY", "10")
+
+	opt, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 指定しなかった境界は、0ではなくデフォルトの範囲の値を使用する
+	if r := DefaultTemperatureRange.Override(opt.SensorMinTemperature, opt.SensorMaxTemperature); r != (ValueRange{Min: -30, Max: 40}) {
+		t.Errorf("should keep the default minimum temperature, but result is %+v", r)
+	}
+	if r := DefaultHumidityRange.Override(opt.SensorMinHumidity, opt.SensorMaxHumidity); r != (ValueRange{Min: 10, Max: 100}) {
+		t.Errorf("should keep the default maximum humidity, but result is %+v", r)
+	}
+
+	// デフォルトの最小値より小さい最大値だけを指定した場合は、範囲が空になるため拒否する
+	t.Setenv("TEMVOTE_SENSOR_MAX_TEMPERATURE", "-40")
+	_, err = LoadConfigFromEnv()
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || len(cerr.Invalid) != 1 || !strings.Contains(cerr.Invalid[0], "TEMVOTE_SENSOR_MIN_TEMPERATURE") {
+		t.Errorf("should reject an empty temperature range, but result is %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// プリフライトリクエストの結果をブラウザがキャッシュする時間
+	CORS_MAX_AGE = 10 * time.Minute
+)
+
+var (
+	DefaultCORSAllowedMethods = []string{"GET", "POST", "DELETE"}
+	DefaultCORSAllowedHeaders = []string{"Content-Type", REQUEST_ID_HEADER, IDEMPOTENCY_KEY_HEADER, CSRF_TOKEN_HEADER}
+	// 別オリジンのスクリプトから読み出せるようにするレスポンスのヘッダー
+	CORSExposedHeaders = []string{REQUEST_ID_HEADER, LAST_REFRESH_HEADER, CSRF_TOKEN_HEADER}
+)
+
+// 別オリジンからのリクエストを許可するための設定。
+type CORSConfig struct {
+	// 許可するオリジン。(ex: "https://example.com") "*"はすべてのオリジンを許可する。
+	// 空の場合、CORSのヘッダーは付与しない。
+	AllowedOrigins []string
+	// 許可するメソッドとリクエストヘッダー。空の場合はデフォルト値を使用する。
+	AllowedMethods []string
+	AllowedHeaders []string
+	// セッションのCookieを含むリクエストを許可する。
+	// 許可した場合、Access-Control-Allow-Originには"*"ではなくリクエスト元のオリジンを返す。
+	// どのサイトからでもCSRFトークンを読み出せてしまうため、"*"に一致しただけのオリジンには許可しない。
+	AllowCredentials bool
+}
+
+func (c CORSConfig) allowOrigin(origin string) bool {
+	return c.wildcard() || c.listed(origin)
+}
+
+// "*"ではなく、オリジンが明示的に許可されているかどうかを返す。
+func (c CORSConfig) listed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) wildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSのヘッダーを付与するハンドラーを返す。
+// プリフライトリクエストはnextへ渡さずに応答するため、DBへのアクセスは発生しない。
+func (c CORSConfig) Handler(next http.Handler) http.Handler {
+	if len(c.AllowedOrigins) == 0 {
+		return next
+	}
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSAllowedMethods
+	}
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSAllowedHeaders
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !c.allowOrigin(origin) {
+			if preflight {
+				writeError(w, req, http.StatusForbidden, errors.New("origin is not allowed"))
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		credentials := c.AllowCredentials && c.listed(origin)
+		if c.wildcard() && !credentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// Cookieを含むリクエストでは、"*"は使用できない
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORS_MAX_AGE.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(CORSExposedHeaders, ", "))
+		next.ServeHTTP(w, req)
+	})
+}
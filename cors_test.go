@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	var called bool
+	h := CORSConfig{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowCredentials: true,
+	}.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest("OPTIONS", "/api/v1/status?room=1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if called {
+		t.Error("should not pass preflight requests to the next handler")
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("should return 204, but status is %d", w.Code)
+	}
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "https://example.com" {
+		t.Errorf("should allow the origin, but Access-Control-Allow-Origin is %q", v)
+	}
+	if v := w.Header().Get("Access-Control-Allow-Credentials"); v != "true" {
+		t.Errorf("should allow credentials, but Access-Control-Allow-Credentials is %q", v)
+	}
+	if v := w.Header().Get("Access-Control-Allow-Methods"); v != "GET, POST, DELETE" {
+		t.Errorf("should return default methods, but Access-Control-Allow-Methods is %q", v)
+	}
+
+	// 許可されていないオリジン
+	req = httptest.NewRequest("OPTIONS", "/api/v1/status?room=1", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("should return 403 for disallowed origin, but status is %d", w.Code)
+	}
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("should not allow the origin, but Access-Control-Allow-Origin is %q", v)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	})
+	tests := []struct {
+		credentials bool
+		expected    string
+	}{
+		{false, "*"},
+		// "*"に一致しただけのオリジンには、Cookieを含むリクエストを許可しない
+		{true, "*"},
+	}
+	for _, tt := range tests {
+		h := CORSConfig{
+			AllowedOrigins:   []string{"*"},
+			AllowCredentials: tt.credentials,
+		}.Handler(next)
+		req := httptest.NewRequest("GET", "/api/v1/status?room=1", nil)
+		req.Header.Set("Origin", "https://example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Errorf("credentials=%v: should pass the request to the next handler, but status is %d", tt.credentials, w.Code)
+		}
+		if v := w.Header().Get("Access-Control-Allow-Origin"); v != tt.expected {
+			t.Errorf("credentials=%v: expected Access-Control-Allow-Origin %q, but result is %q", tt.credentials, tt.expected, v)
+		}
+		if v := w.Header().Get("Access-Control-Allow-Credentials"); v != "" {
+			t.Errorf("credentials=%v: should not allow credentials for a wildcard match, but result is %q", tt.credentials, v)
+		}
+	}
+
+	// 明示的に許可したオリジンには、"*"と併記していてもCookieを含むリクエストを許可する
+	h := CORSConfig{
+		AllowedOrigins:   []string{"*", "https://example.com"},
+		AllowCredentials: true,
+	}.Handler(next)
+	req := httptest.NewRequest("GET", "/api/v1/status?room=1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("should allow credentials for a listed origin, but headers are %v", w.Header())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CSRFトークンを格納するCookie。JavaScriptから読み出せるように、HttpOnly属性は付与しない。
+	CSRF_TOKEN_COOKIE = "temvote_csrf_token"
+	// 状態を変更するリクエストで、CSRFトークンを受け取るヘッダー
+	CSRF_TOKEN_HEADER = "X-CSRF-Token"
+	// 管理者用APIのパス。トークンのヘッダーで認証するリクエストには、CSRFトークンを要求しない。
+	ADMIN_API_PREFIX = "/api/v1/admin"
+)
+
+// セッションの秘密情報から、そのセッションのCSRFトークンを求める。
+// 秘密情報はHttpOnlyのCookieにのみ保存されるため、他のオリジンのページからトークンを求めることはできない。
+func csrfToken(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("temvote csrf token"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// リクエストのCookieのセッションに紐付いたCSRFトークンが、ヘッダーとCookieの両方に含まれているかどうかを返す。
+func validCSRFToken(req *http.Request) bool {
+	secret, err := req.Cookie(SESSION_SECRET_COOKIE)
+	if err != nil || secret.Value == "" {
+		return false
+	}
+	cookie, err := req.Cookie(CSRF_TOKEN_COOKIE)
+	if err != nil {
+		return false
+	}
+	given := req.Header.Get(CSRF_TOKEN_HEADER)
+	if given == "" {
+		return false
+	}
+	expected := csrfToken(secret.Value)
+	headerOK := subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+	cookieOK := subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(expected)) == 1
+	return headerOK && cookieOK
+}
+
+// 状態を変更するリクエスト(投票、投票の取り消し、ログアウトなど)に、CSRFトークンを要求するハンドラーを返す。
+// GETなどの安全なメソッドと、BearerトークンまたはX-Admin-Tokenヘッダーで認証する管理者用APIは対象外。
+// Basic認証の認証情報はブラウザが自動的に送信するため、Basic認証を含む管理者用APIのリクエストには要求する。
+// トークンがない場合や一致しない場合は403を返す。
+func CSRFHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, ADMIN_API_PREFIX+"/") && adminToken(req) != "" {
+			// 別のオリジンのページは、プリフライトなしでこれらのヘッダーを付与できない
+			if _, _, basic := req.BasicAuth(); !basic {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+		if !validCSRFToken(req) {
+			logRequestf(req, "WARN: CSRF token is missing or invalid: %s %s\n", req.Method, req.URL.Path)
+			writeError(w, req, http.StatusForbidden, errors.New("CSRF token is missing or invalid"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	h := CSRFHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	token := csrfToken("secret")
+
+	for _, c := range []struct {
+		name   string
+		method string
+		path   string
+		secret string
+		cookie string
+		header string
+		// 管理者用APIの認証方法。"basic"、"bearer"、"token"のいずれか
+		auth   string
+		status int
+	}{
+		{"valid", "POST", "/api/v1/status", "secret", token, token, "", http.StatusNoContent},
+		{"unvote", "DELETE", "/api/v1/status", "secret", token, token, "", http.StatusNoContent},
+		{"missing header", "POST", "/api/v1/status", "secret", token, "", "", http.StatusForbidden},
+		{"missing cookie", "POST", "/api/v1/status", "secret", "", token, "", http.StatusForbidden},
+		{"mismatched header", "POST", "/api/v1/status", "secret", token, "wrong", "", http.StatusForbidden},
+		{"mismatched cookie", "POST", "/logout", "secret", "wrong", token, "", http.StatusForbidden},
+		// 別のセッションのトークン
+		{"other session", "POST", "/api/v1/status", "other", token, token, "", http.StatusForbidden},
+		{"no session", "POST", "/api/v1/status", "", token, token, "", http.StatusForbidden},
+		// 安全なメソッドと、トークンのヘッダーで認証する管理者用APIは対象外
+		{"get", "GET", "/api/v1/status", "", "", "", "", http.StatusNoContent},
+		{"admin bearer", "POST", "/api/v1/admin/rooms", "", "", "", "bearer", http.StatusNoContent},
+		{"admin token", "DELETE", "/api/v1/admin/rooms/1", "", "", "", "token", http.StatusNoContent},
+		// ブラウザが自動的に送信するBasic認証やCookieだけの管理者用APIは対象
+		{"admin basic", "POST", "/api/v1/admin/rooms", "", "", "", "basic", http.StatusForbidden},
+		{"admin no auth", "POST", "/api/v1/admin/rooms", "", "", "", "", http.StatusForbidden},
+		{"admin basic with token", "POST", "/api/v1/admin/rooms", "", "", "", "basic+token", http.StatusForbidden},
+		{"admin basic with csrf token", "POST", "/api/v1/admin/rooms", "secret", token, token, "basic", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.secret != "" {
+			req.AddCookie(&http.Cookie{Name: SESSION_SECRET_COOKIE, Value: c.secret})
+		}
+		if c.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: CSRF_TOKEN_COOKIE, Value: c.cookie})
+		}
+		if c.header != "" {
+			req.Header.Set(CSRF_TOKEN_HEADER, c.header)
+		}
+		switch c.auth {
+		case "basic":
+			req.SetBasicAuth("admin", "password")
+		case "bearer":
+			req.Header.Set("Authorization", "Bearer admin-token")
+		case "token":
+			req.Header.Set(ADMIN_TOKEN_HEADER, "admin-token")
+		case "basic+token":
+			req.SetBasicAuth("admin", "password")
+			req.Header.Set(ADMIN_TOKEN_HEADER, "admin-token")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: should return %d, but status is %d", c.name, c.status, w.Code)
+		}
+	}
+}
+
+func TestSessionCSRFToken(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	w := httptest.NewRecorder()
+	rst.s.w = w
+	rst.s.secret = "secret"
+	rst.s.Save()
+
+	// Saveで書き込んだCookieのトークンで、リクエストが受け付けられること
+	req := httptest.NewRequest("POST", "/api/v1/status", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	req.Header.Set(CSRF_TOKEN_HEADER, rst.CSRFToken())
+	if !validCSRFToken(req) {
+		t.Error("should accept the token of the session")
+	}
+
+	rst.s = nil
+	if token := rst.CSRFToken(); token != "" {
+		t.Errorf("should return an empty token for nil session, but result is %q", token)
+	}
+}
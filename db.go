@@ -1,7 +1,8 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"strconv"
 	"time"
 )
@@ -9,12 +10,44 @@ import (
 type VoteChoice string
 type VoteID uint64
 
+// 投票の選択肢。DBのvote.choice列には、この文字列がそのまま格納される。
+//
+//	very_hot  : とても暑い
+//	hot       : 暑い
+//	comfort   : 快適
+//	cold      : 寒い
+//	very_cold : とても寒い
+//
+// 3段階評価だった頃の投票(hot, comfort, cold)は、5段階評価の同じ値として扱う。
 const (
-	Hot     = VoteChoice("hot")
-	Comfort = VoteChoice("comfort")
-	Cold    = VoteChoice("cold")
+	VeryHot  = VoteChoice("very_hot")
+	Hot      = VoteChoice("hot")
+	Comfort  = VoteChoice("comfort")
+	Cold     = VoteChoice("cold")
+	VeryCold = VoteChoice("very_cold")
 )
 
+// 投票の選択肢として有効な値かどうかを返す。
+func (c VoteChoice) IsValid() bool {
+	switch c {
+	case VeryHot, Hot, Comfort, Cold, VeryCold:
+		return true
+	}
+	return false
+}
+
+// 投票の選択肢として無効な値であることを表すエラー
+var ErrInvalidVoteChoice = errors.New("vote must be one of very_hot, hot, comfort, cold and very_cold")
+
+// 文字列を投票の選択肢として解釈する。無効な値の場合はErrInvalidVoteChoiceを返す。
+func ParseVoteChoice(s string) (VoteChoice, error) {
+	c := VoteChoice(s)
+	if !c.IsValid() {
+		return "", ErrInvalidVoteChoice
+	}
+	return c, nil
+}
+
 type Vote struct {
 	VoteID    VoteID
 	RoomID    RoomID
@@ -23,28 +56,33 @@ type Vote struct {
 	Timestamp time.Time
 }
 
-// 投票内容を変更する。VoteID, RoomID, Sが指定されていなければならない。
-// 初投票の場合は、VoteIDはデフォルト値(VoteID(0))に設定すること。
-func (v *Vote) UpdateChoice(tx *sql.Tx, choice VoteChoice) error {
+// 投票内容を変更する。RoomIDとSが指定されていなければならない。
+// 初投票かどうかに関わらず、セッションと部屋の組の一意制約を使って1文で追加または更新するため、
+// 同じセッションから同時に投票されても、投票が重複して記録されることはない。
+// 初投票で追加された行のvote_idは取得しないため、VoteIDは更新しない。
+func (v *Vote) UpdateChoice(ctx context.Context, tx *dbTx, choice VoteChoice) error {
 	now := time.Now()
-	if v.VoteID == VoteID(0) {
-		// 初投票の場合
-		if _, err := tx.Exec(`
-			INSERT INTO vote(
-				session_id, room_id, choice, timestamp
-			) VALUES (?, ?, ?, ?)`,
-			v.S.SessionID, v.RoomID, string(choice), now,
-		); err != nil {
-			return err
-		}
-	} else {
-		// 投票内容を変更する場合
-		if _, err := tx.Exec(`
-			UPDATE vote SET choice=?, timestamp=? WHERE vote_id=?`,
-			string(choice), now, v.VoteID,
-		); err != nil {
-			return err
-		}
+	if _, err := tx.ExecContext(ctx,
+		tx.dialect.Upsert("vote", []string{"session_id", "room_id"}, "session_id", "room_id", "choice", "timestamp"),
+		v.S.SessionID, v.RoomID, string(choice), now,
+	); err != nil {
+		return err
+	}
+	// 集計の推移を後から分析できるように、投票の度に履歴を残す
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO vote_event(
+			session_id, room_id, choice, timestamp
+		) VALUES (?, ?, ?, ?)`,
+		v.S.SessionID, v.RoomID, string(choice), now,
+	); err != nil {
+		return err
+	}
+	// 投票したことのあるセッションは、セッションの削除後や履歴の保持期間を過ぎた後も数えられるように残す
+	if _, err := tx.ExecContext(ctx,
+		tx.dialect.InsertIgnore("room_voter", "room_id", "session_id"),
+		v.RoomID, v.S.SessionID,
+	); err != nil {
+		return err
 	}
 	v.Choice = choice
 	v.Timestamp = now
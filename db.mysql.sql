@@ -8,7 +8,9 @@ CREATE TABLE room (
   room_id       BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
   name          TEXT NOT NULL COMMENT 'ex: 研A402',
   building_name TEXT NOT NULL COMMENT 'ex: 研究棟A',
-  floor         INT  NOT NULL COMMENT '地下階はマイナスの値、地上階はプラスの値。0は存在しない'
+  floor         INT  NOT NULL COMMENT '地下階はマイナスの値、地上階はプラスの値。0は存在しない',
+  target_temp_min DOUBLE NULL COMMENT '目標とする気温の下限。NULLの場合は下限なし',
+  target_temp_max DOUBLE NULL COMMENT '目標とする気温の上限。NULLの場合は上限なし'
 ) CHARSET = 'utf8';
 
 CREATE TABLE thing (
@@ -16,6 +18,7 @@ CREATE TABLE thing (
   room_id      BIGINT UNSIGNED          NOT NULL,
   thing_name   CHAR(32)                 NOT NULL,
   update_cycle INT UNSIGNED DEFAULT 60  NOT NULL COMMENT '単位: 秒',
+  label        VARCHAR(64)              NULL     COMMENT 'センサーの表示名(ex: 窓側)。NULLの場合はThing名を表示する',
 
   UNIQUE (room_id, thing_name),
   FOREIGN KEY (room_id) REFERENCES room (room_id)
@@ -26,12 +29,46 @@ CREATE TABLE vote (
   vote_id    BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
   session_id BIGINT UNSIGNED NOT NULL,
   room_id    BIGINT UNSIGNED NOT NULL,
-  choice     CHAR(10)        NOT NULL COMMENT 'hot, comfort, coldのいずれか',
+  choice     CHAR(10)        NOT NULL COMMENT 'very_hot, hot, comfort, cold, very_coldのいずれか',
   timestamp  DATETIME        NOT NULL COMMENT '投票時刻',
 
+  UNIQUE KEY vote_session_room (session_id, room_id),
   FOREIGN KEY (session_id) REFERENCES session (session_id)
     ON DELETE CASCADE,
   FOREIGN KEY (room_id) REFERENCES room (room_id)
     ON DELETE CASCADE
 );
 
+CREATE TABLE sensor_reading (
+  reading_id  BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+  room_id     BIGINT UNSIGNED NOT NULL,
+  thing_name  CHAR(32)        NOT NULL,
+  temperature DOUBLE          NULL     COMMENT 'NULLの場合、センサーは気温を測定していない',
+  humidity    DOUBLE          NULL     COMMENT 'NULLの場合、センサーは湿度を測定していない',
+  timestamp   DATETIME        NOT NULL COMMENT 'センサーの測定時刻',
+
+  INDEX (room_id, timestamp),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE vote_event (
+  event_id   BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+  session_id BIGINT UNSIGNED NOT NULL COMMENT 'セッションの削除後も残すため、外部キーにしない',
+  room_id    BIGINT UNSIGNED NOT NULL,
+  choice     CHAR(10)        NOT NULL,
+  timestamp  DATETIME        NOT NULL COMMENT '投票時刻',
+
+  INDEX (room_id, timestamp),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE room_voter (
+  room_id    BIGINT UNSIGNED NOT NULL,
+  session_id BIGINT UNSIGNED NOT NULL COMMENT 'セッションの削除後も残すため、外部キーにしない',
+
+  PRIMARY KEY (room_id, session_id),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
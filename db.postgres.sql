@@ -0,0 +1,78 @@
+CREATE TABLE session (
+  session_id    BIGSERIAL PRIMARY KEY,
+  secret_sha256 CHAR(64)                 NOT NULL, -- '16進数表記',
+  expire        TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE room (
+  room_id       BIGSERIAL PRIMARY KEY,
+  name          TEXT NOT NULL, -- 'ex: 研A402',
+  building_name TEXT NOT NULL, -- 'ex: 研究棟A',
+  floor         INT  NOT NULL, -- '地下階はマイナスの値、地上階はプラスの値。0は存在しない'
+  target_temp_min DOUBLE PRECISION, -- '目標とする気温の下限。NULLの場合は下限なし'
+  target_temp_max DOUBLE PRECISION  -- '目標とする気温の上限。NULLの場合は上限なし'
+);
+
+-- CHAR型は値の末尾が空白で埋められるため、文字列を比較する列にはVARCHAR型を使用する
+CREATE TABLE thing (
+  thing_id     BIGSERIAL PRIMARY KEY,
+  room_id      BIGINT              NOT NULL,
+  thing_name   VARCHAR(32)         NOT NULL,
+  update_cycle INTEGER DEFAULT 60  NOT NULL, -- '単位: 秒',
+  label        VARCHAR(64),                  -- 'センサーの表示名(ex: 窓側)。NULLの場合はThing名を表示する',
+
+  UNIQUE (room_id, thing_name),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE vote (
+  vote_id    BIGSERIAL PRIMARY KEY,
+  session_id BIGINT                   NOT NULL,
+  room_id    BIGINT                   NOT NULL,
+  choice     VARCHAR(10)              NOT NULL, -- 'very_hot, hot, comfort, cold, very_coldのいずれか',
+  timestamp  TIMESTAMP WITH TIME ZONE NOT NULL, -- '投票時刻',
+
+  -- セッション毎に部屋への投票は1つ。投票し直した場合は同じ行を更新する
+  CONSTRAINT vote_session_room UNIQUE (session_id, room_id),
+  FOREIGN KEY (session_id) REFERENCES session (session_id)
+    ON DELETE CASCADE,
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE TABLE sensor_reading (
+  reading_id  BIGSERIAL PRIMARY KEY,
+  room_id     BIGINT                   NOT NULL,
+  thing_name  VARCHAR(32)              NOT NULL,
+  temperature DOUBLE PRECISION,                  -- 'NULLの場合、センサーは気温を測定していない'
+  humidity    DOUBLE PRECISION,                  -- 'NULLの場合、センサーは湿度を測定していない'
+  timestamp   TIMESTAMP WITH TIME ZONE NOT NULL, -- 'センサーの測定時刻',
+
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE INDEX sensor_reading_room_timestamp ON sensor_reading (room_id, timestamp);
+
+CREATE TABLE vote_event (
+  event_id   BIGSERIAL PRIMARY KEY,
+  session_id BIGINT                   NOT NULL, -- 'セッションの削除後も残すため、外部キーにしない',
+  room_id    BIGINT                   NOT NULL,
+  choice     VARCHAR(10)              NOT NULL,
+  timestamp  TIMESTAMP WITH TIME ZONE NOT NULL, -- '投票時刻',
+
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE INDEX vote_event_room_timestamp ON vote_event (room_id, timestamp);
+
+CREATE TABLE room_voter (
+  room_id    BIGINT NOT NULL,
+  session_id BIGINT NOT NULL, -- 'セッションの削除後も残すため、外部キーにしない',
+
+  PRIMARY KEY (room_id, session_id),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
@@ -8,7 +8,9 @@ CREATE TABLE room (
   room_id       INTEGER PRIMARY KEY AUTOINCREMENT,
   name          TEXT NOT NULL, -- 'ex: 研A402',
   building_name TEXT NOT NULL, -- 'ex: 研究棟A',
-  floor         INT  NOT NULL  -- '地下階はマイナスの値、地上階はプラスの値。0は存在しない'
+  floor         INT  NOT NULL, -- '地下階はマイナスの値、地上階はプラスの値。0は存在しない'
+  target_temp_min REAL,          -- '目標とする気温の下限。NULLの場合は下限なし'
+  target_temp_max REAL           -- '目標とする気温の上限。NULLの場合は上限なし'
 );
 
 CREATE TABLE thing (
@@ -16,6 +18,7 @@ CREATE TABLE thing (
   room_id      INTEGER             NOT NULL,
   thing_name   CHAR(32)            NOT NULL,
   update_cycle INTEGER DEFAULT 60  NOT NULL, -- '単位: 秒',
+  label        TEXT,                -- 'センサーの表示名(ex: 窓側)。NULLの場合はThing名を表示する',
 
   UNIQUE (room_id, thing_name),
   FOREIGN KEY (room_id) REFERENCES room (room_id)
@@ -26,12 +29,49 @@ CREATE TABLE vote (
   vote_id    INTEGER  PRIMARY KEY AUTOINCREMENT,
   session_id INTEGER  NOT NULL,
   room_id    INTEGER  NOT NULL,
-  choice     CHAR(10) NOT NULL, -- 'hot, comfort, coldのいずれか',
+  choice     CHAR(10) NOT NULL, -- 'very_hot, hot, comfort, cold, very_coldのいずれか',
   timestamp  DATETIME NOT NULL, -- '投票時刻',
 
+  -- セッション毎に部屋への投票は1つ。投票し直した場合は同じ行を更新する
+  CONSTRAINT vote_session_room UNIQUE (session_id, room_id),
   FOREIGN KEY (session_id) REFERENCES session (session_id)
     ON DELETE CASCADE,
   FOREIGN KEY (room_id) REFERENCES room (room_id)
     ON DELETE CASCADE
 );
 
+CREATE TABLE sensor_reading (
+  reading_id  INTEGER PRIMARY KEY AUTOINCREMENT,
+  room_id     INTEGER  NOT NULL,
+  thing_name  CHAR(32) NOT NULL,
+  temperature REAL,              -- 'NULLの場合、センサーは気温を測定していない'
+  humidity    REAL,              -- 'NULLの場合、センサーは湿度を測定していない'
+  timestamp   DATETIME NOT NULL, -- 'センサーの測定時刻',
+
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE INDEX sensor_reading_room_timestamp ON sensor_reading (room_id, timestamp);
+
+CREATE TABLE vote_event (
+  event_id   INTEGER  PRIMARY KEY AUTOINCREMENT,
+  session_id INTEGER  NOT NULL, -- 'セッションの削除後も残すため、外部キーにしない',
+  room_id    INTEGER  NOT NULL,
+  choice     CHAR(10) NOT NULL,
+  timestamp  DATETIME NOT NULL, -- '投票時刻',
+
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
+
+CREATE INDEX vote_event_room_timestamp ON vote_event (room_id, timestamp);
+
+CREATE TABLE room_voter (
+  room_id    INTEGER NOT NULL,
+  session_id INTEGER NOT NULL, -- 'セッションの削除後も残すため、外部キーにしない',
+
+  PRIMARY KEY (room_id, session_id),
+  FOREIGN KEY (room_id) REFERENCES room (room_id)
+    ON DELETE CASCADE
+);
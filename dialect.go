@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 1つのクエリの実行がqueryTimeoutを超えた場合のエラー。
+var ErrQueryTimeout = errors.New("database query timed out")
+
+// SQLの方言。プレースホルダーの形式や、方言に依存するSQLを切り替える。
+type Dialect int
+
+const (
+	// MySQL/MariaDB。プレースホルダーは"?"。
+	DialectMySQL Dialect = iota
+	// PostgreSQL。プレースホルダーは"$1", "$2", ...。
+	DialectPostgres
+	// SQLite。プレースホルダーはMySQLと同じ"?"。
+	DialectSQLite
+)
+
+// database/sqlのドライバー名から方言を返す。
+func DialectOf(driver string) Dialect {
+	switch driver {
+	case "postgres", "pgx":
+		return DialectPostgres
+	case "sqlite3":
+		return DialectSQLite
+	}
+	return DialectMySQL
+}
+
+// "?"形式のプレースホルダーを、方言に合わせた形式に書き換える。
+// 文字列リテラルと引用符で囲まれた識別子の中の"?"は書き換えない。
+func (d Dialect) Rebind(query string) string {
+	if d != DialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	var quote rune
+	n := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// keysの列の一意制約に違反する行があればその行を更新し、なければ行を追加するINSERT文を返す。
+// 1文で実行するため、同時に実行しても重複した行は作られない。
+// 既存の行はその場で更新するため、自動採番の列の値は変わらない。
+// (MySQLでは、keysの列以外の一意制約に違反した場合も更新になることに注意)
+func (d Dialect) Upsert(table string, keys []string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	isKey := map[string]bool{}
+	for _, k := range keys {
+		isKey[k] = true
+	}
+	var sets []string
+	for _, c := range columns {
+		if isKey[c] {
+			continue
+		}
+		if d == DialectMySQL {
+			sets = append(sets, c+"=VALUES("+c+")")
+		} else {
+			sets = append(sets, c+"=EXCLUDED."+c)
+		}
+	}
+
+	query := "INSERT INTO " + table + "(" + strings.Join(columns, ", ") + ") VALUES (" + placeholders + ")"
+	if d == DialectMySQL {
+		return query + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+	return query + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// 一意制約に違反する行があれば何もせず、なければ行を追加するINSERT文を返す。
+func (d Dialect) InsertIgnore(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if d == DialectMySQL {
+		return "INSERT IGNORE INTO " + table + "(" + strings.Join(columns, ", ") + ") VALUES (" + placeholders + ")"
+	}
+	return "INSERT INTO " + table + "(" + strings.Join(columns, ", ") + ") VALUES (" + placeholders + ") ON CONFLICT DO NOTHING"
+}
+
+// 方言に合わせてプレースホルダーを書き換えるトランザクション。
+// クエリは常に"?"形式のプレースホルダーで記述すること。
+//
+// queryTimeoutが0より大きい場合、クエリ毎に呼び出し元のcontextより短い期限を設定する。
+// クライアントの振る舞いに関わらず、時間の掛かるクエリがコネクションを占有し続けないようにするため。
+type dbTx struct {
+	*sql.Tx
+	dialect      Dialect
+	queryTimeout time.Duration
+}
+
+func beginTx(ctx context.Context, db *sql.DB, dialect Dialect, queryTimeout time.Duration) (*dbTx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{Tx: tx, dialect: dialect, queryTimeout: queryTimeout}, nil
+}
+
+// クエリ1つ分の期限を設定したcontextを返す。
+func (tx *dbTx) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if tx.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, tx.queryTimeout)
+}
+
+// クエリの期限を過ぎたことによるエラーを、ErrQueryTimeoutに置き換える。
+// 呼び出し元のcontextが終了した場合のエラーはそのまま返す。
+func queryError(parent, ctx context.Context, err error) error {
+	if err != nil && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrQueryTimeout, err)
+	}
+	return err
+}
+
+func (tx *dbTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	qctx, cancel := tx.queryContext(ctx)
+	defer cancel()
+	res, err := tx.Tx.ExecContext(qctx, tx.dialect.Rebind(query), args...)
+	return res, queryError(ctx, qctx, err)
+}
+
+// 結果の読み込みが終わるまでクエリの期限を保つため、Closeで期限を解除する*sql.Rows。
+type dbRows struct {
+	*sql.Rows
+	parent, ctx context.Context
+	cancel      context.CancelFunc
+}
+
+func (rows *dbRows) Err() error {
+	return queryError(rows.parent, rows.ctx, rows.Rows.Err())
+}
+
+func (rows *dbRows) Scan(dest ...interface{}) error {
+	return queryError(rows.parent, rows.ctx, rows.Rows.Scan(dest...))
+}
+
+func (rows *dbRows) Close() error {
+	defer rows.cancel()
+	return rows.Rows.Close()
+}
+
+func (tx *dbTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*dbRows, error) {
+	qctx, cancel := tx.queryContext(ctx)
+	rows, err := tx.Tx.QueryContext(qctx, tx.dialect.Rebind(query), args...)
+	if err != nil {
+		cancel()
+		return nil, queryError(ctx, qctx, err)
+	}
+	return &dbRows{Rows: rows, parent: ctx, ctx: qctx, cancel: cancel}, nil
+}
+
+// Scanを呼び出すまでクエリの期限を保つ*sql.Row。
+type dbRow struct {
+	row         *sql.Row
+	parent, ctx context.Context
+	cancel      context.CancelFunc
+}
+
+func (row *dbRow) Scan(dest ...interface{}) error {
+	defer row.cancel()
+	return queryError(row.parent, row.ctx, row.row.Scan(dest...))
+}
+
+func (row *dbRow) Err() error {
+	return queryError(row.parent, row.ctx, row.row.Err())
+}
+
+func (tx *dbTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbRow {
+	qctx, cancel := tx.queryContext(ctx)
+	return &dbRow{
+		row:    tx.Tx.QueryRowContext(qctx, tx.dialect.Rebind(query), args...),
+		parent: ctx,
+		ctx:    qctx,
+		cancel: cancel,
+	}
+}
+
+// contextを受け取らないメソッドは、プレースホルダーを書き換えずに実行されることを防ぐために、
+// 埋め込んだ*sql.Txのメソッドを隠す。
+func (tx *dbTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *dbTx) Query(query string, args ...interface{}) (*dbRows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *dbTx) QueryRow(query string, args ...interface{}) *dbRow {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+// INSERT文を実行し、追加した行のIDを返す。idColumnは自動採番される列の名前。
+// PostgreSQLはLastInsertIdに対応していないため、RETURNING句でIDを取得する。
+func (tx *dbTx) InsertID(ctx context.Context, idColumn, query string, args ...interface{}) (int64, error) {
+	if tx.dialect == DialectPostgres {
+		var id int64
+		err := tx.QueryRowContext(ctx, query+" RETURNING "+idColumn, args...).Scan(&id)
+		return id, err
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 部屋の状態と投票から、弱いETagを計算する。
+// センサーの値と投票数が変わった場合にだけ変化するように、AgeSecondsのような
+// 時間の経過とともに変わる値は含めない。extraには、レスポンスに含まれるその他の値を指定する。
+func statusETag(statuses []*RoomStatus, myVote *MyVote, extra ...string) string {
+	h := sha1.New()
+	for _, rs := range statuses {
+		rs.writeETagInput(h)
+	}
+	if myVote != nil {
+		fmt.Fprintf(h, "my:%s:%d;", myVote.Vote, myVote.Timestamp)
+	}
+	for _, e := range extra {
+		fmt.Fprintf(h, "x:%q;", e)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+func (rs *RoomStatus) writeETagInput(w io.Writer) {
+	fmt.Fprintf(w, "room:%d;", rs.RoomID)
+	// Sensorsの順序はキャッシュのmapの順序に依存するため、並べ替えてから書き込む
+	sensors := make([]string, 0, len(rs.Sensors))
+	for _, s := range rs.Sensors {
+		sensors = append(sensors, fmt.Sprintf("s:%q:%q:%v:%v:%d:%t:%t;", s.ThingName, s.Label, optionalValue(s.Temperature), optionalValue(s.Humidity), s.LastUpdated, s.IsConnected, s.Stale))
+	}
+	sort.Strings(sensors)
+	io.WriteString(w, strings.Join(sensors, ""))
+	fmt.Fprintf(w, "v:%d:%d:%d:%d:%d:%d;", rs.VeryHot, rs.Hot, rs.Comfort, rs.Cold, rs.VeryCold, rs.Other)
+	optional := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	fmt.Fprintf(w, "t:%s:%s;", optional(rs.TargetTempMin), optional(rs.TargetTempMax))
+}
+
+// ETagをレスポンスヘッダーに設定し、If-None-Matchと一致する場合は304を返してtrueを返す。
+// 弱いETagとして比較するため、"W/"の有無は区別しない。
+func checkETag(w http.ResponseWriter, req *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	inm := req.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusETag(t *testing.T) {
+	newStatus := func() *RoomStatus {
+		return &RoomStatus{
+			RoomID: 1,
+			Sensors: []SensorStatus{
+				{Temperature: float64Ptr(24), Humidity: float64Ptr(50), LastUpdated: 100, IsConnected: true, AgeSeconds: 3},
+				{Temperature: float64Ptr(25), Humidity: float64Ptr(40), LastUpdated: 100, IsConnected: true, AgeSeconds: 3},
+			},
+			Hot:   1,
+			Total: 1,
+		}
+	}
+	base := statusETag([]*RoomStatus{newStatus()}, nil)
+
+	// 経過時間とセンサーの順序は影響しない
+	rs := newStatus()
+	rs.Sensors[0], rs.Sensors[1] = rs.Sensors[1], rs.Sensors[0]
+	rs.Sensors[0].AgeSeconds = 60
+	if etag := statusETag([]*RoomStatus{rs}, nil); etag != base {
+		t.Errorf("should not change ETag, but %s != %s", etag, base)
+	}
+
+	rs = newStatus()
+	rs.Sensors[0].Temperature = float64Ptr(24.5)
+	if etag := statusETag([]*RoomStatus{rs}, nil); etag == base {
+		t.Error("should change ETag when sensor readings change")
+	}
+
+	rs = newStatus()
+	rs.Cold = 1
+	if etag := statusETag([]*RoomStatus{rs}, nil); etag == base {
+		t.Error("should change ETag when vote counts change")
+	}
+
+	if etag := statusETag([]*RoomStatus{newStatus()}, &MyVote{Vote: Hot, Timestamp: 1}); etag == base {
+		t.Error("should change ETag when my vote changes")
+	}
+}
+
+func TestCheckETag(t *testing.T) {
+	etag := `W/"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		notModified bool
+	}{
+		{"", false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{`*`, true},
+		{`W/"xyz"`, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/status?room=1", nil)
+		if tt.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		if got := checkETag(w, req, etag); got != tt.notModified {
+			t.Errorf("checkETag with If-None-Match %q should return %t, but result is %t", tt.ifNoneMatch, tt.notModified, got)
+		}
+		if tt.notModified && w.Code != http.StatusNotModified {
+			t.Errorf("should respond 304, but status is %d", w.Code)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("should set ETag header, but result is %q", w.Header().Get("ETag"))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSVの列名。投票数は5段階の選択肢毎に出力する。
+var statusCSVHeader = []string{
+	"building", "floor", "room_id", "room_name",
+	"avg_temperature", "avg_humidity", "connected_sensors",
+	"very_hot", "hot", "comfort", "cold", "very_cold",
+}
+
+// すべての部屋の状態を、建物、階、部屋IDの順にCSVで書き込む。
+// 部屋はMAX_ROOMS_PAGE_LIMIT件ずつ読み込んで書き込むため、部屋の数に比例してメモリを使用することはない。
+func (rst *RoomStatusTx) WriteStatusCSV(ctx context.Context, w io.Writer) (err error) {
+	ctx, span := rst.startSpan(ctx, "WriteStatusCSV")
+	defer func() { endSpan(span, err) }()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(statusCSVHeader); err != nil {
+		return err
+	}
+
+	for offset := 0; ; offset += MAX_ROOMS_PAGE_LIMIT {
+		rooms, _, err := rst.GetRoomsPage(ctx, offset, MAX_ROOMS_PAGE_LIMIT)
+		if err != nil {
+			return err
+		}
+		if len(rooms) == 0 {
+			break
+		}
+
+		placeholders := make([]string, len(rooms))
+		args := make([]interface{}, len(rooms))
+		for i, r := range rooms {
+			placeholders[i] = "?"
+			args[i] = r.RoomID
+		}
+		statuses, err := rst.getRoomStatuses(ctx, `room.room_id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[RoomID]*RoomStatus, len(statuses))
+		for _, rs := range statuses {
+			byID[rs.RoomID] = rs
+		}
+
+		for _, r := range rooms {
+			rs, ok := byID[r.RoomID]
+			if !ok {
+				// ページの読み込み後に削除された部屋
+				continue
+			}
+			if err := cw.Write(statusCSVRecord(r, rs)); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		if len(rooms) < MAX_ROOMS_PAGE_LIMIT {
+			break
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func statusCSVRecord(r RoomInfo, rs *RoomStatus) []string {
+	// 接続中のセンサーがない場合、平均値は空欄にする
+	optional := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', 1, 64)
+	}
+	count := func(n uint64) string {
+		return strconv.FormatUint(n, 10)
+	}
+	return []string{
+		string(r.Building),
+		strconv.FormatInt(int64(r.Floor), 10),
+		strconv.FormatUint(uint64(r.RoomID), 10),
+		r.Name,
+		optional(rs.AvgTemperature),
+		optional(rs.AvgHumidity),
+		strconv.Itoa(rs.SensorCount),
+		count(rs.VeryHot),
+		count(rs.Hot),
+		count(rs.Comfort),
+		count(rs.Cold),
+		count(rs.VeryCold),
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestWriteStatusCSV(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	temperature, humidity := 24.0, 50.0
+	rsm.sensorCache[2] = map[ThingName]SensorStatus{
+		"thing": {Temperature: &temperature, Humidity: &humidity, IsConnected: true, expire: time.Now().Add(time.Minute)},
+	}
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'B101', 'B', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'A201, "annex"', 'A', 2);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := rst.WriteStatusCSV(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		statusCSVHeader,
+		{"A", "2", "2", `A201, "annex"`, "24.0", "50.0", "1", "0", "0", "0", "0", "0"},
+		{"B", "1", "1", "B101", "", "", "0", "0", "1", "0", "0", "0"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("should write %d records, but result is %v", len(want), records)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if records[i][j] != want[i][j] {
+				t.Errorf("record %d column %s should be %q, but result is %q", i, statusCSVHeader[j], want[i][j], records[i][j])
+			}
+		}
+	}
+}
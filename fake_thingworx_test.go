@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	dproxy "github.com/koron/go-dproxy"
+)
+
+// テスト用のPropertyReader。登録したプロパティやエラーをそのまま返す。
+type FakeThingWorx struct {
+	lock  sync.Mutex
+	props map[ThingName]map[string]interface{}
+	errs  map[ThingName]error
+	calls map[ThingName]int
+}
+
+func NewFakeThingWorx() *FakeThingWorx {
+	return &FakeThingWorx{
+		props: make(map[ThingName]map[string]interface{}),
+		errs:  make(map[ThingName]error),
+		calls: make(map[ThingName]int),
+	}
+}
+
+// Thingの気温、湿度、最終更新時刻を登録する。
+func (f *FakeThingWorx) Set(name ThingName, temperature, humidity float64, lastUpdated time.Time) {
+	f.SetProperties(name, map[string]interface{}{
+		"temperature": temperature,
+		"humidity":    humidity,
+		"lastUpdated": float64(lastUpdated.UnixNano() / int64(time.Millisecond)),
+	})
+}
+
+// Thingのプロパティをそのまま登録する。
+func (f *FakeThingWorx) SetProperties(name ThingName, props map[string]interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.props[name] = props
+	delete(f.errs, name)
+}
+
+// Thingのプロパティの読み出しで返すエラーを登録する。
+func (f *FakeThingWorx) SetError(name ThingName, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.errs[name] = err
+}
+
+// Propertiesが呼び出された回数を返す。
+func (f *FakeThingWorx) Calls(name ThingName) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[name]
+}
+
+func (f *FakeThingWorx) Properties(ctx context.Context, name ThingName) (dproxy.Proxy, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls[name]++
+	if err := f.errs[name]; err != nil {
+		return nil, err
+	}
+	props, ok := f.props[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoThingData, string(name))
+	}
+	return dproxy.New(props), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+// 階毎の部屋の状態の集計。
+// Hot、Comfort、Coldは、その選択肢が投票の過半数を占める部屋の数。(とても暑いは暑いに、とても寒いは寒いに含める)
+type FloorSummary struct {
+	Floor   FloorID `json:"floor"`
+	Rooms   int     `json:"rooms"`
+	Hot     int     `json:"hot"`
+	Comfort int     `json:"comfort"`
+	Cold    int     `json:"cold"`
+	// 接続中のセンサーが1台もない部屋の数
+	NoSensorData int `json:"noSensorData"`
+}
+
+// 建物の部屋の状態を階毎に集計する。部屋がない建物の場合は空のmapを返す。
+func (rst *RoomStatusTx) GetFloorSummary(ctx context.Context, building BuildingName) (_ map[FloorID]FloorSummary, err error) {
+	ctx, span := rst.startSpan(ctx, "GetFloorSummary", attribute.String("room.building", string(building)))
+	defer func() { endSpan(span, err) }()
+
+	votes, votesArgs := rst.rsm.countedVotes(`vote.room_id IN (SELECT room_id FROM room WHERE building_name=?)`, string(building))
+	args := []interface{}{string(VeryHot), string(Hot), string(Comfort), string(Cold), string(VeryCold)}
+	args = append(args, votesArgs...)
+	rows, err := rst.tx.QueryContext(ctx, `
+		SELECT room.room_id, room.floor,
+			sum(CASE WHEN v.choice IN (?, ?) THEN 1 ELSE 0 END),
+			sum(CASE WHEN v.choice=? THEN 1 ELSE 0 END),
+			sum(CASE WHEN v.choice IN (?, ?) THEN 1 ELSE 0 END),
+			count(v.choice)
+		FROM room LEFT JOIN (`+votes+`) v ON v.room_id=room.room_id
+		WHERE room.building_name=?
+		GROUP BY room.room_id, room.floor
+	`, append(args, string(building))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make(map[FloorID]FloorSummary)
+	for rows.Next() {
+		var id RoomID
+		var floor FloorID
+		var hot, comfort, cold, total uint64
+		if err := rows.Scan(&id, &floor, &hot, &comfort, &cold, &total); err != nil {
+			return nil, err
+		}
+
+		s := summaries[floor]
+		s.Floor = floor
+		s.Rooms++
+		switch {
+		case total == 0:
+		case hot*2 > total:
+			s.Hot++
+		case cold*2 > total:
+			s.Cold++
+		case comfort*2 > total:
+			s.Comfort++
+		}
+		if !rst.rsm.hasLiveSensor(id) {
+			s.NoSensorData++
+		}
+		summaries[floor] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// 部屋に、接続中で有効期限内の状態がキャッシュされているセンサーがあるかどうかを返す。
+func (rsm *RoomStatusManager) hasLiveSensor(id RoomID) bool {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+
+	now := time.Now()
+	for _, stat := range rsm.sensorCache[id] {
+		if stat.IsConnected && stat.expire.After(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetFloorSummary(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	if _, err := rst.tx.ExecContext(ctx, `
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'hot', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'tie', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (3, 'cold', 'building', 2);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (4, 'other', 'other', 2);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	votes := []struct {
+		room   RoomID
+		choice VoteChoice
+	}{
+		{1, VeryHot}, {1, Hot}, {1, Comfort},
+		{2, Hot}, {2, Comfort},
+		{3, VeryCold},
+		{4, Comfort},
+	}
+	for i, v := range votes {
+		if _, err := rst.tx.ExecContext(ctx,
+			`INSERT INTO session (session_id, secret_sha256, expire) VALUES (?, '', ?)`,
+			100+i, time.Now().Add(time.Hour),
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rst.tx.ExecContext(ctx,
+			`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, ?, ?, ?)`,
+			100+i, v.room, string(v.choice), time.Now(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"thing1": {IsConnected: true, expire: time.Now().Add(time.Minute)},
+	}
+	rsm.sensorCache[2] = map[ThingName]SensorStatus{
+		"thing2": {IsConnected: false, expire: time.Now().Add(time.Minute)},
+	}
+
+	summaries, err := rst.GetFloorSummary(ctx, "building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[FloorID]FloorSummary{
+		1: {Floor: 1, Rooms: 2, Hot: 1, NoSensorData: 1},
+		2: {Floor: 2, Rooms: 1, Cold: 1, NoSensorData: 1},
+	}
+	if len(summaries) != len(expected) {
+		t.Fatalf("should return %d floors, but result is %+v", len(expected), summaries)
+	}
+	for floor, e := range expected {
+		if s := summaries[floor]; s != e {
+			t.Errorf("floor %d should be %+v, but result is %+v", floor, e, s)
+		}
+	}
+
+	summaries, err = rst.GetFloorSummary(ctx, "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summaries == nil || len(summaries) != 0 {
+		t.Errorf("should return an empty map, but result is %+v", summaries)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// これより小さいレスポンスは、圧縮しても効果が小さいため圧縮しない
+	GZIP_MIN_SIZE = 1024
+)
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// クライアントがgzipを受け入れる場合に、レスポンスをgzipで圧縮するハンドラーを返す。
+// minSizeバイト未満のレスポンスと、圧縮済みのレスポンスは圧縮しない。minSizeが0以下の場合はGZIP_MIN_SIZE。
+func GzipHandler(next http.Handler, minSize int) http.Handler {
+	if minSize <= 0 {
+		minSize = GZIP_MIN_SIZE
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// WebSocketはHijackして独自に読み書きするため、ラップしない
+		if !acceptsGzip(req) || req.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.Close()
+		next.ServeHTTP(gw, req)
+	})
+}
+
+// Accept-Encodingにgzipが含まれ、q=0で拒否されていないかどうかを返す。
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[len("q="):], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// 圧縮しても小さくならない、または既に圧縮されているContent-Typeかどうかを返す。
+func incompressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "image/svg"),
+		strings.HasPrefix(ct, "video/"),
+		strings.HasPrefix(ct, "audio/"),
+		strings.HasPrefix(ct, "application/zip"),
+		strings.HasPrefix(ct, "application/gzip"),
+		// Server-Sent Eventsはイベント毎にFlushするため、圧縮するとバッファリングされてしまう
+		strings.HasPrefix(ct, "text/event-stream"):
+		return true
+	}
+	return false
+}
+
+// 最初のminSizeバイトをバッファリングし、圧縮するかどうかを決めてから書き込むResponseWriter。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.minSize {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ヘッダーとバッファリングした内容から圧縮するかどうかを決め、ヘッダーとバッファを書き込む。
+func (w *gzipResponseWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// 圧縮後の内容から推測されないように、元の内容から推測しておく
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	compress := len(w.buf) >= w.minSize &&
+		h.Get("Content-Encoding") == "" &&
+		!incompressible(h.Get("Content-Type")) &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		// Flushした時点の内容で圧縮するかどうかを決める
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// バッファリングしている内容を書き込み、gzipのストリームを閉じる。
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// ハンドラーが何も書き込まなかった場合は、net/httpに任せる
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	large := strings.Repeat(`{"temperature":24.5,"humidity":50}`, 100)
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(large))
+		case "/small":
+			w.Write([]byte("ok"))
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(large))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		}
+	}), 0)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"/large", "gzip, deflate", true},
+		{"/large", "", false},
+		{"/large", "gzip;q=0", false},
+		{"/small", "gzip", false},
+		{"/encoded", "gzip", false},
+		{"/image", "gzip", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: should set Vary, but result is %q", tt.path, w.Header().Get("Vary"))
+		}
+		gzipped := w.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != tt.gzipped {
+			t.Errorf("%s with %q: gzipped should be %t, but result is %t", tt.path, tt.acceptEncoding, tt.gzipped, gzipped)
+			continue
+		}
+		if !gzipped {
+			continue
+		}
+		r, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != large {
+			t.Errorf("%s: decompressed body does not match", tt.path)
+		}
+	}
+}
+
+func TestGzipHandlerStatusCode(t *testing.T) {
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+	}), 0)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("should pass through small error responses, but status is %d and encoding is %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+)
+
+// 気温(℃)と相対湿度(%)から、体感温度として暑さ指数(Heat Index, ℃)を計算する。
+// 米国気象局(NWS)の計算方法に従う。
+// https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml
+//
+// 湿度が不明な場合や、計算式の適用範囲外(気温が4.4℃(40°F)未満)の場合は、
+// 気温をそのまま返し、okにfalseを返す。
+func HeatIndex(temperature, humidity float64) (hi float64, ok bool) {
+	if math.IsNaN(humidity) || humidity <= 0 || humidity > 100 || math.IsNaN(temperature) {
+		return temperature, false
+	}
+
+	t := temperature*9/5 + 32
+	if t < 40 {
+		return temperature, false
+	}
+	rh := humidity
+
+	// 暑さ指数が80°F未満の場合は、簡易式の値を使用する
+	f := 0.5 * (t + 61.0 + (t-68.0)*1.2 + rh*0.094)
+	if (f+t)/2 >= 80 {
+		f = -42.379 + 2.04901523*t + 10.14333127*rh -
+			0.22475541*t*rh - 0.00683783*t*t -
+			0.05481717*rh*rh + 0.00122874*t*t*rh +
+			0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+		switch {
+		case rh < 13 && t >= 80 && t <= 112:
+			f -= ((13 - rh) / 4) * math.Sqrt((17-math.Abs(t-95))/17)
+		case rh > 85 && t >= 80 && t <= 87:
+			f += ((rh - 85) / 10) * ((87 - t) / 5)
+		}
+	}
+	return (f - 32) * 5 / 9, true
+}
+
+// 気温(℃)と相対湿度(%)から、Magnusの式で露点温度(℃)を計算する。
+// https://en.wikipedia.org/wiki/Dew_point#Calculating_the_dew_point
+//
+// 湿度が不明な場合は、okにfalseを返す。
+func DewPoint(temperature, humidity float64) (dp float64, ok bool) {
+	if math.IsNaN(humidity) || humidity <= 0 || humidity > 100 || math.IsNaN(temperature) {
+		return 0, false
+	}
+
+	const a, b = 17.62, 243.12
+	gamma := math.Log(humidity/100) + a*temperature/(b+temperature)
+	return b * gamma / (a - gamma), true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHeatIndex(t *testing.T) {
+	tests := []struct {
+		temperature float64
+		humidity    float64
+		expected    float64
+		ok          bool
+	}{
+		// NWSの暑さ指数表の値 (90°F, 70% => 106°F)
+		{32.2222, 70, 41.1, true},
+		// 湿度が高いほど、体感温度は高くなる
+		{26, 30, 25.4, true},
+		{26, 70, 26.5, true},
+		// 湿度が不明
+		{26, 0, 26, false},
+		{26, math.NaN(), 26, false},
+		// 適用範囲外
+		{0, 50, 0, false},
+	}
+	for _, test := range tests {
+		hi, ok := HeatIndex(test.temperature, test.humidity)
+		if ok != test.ok || math.Abs(hi-test.expected) > 0.1 {
+			t.Errorf("HeatIndex(%f, %f) should be (%.1f, %t), but result is (%.1f, %t)",
+				test.temperature, test.humidity, test.expected, test.ok, hi, ok)
+		}
+	}
+}
+
+func TestDewPoint(t *testing.T) {
+	tests := []struct {
+		temperature float64
+		humidity    float64
+		expected    float64
+		ok          bool
+	}{
+		{25, 60, 16.7, true},
+		// 飽和している場合は、気温と同じになる
+		{20, 100, 20, true},
+		{-5, 80, -7.9, true},
+		// 湿度が不明
+		{25, 0, 0, false},
+		{25, math.NaN(), 0, false},
+	}
+	for _, test := range tests {
+		dp, ok := DewPoint(test.temperature, test.humidity)
+		if ok != test.ok || math.Abs(dp-test.expected) > 0.1 {
+			t.Errorf("DewPoint(%f, %f) should be (%.1f, %t), but result is (%.1f, %t)",
+				test.temperature, test.humidity, test.expected, test.ok, dp, ok)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// センサーの測定値の履歴を保持する期間
+	HISTORY_RETENTION = 7 * 24 * time.Hour
+)
+
+// 履歴として保存されたセンサーの測定値
+type SensorReading struct {
+	RoomID    RoomID    `json:"roomId"`
+	ThingName ThingName `json:"thingName"`
+	// センサーが測定していない値はnil
+	Temperature *float64  `json:"temperature"`
+	Humidity    *float64  `json:"humidity"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type sensorKey struct {
+	RoomID    RoomID
+	ThingName ThingName
+}
+
+// 前回の保存以降に更新された、接続中のセンサーの測定値をsensor_readingテーブルに追加する。
+func (rsm *RoomStatusManager) recordSensorReadings(ctx context.Context) error {
+	var readings []SensorReading
+	for id, cache := range rsm.CacheSnapshot() {
+		for name, stat := range cache {
+			key := sensorKey{id, name}
+			if !stat.IsConnected || stat.LastUpdated <= rsm.lastRecorded[key] {
+				// 未接続のセンサーや、前回から更新されていない値は保存しない
+				continue
+			}
+			if stat.Temperature == nil && stat.Humidity == nil {
+				// 気温も湿度も測定していないセンサーは、保存する値がない
+				continue
+			}
+			readings = append(readings, SensorReading{
+				RoomID:      id,
+				ThingName:   name,
+				Temperature: stat.measuredTemperature(),
+				Humidity:    stat.Humidity,
+				Timestamp:   time.Unix(stat.LastUpdated, 0),
+			})
+		}
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range readings {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO sensor_reading(
+				room_id, thing_name, temperature, humidity, timestamp
+			) VALUES (?, ?, ?, ?, ?)`,
+			r.RoomID, string(r.ThingName), r.Temperature, r.Humidity, r.Timestamp,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, r := range readings {
+		rsm.lastRecorded[sensorKey{r.RoomID, r.ThingName}] = r.Timestamp.Unix()
+	}
+	rsm.config.Logger.Debug("recorded sensor readings", "count", len(readings))
+	return nil
+}
+
+// 保持期間を過ぎたセンサーの測定値の履歴を削除する。
+func (rsm *RoomStatusManager) cleanUpOldSensorReadings(ctx context.Context) error {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM sensor_reading WHERE timestamp<?`,
+		time.Now().Add(-rsm.config.HistoryRetention),
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 指定した時刻以降の、部屋のセンサーの測定値の履歴を古い順に返す。
+func (rst *RoomStatusTx) GetSensorHistory(ctx context.Context, id RoomID, since time.Time) (_ []SensorReading, err error) {
+	ctx, span := rst.startSpan(ctx, "GetSensorHistory", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	rows, err := rst.tx.QueryContext(ctx,
+		`SELECT thing_name, temperature, humidity, timestamp FROM sensor_reading
+		WHERE room_id=? AND timestamp>=?
+		ORDER BY timestamp`,
+		id, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := []SensorReading{}
+	for rows.Next() {
+		r := SensorReading{RoomID: id}
+		if err := rows.Scan((*string)(&r.ThingName), &r.Temperature, &r.Humidity, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
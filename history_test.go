@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordSensorReadings(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"thing": {
+			Temperature: float64Ptr(21.0),
+			Humidity:    float64Ptr(40.0),
+			IsConnected: true,
+			LastUpdated: now.Unix(),
+			expire:      now.Add(time.Minute),
+		},
+	}
+
+	// 同じ測定値を2回保存しようとしても、1件だけ保存される
+	for i := 0; i < 2; i++ {
+		if err := rsm.recordSensorReadings(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	readings, err := rst.GetSensorHistory(context.Background(), 1, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 1 {
+		t.Fatalf("should record 1 reading, but recorded %d", len(readings))
+	}
+	if readings[0].ThingName != "thing" || optionalValue(readings[0].Temperature) != 21.0 {
+		t.Errorf("should record the cached reading, but result is %+v", readings[0])
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 投票のリクエストの再送を識別するキーを受け取るヘッダー
+	IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+	// 受け取るキーの最大長。これを超えるキーは無効として扱う。
+	MAX_IDEMPOTENCY_KEY_LENGTH = 128
+	// 処理済みのキーを覚えておく期間
+	IDEMPOTENCY_KEY_TTL = 10 * time.Minute
+	// 覚えておくキーの最大数。超えた場合は古いものから忘れる。
+	MAX_IDEMPOTENCY_KEYS = 10000
+)
+
+type idempotencyKey struct {
+	SessionID uint64
+	RoomID    RoomID
+	Key       string
+}
+
+// 処理済みの投票のキーを、一定期間・一定数だけ覚えておくキャッシュ。ゼロ値のまま使用できる。
+type idempotencyCache struct {
+	lock   sync.Mutex
+	expire map[idempotencyKey]time.Time
+	// 追加した順のキー。期限切れと上限を超えたキーを古いものから削除するために使用する。
+	order []idempotencyKey
+}
+
+// キーが有効期限内に処理済みとして記録されているかどうかを返す。
+func (c *idempotencyCache) Seen(key idempotencyKey, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expire, ok := c.expire[key]
+	return ok && expire.After(now)
+}
+
+// キーを処理済みとして記録する。
+func (c *idempotencyCache) Add(key idempotencyKey, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.expire == nil {
+		c.expire = make(map[idempotencyKey]time.Time)
+	}
+
+	// 有効期間は一定のため、orderの先頭ほど有効期限が早い
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if expire, ok := c.expire[oldest]; ok && expire.After(now) && len(c.expire) < MAX_IDEMPOTENCY_KEYS {
+			break
+		}
+		delete(c.expire, oldest)
+		c.order = c.order[1:]
+	}
+
+	if _, ok := c.expire[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.expire[key] = now.Add(IDEMPOTENCY_KEY_TTL)
+}
+
+// 投票の再送を識別するキーとして使用できるかどうかを返す。
+func validIdempotencyKey(key string) bool {
+	return validRequestID(key) && len(key) <= MAX_IDEMPOTENCY_KEY_LENGTH
+}
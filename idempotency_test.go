@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVoteWithKey(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.VoteWithKey(ctx, 1, Hot, "key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	sid := rst.s.SessionID
+
+	// 再送を投票時刻で判別できるように、投票時刻を過去にずらしておく
+	old := time.Now().Add(-10 * time.Minute)
+	if _, err := rsm.db.Exec(`UPDATE vote SET timestamp=?`, old); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := func(choice VoteChoice, key string) *MyVote {
+		t.Helper()
+		tx, err := rsm.begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		rst := &RoomStatusTx{rsm: rsm, tx: tx, s: &Session{SessionID: sid, tx: tx, ttl: rsm.config.SessionTTL}}
+		if err := rst.VoteWithKey(ctx, 1, choice, key); err != nil {
+			t.Fatal(err)
+		}
+		vote, err := rst.GetMyVote(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rst.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return vote
+	}
+
+	if vote := retry(Hot, "key1"); vote == nil || vote.Vote != Hot || vote.Timestamp != old.Unix() {
+		t.Errorf("should not update the vote for the same key, but result is %+v", vote)
+	}
+	if vote := retry(Cold, "key2"); vote == nil || vote.Vote != Cold || vote.Timestamp == old.Unix() {
+		t.Errorf("should update the vote for a new key, but result is %+v", vote)
+	}
+}
+
+func TestIdempotencyCacheBounded(t *testing.T) {
+	var c idempotencyCache
+	now := time.Now()
+	for i := 0; i < MAX_IDEMPOTENCY_KEYS+10; i++ {
+		c.Add(idempotencyKey{SessionID: 1, RoomID: 1, Key: fmt.Sprint(i)}, now)
+	}
+	if len(c.expire) > MAX_IDEMPOTENCY_KEYS || len(c.order) > MAX_IDEMPOTENCY_KEYS {
+		t.Errorf("should keep at most %d keys, but keeps %d", MAX_IDEMPOTENCY_KEYS, len(c.expire))
+	}
+	if c.Seen(idempotencyKey{SessionID: 1, RoomID: 1, Key: "0"}, now) {
+		t.Error("should forget the oldest key")
+	}
+	if !c.Seen(idempotencyKey{SessionID: 1, RoomID: 1, Key: fmt.Sprint(MAX_IDEMPOTENCY_KEYS + 9)}, now) {
+		t.Error("should remember the newest key")
+	}
+	if c.Seen(idempotencyKey{SessionID: 2, RoomID: 1, Key: fmt.Sprint(MAX_IDEMPOTENCY_KEYS + 9)}, now) {
+		t.Error("should not share keys between sessions")
+	}
+	if c.Seen(idempotencyKey{SessionID: 1, RoomID: 1, Key: fmt.Sprint(MAX_IDEMPOTENCY_KEYS + 9)}, now.Add(IDEMPOTENCY_KEY_TTL)) {
+		t.Error("should forget expired keys")
+	}
+}
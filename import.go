@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 取り込むCSVの最大サイズ
+	MAX_IMPORT_SIZE = 1 << 20
+	// thing_names列で、複数のThing名を区切る文字
+	importThingSeparator = ";"
+)
+
+// 取り込むCSVに必須の列名。thing_names列は省略できる。
+var roomImportColumns = []string{"building", "floor", "room_id", "name"}
+
+// CSVのヘッダーが不正であることを表すエラー
+var ErrInvalidImport = errors.New("csv header must contain building, floor, room_id and name")
+
+// CSVの1行分の取り込み結果。
+type RoomImportRow struct {
+	// CSVの行番号。(ヘッダーが1行目)
+	Line   int    `json:"line"`
+	RoomID RoomID `json:"roomId,omitempty"`
+	// "created", "updated", "failed"のいずれか。strictな取り込みで他の行が失敗した場合は"skipped"。
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CSVの取り込み結果。
+type RoomImportSummary struct {
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Failed  int             `json:"failed"`
+	Rows    []RoomImportRow `json:"rows"`
+}
+
+func (s *RoomImportSummary) fail(line int, id RoomID, err error) {
+	s.Failed++
+	s.Rows = append(s.Rows, RoomImportRow{Line: line, RoomID: id, Result: "failed", Error: err.Error()})
+}
+
+// CSVから部屋とThingを取り込む。存在しない部屋は作成し、存在する部屋は名前、建物、階を更新する。
+// thing_names列のThing(";"区切り)は部屋に追加し、既に追加されているThingはそのままにする。
+// 不正な行は取り込まずに結果に記録し、残りの行の取り込みを続ける。DBのエラーが発生した場合は中断する。
+// コミットするかどうかは呼び出し元が結果を見て判断すること。
+func (rst *RoomStatusTx) ImportRoomsCSV(ctx context.Context, r io.Reader) (_ *RoomImportSummary, err error) {
+	ctx, span := rst.startSpan(ctx, "ImportRoomsCSV")
+	defer func() { endSpan(span, err) }()
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, ErrInvalidImport
+	}
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range roomImportColumns {
+		if _, ok := cols[name]; !ok {
+			return nil, ErrInvalidImport
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	summary := &RoomImportSummary{Rows: []RoomImportRow{}}
+	seen := make(map[RoomID]int)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				summary.fail(parseErr.StartLine, 0, err)
+				continue
+			}
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		id, err := StringToRoomID(field(record, "room_id"))
+		if err != nil {
+			summary.fail(line, 0, fmt.Errorf("room_id is invalid: %w", err))
+			continue
+		}
+		if first, ok := seen[id]; ok {
+			summary.fail(line, id, fmt.Errorf("room_id is duplicated with line %d", first))
+			continue
+		}
+		seen[id] = line
+
+		floor, err := strconv.ParseInt(field(record, "floor"), 10, 64)
+		if err != nil {
+			summary.fail(line, id, fmt.Errorf("floor is invalid: %w", err))
+			continue
+		}
+		name := field(record, "name")
+		building := BuildingName(field(record, "building"))
+		if !validRoom(id, name, building, FloorID(floor)) {
+			summary.fail(line, id, ErrInvalidRoom)
+			continue
+		}
+
+		var things []ThingName
+		var invalidThing bool
+		for _, t := range strings.Split(field(record, "thing_names"), importThingSeparator) {
+			if strings.TrimSpace(t) == "" {
+				continue
+			}
+			thing := ThingName(strings.TrimSpace(t))
+			if !validThingName(thing) {
+				invalidThing = true
+				break
+			}
+			things = append(things, thing)
+		}
+		if invalidThing {
+			summary.fail(line, id, ErrInvalidThing)
+			continue
+		}
+
+		// 行の検証が済んでいるため、ここから先のエラーはDBのエラーとして中断する
+		exists, err := rst.roomExists(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		result := "created"
+		if exists {
+			result = "updated"
+			err = rst.UpdateRoom(ctx, id, name, building, FloorID(floor))
+		} else {
+			err = rst.CreateRoom(ctx, id, name, building, FloorID(floor))
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, thing := range things {
+			if err := rst.AttachThing(ctx, id, thing); err != nil && err != ErrThingAttached {
+				return nil, err
+			}
+		}
+
+		if exists {
+			summary.Updated++
+		} else {
+			summary.Created++
+		}
+		summary.Rows = append(summary.Rows, RoomImportRow{Line: line, RoomID: id, Result: result})
+	}
+	return summary, nil
+}
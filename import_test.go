@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestImportRoomsCSV(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'old', 'A', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	csv := strings.Join([]string{
+		"building,floor,room_id,name,thing_names",
+		"A,2,1,renamed,thing1",
+		"A,2,2,new room,thing2;thing3",
+		"A,2,2,duplicated,",
+		"A,x,3,bad floor,",
+		"A,3,4,,",
+		"B,1,5,no things",
+	}, "\n")
+	summary, err := rst.ImportRoomsCSV(ctx, strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Created != 2 || summary.Updated != 1 || summary.Failed != 3 {
+		t.Errorf("should create 2, update 1 and fail 3 rows, but result is %+v", summary)
+	}
+	for _, row := range summary.Rows {
+		if row.Result == "failed" && row.Line != 4 && row.Line != 5 && row.Line != 6 {
+			t.Errorf("line %d should not fail: %s", row.Line, row.Error)
+		}
+	}
+
+	var name string
+	var floor FloorID
+	if err := rst.tx.QueryRowContext(ctx, `SELECT name, floor FROM room WHERE room_id=1`).Scan(&name, &floor); err != nil {
+		t.Fatal(err)
+	}
+	if name != "renamed" || floor != 2 {
+		t.Errorf("room 1 should be updated, but result is %q on floor %d", name, floor)
+	}
+	var things int
+	if err := rst.tx.QueryRowContext(ctx, `SELECT count(*) FROM thing`).Scan(&things); err != nil {
+		t.Fatal(err)
+	}
+	if things != 3 {
+		t.Errorf("should attach 3 things, but attached %d", things)
+	}
+
+	// 同じCSVを再度取り込んでも、Thingは重複しない
+	if _, err := rst.ImportRoomsCSV(ctx, strings.NewReader(csv)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.tx.QueryRowContext(ctx, `SELECT count(*) FROM thing`).Scan(&things); err != nil {
+		t.Fatal(err)
+	}
+	if things != 3 {
+		t.Errorf("should not attach things twice, but found %d", things)
+	}
+}
+
+func TestImportRoomsCSVInvalidHeader(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+
+	for _, csv := range []string{"", "building,floor,name\nA,1,room"} {
+		if _, err := rst.ImportRoomsCSV(context.Background(), strings.NewReader(csv)); err != ErrInvalidImport {
+			t.Errorf("%q: should return ErrInvalidImport, but result is %v", csv, err)
+		}
+	}
+}
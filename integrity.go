@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// 存在しない部屋を参照する行を削除する間隔
+	INTEGRITY_SWEEP_INTERVAL = 1 * time.Hour
+)
+
+// 存在しない部屋を参照するThingと投票を、IntegritySweepInterval毎に削除する。
+// センサーの状態の更新とは独立して動作する。
+func (rsm *RoomStatusManager) integritySweeper(ctx context.Context) {
+	rsm.config.Logger.Debug("starting integritySweeper")
+
+	ticker := time.NewTicker(rsm.config.IntegritySweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := rsm.cleanUpOrphans(ctx); err != nil {
+			rsm.config.Logger.Error("failed to clean up orphaned rows", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			rsm.config.Logger.Debug("stopping integritySweeper")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 存在しない部屋を参照するThingと投票を削除する。
+// 外部キー制約が無効なDB(SQLiteのデフォルト)や、DBを直接操作して部屋を削除した場合に残る行を対象とする。
+func (rsm *RoomStatusManager) cleanUpOrphans(ctx context.Context) error {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var removed [2]int64
+	for i, query := range []string{
+		`DELETE FROM thing WHERE room_id NOT IN (SELECT room_id FROM room)`,
+		`DELETE FROM vote WHERE room_id NOT IN (SELECT room_id FROM room)`,
+	} {
+		res, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		if removed[i], err = res.RowsAffected(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if removed[0] > 0 || removed[1] > 0 {
+		rsm.config.Logger.Info("removed rows referencing non-existent rooms", "things", removed[0], "votes", removed[1])
+	}
+	return nil
+}
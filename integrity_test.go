@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanUpOrphans(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO session (session_id, secret_sha256, expire) VALUES (1, '', ?);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'kept');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'orphan');
+		INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (1, 1, 'hot', ?);
+		INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (1, 2, 'hot', ?);
+	`, time.Now().Add(time.Hour), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rsm.cleanUpOrphans(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var things, votes int
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM thing WHERE room_id=2`).Scan(&things); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM vote WHERE room_id=2`).Scan(&votes); err != nil {
+		t.Fatal(err)
+	}
+	if things != 0 || votes != 0 {
+		t.Errorf("should delete rows of the non-existent room, but %d things and %d votes remain", things, votes)
+	}
+	var total int
+	if err := rsm.db.QueryRow(`SELECT (SELECT count(*) FROM thing) + (SELECT count(*) FROM vote)`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("should keep rows of the existing room, but %d rows remain", total)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Prometheusに公開するメトリクス。デフォルトのレジストリに登録する。
+var (
+	sensorCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "temvote",
+		Name:      "sensor_cache_requests_total",
+		Help:      "Number of sensor status cache lookups, partitioned by result (hit or miss).",
+	}, []string{"building", "result"})
+	sensorsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "temvote",
+		Name:      "sensors",
+		Help:      "Number of cached sensors, partitioned by connection state (connected or disconnected).",
+	}, []string{"building", "state"})
+	sensorUpdateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "temvote",
+		Name:      "sensor_update_duration_seconds",
+		Help:      "Time taken to update all sensor statuses.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	votesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "temvote",
+		Name:      "votes_total",
+		Help:      "Number of committed votes, partitioned by choice.",
+	}, []string{"building", "choice"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "temvote",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, partitioned by method, route template and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "temvote",
+		Name:      "http_response_size_bytes",
+		Help:      "Size of HTTP response bodies, partitioned by method and route template.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"method", "route"})
+)
+
+func init() {
+	prometheus.MustRegister(sensorCacheRequests, sensorsGauge, sensorUpdateDuration, votesCounter,
+		httpRequestDuration, httpResponseSize)
+}
+
+// 部屋が属する建物の名前を返す。メトリクスのラベルに使用する。
+// 建物の一覧はセンサーの状態の更新時に読み込むため、それ以降に追加された部屋は空文字列になる。
+func (rsm *RoomStatusManager) buildingOf(id RoomID) BuildingName {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+	return rsm.buildings[id]
+}
+
+// キャッシュされているセンサーの数を、建物と接続状態毎に集計する。
+func (rsm *RoomStatusManager) updateSensorMetrics() {
+	type key struct {
+		building BuildingName
+		state    string
+	}
+	counts := map[key]float64{}
+
+	rsm.cacheLock.RLock()
+	now := time.Now()
+	for id, cache := range rsm.sensorCache {
+		b := rsm.buildings[id]
+		for _, stat := range cache {
+			switch {
+			case stat.expire.After(now) && stat.IsConnected:
+				counts[key{b, "connected"}]++
+			case stat.expire.After(now) || stat.staleUntil.After(now):
+				counts[key{b, "disconnected"}]++
+			}
+		}
+	}
+	rsm.cacheLock.RUnlock()
+
+	sensorsGauge.Reset()
+	for k, n := range counts {
+		sensorsGauge.WithLabelValues(string(k.building), k.state).Set(n)
+	}
+}
+
+// キャッシュの参照結果を記録する。
+func observeCacheLookup(building BuildingName, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	sensorCacheRequests.WithLabelValues(string(building), result).Inc()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestVoteMetricsAfterCommit(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'metrics', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := rsm.begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.loadBuildings(context.Background(), tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	counter := votesCounter.WithLabelValues("metrics", string(Hot))
+	before := testutil.ToFloat64(counter)
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(counter) - before; n != 0 {
+		t.Errorf("should not count votes before commit, but counted %v", n)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(counter) - before; n != 1 {
+		t.Errorf("should count 1 vote after commit, but counted %v", n)
+	}
+}
+
+func TestUpdateSensorMetrics(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	now := time.Now()
+	rsm.buildings = map[RoomID]BuildingName{1: "A", 2: "B"}
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"connected":    {IsConnected: true, expire: now.Add(time.Minute)},
+		"disconnected": {IsConnected: false, expire: now.Add(time.Minute)},
+	}
+	rsm.sensorCache[2] = map[ThingName]SensorStatus{
+		"stale":   {IsConnected: true, expire: now.Add(-time.Minute), staleUntil: now.Add(time.Minute)},
+		"expired": {IsConnected: true, expire: now.Add(-time.Minute), staleUntil: now.Add(-time.Second)},
+	}
+	rsm.updateSensorMetrics()
+
+	tests := []struct {
+		building string
+		state    string
+		expected float64
+	}{
+		{"A", "connected", 1},
+		{"A", "disconnected", 1},
+		{"B", "connected", 0},
+		{"B", "disconnected", 1},
+	}
+	for _, tt := range tests {
+		if n := testutil.ToFloat64(sensorsGauge.WithLabelValues(tt.building, tt.state)); n != tt.expected {
+			t.Errorf("building=%s, state=%s: expected %v, but result is %v", tt.building, tt.state, tt.expected, n)
+		}
+	}
+}
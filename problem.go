@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	// エラーレスポンスのContent-Type (RFC 7807)
+	PROBLEM_CONTENT_TYPE = "application/problem+json"
+	// 既知のエラーのtypeの接頭辞
+	PROBLEM_TYPE_PREFIX = "urn:temvote:problem:"
+)
+
+// RFC 7807形式のエラーレスポンス。
+// typeはエラーの種類を表し、既知のエラー以外では"about:blank"になる。クライアントはtypeとstatusで処理を分岐する。
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// クライアントに内容を返す既知のエラーと、そのステータスコードとtype。
+var knownErrors = []struct {
+	err    error
+	status int
+	typ    string
+}{
+	{ErrNoSession, http.StatusUnauthorized, "no-session"},
+	{ErrVoteTooSoon, http.StatusTooManyRequests, "vote-too-soon"},
+	{ErrRefreshTooSoon, http.StatusTooManyRequests, "refresh-too-soon"},
+	{ErrInvalidChoice, http.StatusBadRequest, "invalid-choice"},
+	{ErrInvalidVoteChoice, http.StatusBadRequest, "invalid-choice"},
+	{ErrRoomNotFound, http.StatusNotFound, "room-not-found"},
+	{ErrThingNotFound, http.StatusNotFound, "thing-not-found"},
+	{ErrRoomOutOfScope, http.StatusMisdirectedRequest, "room-out-of-scope"},
+	{ErrRoomExists, http.StatusConflict, "room-exists"},
+	{ErrRoomInUse, http.StatusConflict, "room-in-use"},
+	{ErrThingAttached, http.StatusConflict, "thing-attached"},
+	{ErrInvalidRoom, http.StatusBadRequest, "invalid-room"},
+	{ErrInvalidThing, http.StatusBadRequest, "invalid-thing"},
+	{ErrInvalidLabel, http.StatusBadRequest, "invalid-label"},
+	{ErrInvalidTarget, http.StatusBadRequest, "invalid-target"},
+	{ErrInvalidTimeline, http.StatusBadRequest, "invalid-timeline"},
+	{ErrInvalidImport, http.StatusBadRequest, "invalid-import"},
+	{ErrQueryTimeout, http.StatusServiceUnavailable, "query-timeout"},
+	{ErrNoPublicBaseURL, http.StatusServiceUnavailable, "no-public-base-url"},
+}
+
+// パラメータの値が不正であることを表すエラーを返す。
+func invalidParameter(name string) error {
+	return errors.New(name + " parameter is invalid")
+}
+
+// errをRFC 7807形式のエラーレスポンスとして書き込む。
+// errが既知のエラーの場合は、statusではなくそのエラーのステータスコードを使用する。
+// 5xxの場合は、DBのエラーなどの内部の情報を返さないように、errはログにのみ出力する。
+// errがnilの場合は、ステータスコードのみを返す。
+func writeError(w http.ResponseWriter, req *http.Request, status int, err error) {
+	p := Problem{Type: "about:blank", Status: status}
+	for _, k := range knownErrors {
+		if errors.Is(err, k.err) {
+			p.Type = PROBLEM_TYPE_PREFIX + k.typ
+			p.Status = k.status
+			break
+		}
+	}
+	p.Title = http.StatusText(p.Status)
+	if p.Status >= 500 {
+		if err != nil {
+			logRequestf(req, "ERROR: %s", err)
+		}
+	} else if err != nil {
+		p.Detail = err.Error()
+	}
+
+	js, err := json.Marshal(p)
+	if err != nil {
+		logRequestf(req, "ERROR: %s", err)
+		http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(js)
+}
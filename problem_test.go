@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		err    error
+		want   Problem
+	}{
+		{"known error", http.StatusInternalServerError, ErrVoteTooSoon,
+			Problem{PROBLEM_TYPE_PREFIX + "vote-too-soon", "Too Many Requests", http.StatusTooManyRequests, ErrVoteTooSoon.Error()}},
+		{"wrapped known error", http.StatusInternalServerError, fmt.Errorf("room 1: %w", ErrRoomNotFound),
+			Problem{PROBLEM_TYPE_PREFIX + "room-not-found", "Not Found", http.StatusNotFound, "room 1: room is not found"}},
+		{"client error", http.StatusBadRequest, invalidParameter("room"),
+			Problem{"about:blank", "Bad Request", http.StatusBadRequest, "room parameter is invalid"}},
+		// 内部のエラーの内容は返さない
+		{"server error", http.StatusInternalServerError, errors.New("sql: connection refused"),
+			Problem{"about:blank", "Internal Server Error", http.StatusInternalServerError, ""}},
+		{"query timeout", http.StatusInternalServerError, fmt.Errorf("%w: context deadline exceeded", ErrQueryTimeout),
+			Problem{PROBLEM_TYPE_PREFIX + "query-timeout", "Service Unavailable", http.StatusServiceUnavailable, ""}},
+		{"no public base url", http.StatusInternalServerError, ErrNoPublicBaseURL,
+			Problem{PROBLEM_TYPE_PREFIX + "no-public-base-url", "Service Unavailable", http.StatusServiceUnavailable, ""}},
+		{"nil error", http.StatusUnauthorized, nil,
+			Problem{"about:blank", "Unauthorized", http.StatusUnauthorized, ""}},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		writeError(w, req, c.status, c.err)
+
+		if w.Code != c.want.Status {
+			t.Errorf("%s: should return %d, but status is %d", c.name, c.want.Status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != PROBLEM_CONTENT_TYPE {
+			t.Errorf("%s: Content-Type should be %s, but result is %s", c.name, PROBLEM_CONTENT_TYPE, ct)
+		}
+		var p Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if p != c.want {
+			t.Errorf("%s: should return %+v, but result is %+v", c.name, c.want, p)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"github.com/skip2/go-qrcode"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// QRコードの画像の一辺のピクセル数のデフォルト値と最大値
+	QR_CODE_SIZE     = 256
+	MAX_QR_CODE_SIZE = 1024
+)
+
+// ベースURLが絶対URLでないことを表すエラー
+var ErrInvalidBaseURL = errors.New("base url must be an absolute http or https url")
+
+// QRコードに使用するベースURLが設定されていないことを表すエラー
+var ErrNoPublicBaseURL = errors.New("public base url is not configured")
+
+// ベースURLとして使用できるかどうかを検証する。空の場合はリクエストのホストを使用するため有効。
+func ValidateBaseURL(baseURL string) error {
+	if baseURL == "" {
+		return nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidBaseURL
+	}
+	return nil
+}
+
+// 部屋の投票画面のURLを返す。ポスターに印刷するため、部屋IDのみから決まる固定のURLにする。
+// baseURLが空の場合は、リクエストのホストから組み立てる。
+func roomVoteURL(baseURL string, req *http.Request, id RoomID) string {
+	if baseURL == "" {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + req.Host
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/vote/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// 部屋の投票画面のURLを、一辺がsizeピクセルのQRコードのPNG画像にする。
+func roomQRCode(voteURL string, size int) ([]byte, error) {
+	return qrcode.Encode(voteURL, qrcode.Medium, size)
+}
+
+// 部屋の投票画面へのリンクのレスポンス
+type roomLinkResponse struct {
+	RoomID RoomID `json:"roomId"`
+	URL    string `json:"url"`
+}
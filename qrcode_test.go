@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoomVoteURL(t *testing.T) {
+	req := httptest.NewRequest("GET", "/rooms/12/qr", nil)
+	req.Host = "temvote.local:8080"
+	if u := roomVoteURL("", req, 12); u != "http://temvote.local:8080/vote/12" {
+		t.Errorf("should use the request host, but result is %s", u)
+	}
+	req.TLS = &tls.ConnectionState{}
+	if u := roomVoteURL("", req, 12); u != "https://temvote.local:8080/vote/12" {
+		t.Errorf("should use https for TLS requests, but result is %s", u)
+	}
+	if u := roomVoteURL("https://example.com/temvote/", req, 12); u != "https://example.com/temvote/vote/12" {
+		t.Errorf("should use the base url, but result is %s", u)
+	}
+}
+
+func TestValidateBaseURL(t *testing.T) {
+	for _, c := range []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"http://localhost:8080/temvote", true},
+		{"example.com", false},
+		{"ftp://example.com", false},
+		{"https://", false},
+	} {
+		if err := ValidateBaseURL(c.url); (err == nil) != c.valid {
+			t.Errorf("%q: valid should be %v, but error is %v", c.url, c.valid, err)
+		}
+	}
+}
+
+func TestRoomQRCode(t *testing.T) {
+	b, err := roomQRCode("https://example.com/vote/1", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("should return a PNG image: %s", err)
+	}
+	if cfg.Width != 128 || cfg.Height != 128 {
+		t.Errorf("should return a 128x128 image, but result is %dx%d", cfg.Width, cfg.Height)
+	}
+}
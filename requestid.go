@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	// リクエストIDを受け渡すヘッダー
+	REQUEST_ID_HEADER = "X-Request-ID"
+	// クライアントから受け取るリクエストIDの最大長。これを超える場合は新しく生成する。
+	MAX_REQUEST_ID_LENGTH = 128
+)
+
+type requestIDKey struct{}
+
+// リクエストIDを格納したcontextを返す。
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// contextに格納されたリクエストIDを返す。格納されていない場合は空文字列を返す。
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ログやヘッダーに含めても安全なリクエストIDかどうかを返す。
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// リクエストIDをcontextに格納し、レスポンスのヘッダーに付与するハンドラーを返す。
+// リクエストのX-Request-IDヘッダーが有効な値であればそれを引き継ぎ、なければ生成する。
+func RequestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, req.WithContext(WithRequestID(req.Context(), id)))
+	})
+}
+
+// log.Printfと同じ形式でログを出力する。リクエストIDがあれば末尾に"request_id"として付与する。
+func logRequestf(req *http.Request, format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	if id := RequestIDFromContext(req.Context()); id != "" {
+		msg += " request_id=" + id
+	}
+	log.Println(msg)
+}
+
+// contextにリクエストIDが格納されていれば、ログに"request_id"として付与するslog.Handler。
+// ログはInfoContextなどのcontextを受け取るメソッドで出力すること。
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h *requestIDLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return &requestIDLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var got string
+	handler := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = RequestIDFromContext(req.Context())
+	}))
+
+	for _, c := range []struct {
+		header   string
+		expected string
+	}{
+		{"abc-123", "abc-123"},
+		{"", ""},
+		{"has space", ""},
+		{strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1), ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			req.Header.Set(REQUEST_ID_HEADER, c.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if c.expected != "" && got != c.expected {
+			t.Errorf("%q: should propagate request id, but result is %q", c.header, got)
+		}
+		if c.expected == "" && (got == "" || got == c.header) {
+			t.Errorf("%q: should generate new request id, but result is %q", c.header, got)
+		}
+		if h := w.Header().Get(REQUEST_ID_HEADER); h != got {
+			t.Errorf("%q: response header should be %q, but result is %q", c.header, got, h)
+		}
+	}
+}
+
+func TestRequestIDLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&requestIDLogHandler{slog.NewTextHandler(&buf, nil)}).With("component", "test")
+
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "with id")
+	logger.InfoContext(context.Background(), "without id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("should output 2 lines, but result is %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "request_id=req-1") || !strings.Contains(lines[0], "component=test") {
+		t.Errorf("should include request id, but result is %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("should not include request id, but result is %q", lines[1])
+	}
+}
+
+func TestWriteErrorLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	handler := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, http.StatusInternalServerError, errors.New("broken"))
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if out := buf.String(); !strings.Contains(out, "ERROR: broken request_id=req-1\n") {
+		t.Errorf("should log the error with request id, but result is %q", out)
+	}
+}
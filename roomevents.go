@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// 購読者1人あたりにバッファリングする通知の数。
+// 購読者の処理が追いつかない場合、溢れた通知は破棄する。
+const roomEventBufferSize = 64
+
+// 部屋の状態が変化したことを購読者に通知する。
+type roomEventHub struct {
+	lock sync.Mutex
+	subs map[*roomSubscription]struct{}
+	// Closeを呼び出した後はtrue
+	closed bool
+	// Close後に、すべての購読が解除されたら閉じる
+	idle chan struct{}
+}
+
+type roomSubscription struct {
+	// 通知対象の部屋。nilの場合はすべての部屋を通知する。
+	rooms map[RoomID]struct{}
+	ch    chan RoomID
+}
+
+func newRoomEventHub() *roomEventHub {
+	return &roomEventHub{
+		subs: make(map[*roomSubscription]struct{}),
+		idle: make(chan struct{}),
+	}
+}
+
+// 指定した部屋の状態が変化したときに、その部屋のIDが送信されるチャネルを返す。
+// 部屋を指定しなかった場合は、すべての部屋の変化を通知する。
+// 購読が不要になったら、必ず戻り値の関数を呼び出して購読を解除すること。
+// Closeの後に購読した場合は、閉じたチャネルを返す。
+func (h *roomEventHub) Subscribe(rooms ...RoomID) (<-chan RoomID, func()) {
+	sub := &roomSubscription{
+		ch: make(chan RoomID, roomEventBufferSize),
+	}
+	if len(rooms) > 0 {
+		sub.rooms = make(map[RoomID]struct{}, len(rooms))
+		for _, id := range rooms {
+			sub.rooms[id] = struct{}{}
+		}
+	}
+
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	h.subs[sub] = struct{}{}
+	h.lock.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			h.lock.Lock()
+			delete(h.subs, sub)
+			if h.closed && len(h.subs) == 0 {
+				close(h.idle)
+			}
+			h.lock.Unlock()
+		})
+	}
+}
+
+// すべての購読のチャネルを閉じ、以降の通知を破棄する。
+// 購読者はチャネルが閉じられたら処理を終えて、購読を解除すること。
+func (h *roomEventHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		close(sub.ch)
+	}
+	if len(h.subs) == 0 {
+		close(h.idle)
+	}
+}
+
+// Closeの後、すべての購読が解除されるか、ctxがキャンセルされるまで待つ。
+func (h *roomEventHub) Wait(ctx context.Context) error {
+	select {
+	case <-h.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 部屋の状態が変化したことを購読者に通知する。
+// 購読者の処理を待たないため、ロックを保持したまま呼び出してもよい。
+func (h *roomEventHub) Publish(id RoomID) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+
+	for sub := range h.subs {
+		if sub.rooms != nil {
+			if _, ok := sub.rooms[id]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.ch <- id:
+		default:
+			// バッファが一杯の場合は破棄する。購読者は次の通知で最新の状態を取得できる。
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRoomEventHub(t *testing.T) {
+	hub := newRoomEventHub()
+
+	all, cancelAll := hub.Subscribe()
+	defer cancelAll()
+	room1, cancelRoom1 := hub.Subscribe(1)
+
+	hub.Publish(1)
+	hub.Publish(2)
+
+	if id := <-all; id != 1 {
+		t.Errorf("should receive room 1, but received %d", id)
+	}
+	if id := <-all; id != 2 {
+		t.Errorf("should receive room 2, but received %d", id)
+	}
+	if id := <-room1; id != 1 {
+		t.Errorf("should receive room 1, but received %d", id)
+	}
+	select {
+	case id := <-room1:
+		t.Errorf("should not receive other rooms, but received %d", id)
+	default:
+	}
+
+	cancelRoom1()
+	cancelRoom1()
+	hub.Publish(1)
+	select {
+	case id := <-room1:
+		t.Errorf("should not receive after unsubscribe, but received %d", id)
+	default:
+	}
+}
+
+func TestRoomEventHubClose(t *testing.T) {
+	hub := newRoomEventHub()
+
+	ch, unsubscribe := hub.Subscribe()
+	hub.Close()
+	hub.Close()
+	hub.Publish(1)
+	if _, ok := <-ch; ok {
+		t.Errorf("channel should be closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := hub.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait should time out while subscribed, but returned %v", err)
+	}
+
+	unsubscribe()
+	if err := hub.Wait(context.Background()); err != nil {
+		t.Errorf("Wait should return after unsubscribe, but returned %v", err)
+	}
+
+	late, unsubscribeLate := hub.Subscribe(1)
+	defer unsubscribeLate()
+	if _, ok := <-late; ok {
+		t.Errorf("channel subscribed after Close should be closed")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// 部屋の名前と建物・階の一覧をキャッシュしておく期間
+	ROOM_INFO_TTL = 5 * time.Minute
+)
+
+// 部屋の名前と建物・階の一覧のキャッシュ。roomInfoLockで保護する。
+type roomInfoCache struct {
+	names  RoomNameMap
+	groups RoomGroupMap
+	expire time.Time
+}
+
+// 有効期限内のキャッシュを返す。キャッシュがない場合はnilを返す。
+func (rsm *RoomStatusManager) cachedRoomInfo() *roomInfoCache {
+	rsm.roomInfoLock.RLock()
+	defer rsm.roomInfoLock.RUnlock()
+	if rsm.roomInfo == nil || !rsm.roomInfo.expire.After(time.Now()) {
+		return nil
+	}
+	return rsm.roomInfo
+}
+
+// DBから読み込んだ一覧をキャッシュする。
+// 読み込みを始めた後にキャッシュが破棄された場合は、古い一覧の可能性があるため保存しない。
+func (rsm *RoomStatusManager) storeRoomInfo(gen uint64, names RoomNameMap, groups RoomGroupMap) {
+	rsm.roomInfoLock.Lock()
+	defer rsm.roomInfoLock.Unlock()
+	if gen != rsm.roomInfoGen {
+		return
+	}
+	rsm.roomInfo = &roomInfoCache{
+		names:  names,
+		groups: groups,
+		expire: time.Now().Add(rsm.config.RoomInfoTTL),
+	}
+}
+
+func (rsm *RoomStatusManager) roomInfoGeneration() uint64 {
+	rsm.roomInfoLock.RLock()
+	defer rsm.roomInfoLock.RUnlock()
+	return rsm.roomInfoGen
+}
+
+// キャッシュを破棄する。部屋の作成、名前の変更、削除のコミット後に呼び出す。
+func (rsm *RoomStatusManager) invalidateRoomInfo() {
+	rsm.roomInfoLock.Lock()
+	defer rsm.roomInfoLock.Unlock()
+	rsm.roomInfo = nil
+	rsm.roomInfoGen++
+}
+
+// キャッシュの有効期限が切れていれば、DBから読み込み直す。cacheUpdaterから呼び出す。
+func (rsm *RoomStatusManager) refreshRoomInfo(ctx context.Context) error {
+	if rsm.cachedRoomInfo() != nil {
+		return nil
+	}
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rst := &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+	}
+	gen := rsm.roomInfoGeneration()
+	names, groups, err := rst.loadAllRoomsInfo(ctx)
+	if err != nil {
+		return err
+	}
+	rsm.storeRoomInfo(gen, names, groups)
+	return nil
+}
+
+// 部屋の名前を返す。キャッシュにない場合はDBから読み込む。
+// 部屋が存在しない場合はsql.ErrNoRowsを返す。
+func (rst *RoomStatusTx) GetRoomName(ctx context.Context, id RoomID) (name string, err error) {
+	ctx, span := rst.startSpan(ctx, "GetRoomName", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	// このトランザクションで部屋を変更した場合、キャッシュはまだ変更を反映していない
+	if cache := rst.rsm.cachedRoomInfo(); cache != nil && !rst.roomsChanged {
+		if name, ok := cache.names[id]; ok {
+			return name, nil
+		}
+	}
+	err = rst.tx.QueryRowContext(ctx,
+		`SELECT name FROM room
+		WHERE room_id=?`,
+		id,
+	).Scan(&name)
+	return
+}
+
+// すべての部屋の名前と、建物・階毎の部屋の一覧を返す。
+// キャッシュが有効な場合はキャッシュのコピーを返し、そうでない場合はDBから読み込んでキャッシュする。
+func (rst *RoomStatusTx) GetAllRoomsInfo(ctx context.Context) (names RoomNameMap, groups RoomGroupMap, err error) {
+	ctx, span := rst.startSpan(ctx, "GetAllRoomsInfo")
+	defer func() { endSpan(span, err) }()
+
+	if rst.roomsChanged {
+		return rst.loadAllRoomsInfo(ctx)
+	}
+	if cache := rst.rsm.cachedRoomInfo(); cache != nil {
+		return copyRoomInfo(cache.names, cache.groups)
+	}
+
+	gen := rst.rsm.roomInfoGeneration()
+	names, groups, err = rst.loadAllRoomsInfo(ctx)
+	if err != nil {
+		return
+	}
+	rst.rsm.storeRoomInfo(gen, names, groups)
+	return copyRoomInfo(names, groups)
+}
+
+// 呼び出し元がキャッシュを書き換えないように、一覧をコピーする。
+func copyRoomInfo(names RoomNameMap, groups RoomGroupMap) (RoomNameMap, RoomGroupMap, error) {
+	namesCopy := make(RoomNameMap, len(names))
+	for id, name := range names {
+		namesCopy[id] = name
+	}
+	groupsCopy := make(RoomGroupMap, len(groups))
+	for b, floors := range groups {
+		groupsCopy[b] = make(map[FloorID][]RoomID, len(floors))
+		for f, ids := range floors {
+			groupsCopy[b][f] = append([]RoomID(nil), ids...)
+		}
+	}
+	return namesCopy, groupsCopy, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoomInfoCache(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	ctx := context.Background()
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	names, groups, err := rst.GetAllRoomsInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names[1] != "room1" || len(groups["building"][1]) != 1 {
+		t.Fatalf("should load rooms from DB, but result is %v %v", names, groups)
+	}
+	// 返された一覧を書き換えても、キャッシュには影響しない
+	names[1] = "modified"
+	rst.tx.Rollback()
+
+	// DBを直接書き換えても、キャッシュの有効期限内は古い名前を返す
+	if _, err := rsm.db.Exec(`UPDATE room SET name='direct' WHERE room_id=1`); err != nil {
+		t.Fatal(err)
+	}
+	rst = newTestRoomStatusTx(t, rsm)
+	if name, err := rst.GetRoomName(ctx, 1); err != nil || name != "room1" {
+		t.Errorf("should return the cached name, but result is (%q, %v)", name, err)
+	}
+
+	// RenameRoomのコミット後は、キャッシュを破棄する
+	if err := rst.RenameRoom(ctx, 1, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := rst.GetRoomName(ctx, 1); err != nil || name != "renamed" {
+		t.Errorf("should return the name changed in the transaction, but result is (%q, %v)", name, err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if rsm.cachedRoomInfo() != nil {
+		t.Error("should invalidate the cache after commit")
+	}
+
+	rst = newTestRoomStatusTx(t, rsm)
+	if name, err := rst.GetRoomName(ctx, 1); err != nil || name != "renamed" {
+		t.Errorf("should return the new name, but result is (%q, %v)", name, err)
+	}
+	rst.tx.Rollback()
+
+	// キャッシュにない部屋は、DBから読み込む
+	if err := rsm.refreshRoomInfo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst = newTestRoomStatusTx(t, rsm)
+	if name, err := rst.GetRoomName(ctx, 2); err != nil || name != "room2" {
+		t.Errorf("should fall back to DB, but result is (%q, %v)", name, err)
+	}
+}
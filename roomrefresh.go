@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// 同じ部屋のセンサーの状態を、リクエストに応じて更新できる最短の間隔
+	ROOM_REFRESH_INTERVAL = 5 * time.Second
+)
+
+// 前回の部屋の更新からRoomRefreshIntervalが経過していないことを表すエラー
+var ErrRefreshTooSoon = errors.New("room is refreshed too soon")
+
+// 部屋のすべてのThingの状態をThingWorxから取得し、キャッシュに反映する。
+// 部屋の詳細を表示する前に、定期的な更新を待たずに最新の値にするために使用する。
+// ThingWorxへの負荷を抑えるため、同じ部屋の更新はRoomRefreshIntervalに1回までに制限し、
+// それより短い間隔で呼び出した場合はErrRefreshTooSoonを返す。
+// 一部のThingの取得に失敗した場合も残りのThingは更新し、最初のエラーを返す。
+func (rsm *RoomStatusManager) RefreshRoom(ctx context.Context, id RoomID) error {
+	now := time.Now()
+	rsm.roomRefreshLock.Lock()
+	if last, ok := rsm.roomRefreshes[id]; ok && now.Sub(last) < rsm.config.RoomRefreshInterval {
+		rsm.roomRefreshLock.Unlock()
+		return ErrRefreshTooSoon
+	}
+	// 間隔が経過した部屋の記録は不要なため、ここで削除しておく
+	for room, last := range rsm.roomRefreshes {
+		if now.Sub(last) >= rsm.config.RoomRefreshInterval {
+			delete(rsm.roomRefreshes, room)
+		}
+	}
+	// 同時に呼び出された場合に、重複してThingWorxへ問い合わせないように、更新前に記録する
+	rsm.roomRefreshes[id] = now
+	rsm.roomRefreshLock.Unlock()
+
+	names, err := rsm.roomThingNames(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	updated := false
+	for _, name := range names {
+		reqCtx, cancel := context.WithTimeout(ctx, rsm.readDeadline())
+		err := rsm.updateSensorStatus(reqCtx, id, name)
+		cancel()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		updated = true
+	}
+	if updated {
+		rsm.events.Publish(id)
+	}
+	return firstErr
+}
+
+// 部屋に取り付けられたThingの名前を返す。
+func (rsm *RoomStatusManager) roomThingNames(ctx context.Context, id RoomID) ([]ThingName, error) {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 担当していない建物の部屋のThingは更新しない
+	scope, scopeArgs := rsm.buildingScope("room.building_name")
+	rows, err := tx.QueryContext(ctx,
+		`SELECT thing.thing_name FROM thing
+			INNER JOIN room ON room.room_id=thing.room_id
+			WHERE thing.room_id=?`+scope,
+		append([]interface{}{id}, scopeArgs...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []ThingName{}
+	for rows.Next() {
+		var name ThingName
+		if err := rows.Scan((*string)(&name)); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshRoom(t *testing.T) {
+	fake := NewFakeThingWorx()
+	rsm := newTestRoomStatusManager(t, fake)
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'window');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'door');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'other');
+	`); err != nil {
+		t.Fatal(err)
+	}
+	fake.Set("window", 24, 50, time.Now())
+	fake.Set("door", 26, 50, time.Now())
+	fake.Set("other", 20, 50, time.Now())
+
+	ch, unsubscribe := rsm.Subscribe(1)
+	defer unsubscribe()
+
+	ctx := context.Background()
+	if err := rsm.RefreshRoom(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	status, err := rsm.GetStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AvgTemperature == nil || *status.AvgTemperature != 25 {
+		t.Errorf("should return the refreshed readings, but result is %+v", status)
+	}
+	if fake.Calls("other") != 0 {
+		t.Error("should not read the things of other rooms")
+	}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Error("should notify subscribers of the refreshed room")
+	}
+
+	// 間隔が短すぎる場合は、ThingWorxへ問い合わせない
+	if err := rsm.RefreshRoom(ctx, 1); err != ErrRefreshTooSoon {
+		t.Errorf("should return ErrRefreshTooSoon, but result is %v", err)
+	}
+	if n := fake.Calls("window"); n != 1 {
+		t.Errorf("should read the thing once, but read %d times", n)
+	}
+	// 制限は部屋毎
+	if err := rsm.RefreshRoom(ctx, 2); err != nil {
+		t.Errorf("should refresh another room, but result is %v", err)
+	}
+
+	rsm.roomRefreshes[1] = time.Now().Add(-rsm.config.RoomRefreshInterval)
+	fake.SetError("door", errors.New("unavailable"))
+	fake.Set("window", 22, 50, time.Now())
+	if err := rsm.RefreshRoom(ctx, 1); err == nil {
+		t.Error("should return the error of the failed thing")
+	}
+	if stats, _, _ := rsm.getSensorStatusFromCache(1); len(stats) != 2 {
+		t.Errorf("should keep the other readings, but result is %+v", stats)
+	} else if optionalValue(stats[1].Temperature) != 22.0 {
+		t.Errorf("should update the other things, but result is %+v", stats)
+	}
+}
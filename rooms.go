@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Thingの名前の最大長。thingテーブルのthing_name列の長さに合わせる。
+	MAX_THING_NAME_LENGTH = 32
+	// センサーの表示名の最大文字数。thingテーブルのlabel列の長さに合わせる。
+	MAX_THING_LABEL_LENGTH = 64
+	// 部屋の一覧の1ページあたりの件数のデフォルト値と最大値
+	ROOMS_PAGE_LIMIT     = 50
+	MAX_ROOMS_PAGE_LIMIT = 500
+)
+
+var (
+	// 指定した部屋が存在しないことを表すエラー
+	ErrRoomNotFound = errors.New("room is not found")
+	// 同じIDの部屋が既に存在することを表すエラー
+	ErrRoomExists = errors.New("room already exists")
+	// 部屋にThingや投票が残っているため、削除できないことを表すエラー
+	ErrRoomInUse = errors.New("room has things or votes")
+	// 部屋の名前、建物、階が不正であることを表すエラー
+	ErrInvalidRoom = errors.New("room id, name, building and floor are required")
+	// Thingが既に部屋に追加されていることを表すエラー
+	ErrThingAttached = errors.New("thing is already attached to the room")
+	// Thingがどの部屋にも追加されていないことを表すエラー
+	ErrThingNotFound = errors.New("thing is not attached to any room")
+	// Thingの名前が不正であることを表すエラー
+	ErrInvalidThing = errors.New("thing name is required and must be at most 32 bytes")
+	// センサーの表示名が長すぎることを表すエラー
+	ErrInvalidLabel = errors.New("thing label must be at most 64 characters")
+	// 目標気温の下限が上限より大きいことを表すエラー
+	ErrInvalidTarget = errors.New("target temperature min must not be greater than max")
+)
+
+// 部屋の一覧の1件分。
+type RoomInfo struct {
+	RoomID   RoomID       `json:"roomId"`
+	Name     string       `json:"name"`
+	Building BuildingName `json:"building"`
+	Floor    FloorID      `json:"floor"`
+}
+
+// offsetとlimitを、GetRoomsPageが実際に使用する値に補正する。
+func normalizeRoomsPage(offset, limit int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = ROOMS_PAGE_LIMIT
+	}
+	if limit > MAX_ROOMS_PAGE_LIMIT {
+		limit = MAX_ROOMS_PAGE_LIMIT
+	}
+	return offset, limit
+}
+
+// 部屋の一覧を、建物、階、部屋IDの順に並べてoffset件目からlimit件返す。
+// totalはすべての部屋の数。limitが0以下の場合はROOMS_PAGE_LIMIT、MAX_ROOMS_PAGE_LIMITを超える場合はMAX_ROOMS_PAGE_LIMITとする。
+func (rst *RoomStatusTx) GetRoomsPage(ctx context.Context, offset, limit int) (rooms []RoomInfo, total int, err error) {
+	ctx, span := rst.startSpan(ctx, "GetRoomsPage")
+	defer func() { endSpan(span, err) }()
+
+	offset, limit = normalizeRoomsPage(offset, limit)
+
+	if err = rst.tx.QueryRowContext(ctx, `SELECT count(*) FROM room`).Scan(&total); err != nil {
+		return
+	}
+
+	rows, err := rst.tx.QueryContext(ctx, `
+		SELECT room_id, name, building_name, floor FROM room
+		ORDER BY building_name, floor, room_id
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	rooms = make([]RoomInfo, 0, limit)
+	for rows.Next() {
+		var r RoomInfo
+		if err = rows.Scan(&r.RoomID, &r.Name, (*string)(&r.Building), &r.Floor); err != nil {
+			return
+		}
+		rooms = append(rooms, r)
+	}
+	err = rows.Err()
+	return
+}
+
+func (rst *RoomStatusTx) roomExists(ctx context.Context, id RoomID) (bool, error) {
+	var n int
+	if err := rst.tx.QueryRowContext(ctx,
+		`SELECT count(*) FROM room WHERE room_id=?`,
+		id,
+	).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// 部屋の名前と建物は空白以外の文字を含み、階は0以外でなければならない。
+func validRoom(id RoomID, name string, building BuildingName, floor FloorID) bool {
+	return id != 0 && strings.TrimSpace(name) != "" && strings.TrimSpace(string(building)) != "" && floor != 0
+}
+
+func validThingName(name ThingName) bool {
+	return strings.TrimSpace(string(name)) != "" && len(name) <= MAX_THING_NAME_LENGTH
+}
+
+// 部屋を作成する。名前と建物は空白以外の文字を含み、階は0以外でなければならない。
+func (rst *RoomStatusTx) CreateRoom(ctx context.Context, id RoomID, name string, building BuildingName, floor FloorID) (err error) {
+	ctx, span := rst.startSpan(ctx, "CreateRoom", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	if !validRoom(id, name, building, floor) {
+		return ErrInvalidRoom
+	}
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrRoomExists
+	}
+
+	if _, err := rst.tx.ExecContext(ctx,
+		`INSERT INTO room (room_id, name, building_name, floor) VALUES (?, ?, ?, ?)`,
+		id, name, string(building), floor,
+	); err != nil {
+		return err
+	}
+	rst.roomsChanged = true
+	return nil
+}
+
+// 部屋の名前を変更する。
+func (rst *RoomStatusTx) RenameRoom(ctx context.Context, id RoomID, name string) (err error) {
+	ctx, span := rst.startSpan(ctx, "RenameRoom", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	if strings.TrimSpace(name) == "" {
+		return ErrInvalidRoom
+	}
+	res, err := rst.tx.ExecContext(ctx,
+		`UPDATE room SET name=? WHERE room_id=?`,
+		name, id,
+	)
+	if err != nil {
+		return err
+	}
+	rst.roomsChanged = true
+	// MySQLは値が変わらなかった行を数えないため、行数が0の場合は存在を確認する
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+	return nil
+}
+
+// 部屋の名前、建物、階を変更する。
+func (rst *RoomStatusTx) UpdateRoom(ctx context.Context, id RoomID, name string, building BuildingName, floor FloorID) (err error) {
+	ctx, span := rst.startSpan(ctx, "UpdateRoom", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	if !validRoom(id, name, building, floor) {
+		return ErrInvalidRoom
+	}
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	if _, err := rst.tx.ExecContext(ctx,
+		`UPDATE room SET name=?, building_name=?, floor=? WHERE room_id=?`,
+		name, string(building), floor, id,
+	); err != nil {
+		return err
+	}
+	rst.markChanged(id)
+	rst.roomsChanged = true
+	return nil
+}
+
+// 部屋の目標気温の下限と上限を設定する。nilの場合は、その側の目標を設定しない。
+func (rst *RoomStatusTx) SetRoomTarget(ctx context.Context, id RoomID, min, max *float64) (err error) {
+	ctx, span := rst.startSpan(ctx, "SetRoomTarget", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	if min != nil && max != nil && *min > *max {
+		return ErrInvalidTarget
+	}
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	if _, err := rst.tx.ExecContext(ctx,
+		`UPDATE room SET target_temp_min=?, target_temp_max=? WHERE room_id=?`,
+		min, max, id,
+	); err != nil {
+		return err
+	}
+	rst.markChanged(id)
+	return nil
+}
+
+// 部屋を削除する。
+// RSMConfig.CascadeRoomDeleteがtrueの場合は、部屋のThing、投票、測定値の履歴も削除する。
+// falseの場合は、Thingまたは投票が残っていればErrRoomInUseを返す。
+func (rst *RoomStatusTx) DeleteRoom(ctx context.Context, id RoomID) (err error) {
+	ctx, span := rst.startSpan(ctx, "DeleteRoom", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	if !rst.rsm.config.CascadeRoomDelete {
+		var n int
+		if err := rst.tx.QueryRowContext(ctx,
+			`SELECT (SELECT count(*) FROM thing WHERE room_id=?) + (SELECT count(*) FROM vote WHERE room_id=?)`,
+			id, id,
+		).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrRoomInUse
+		}
+	}
+
+	// 外部キー制約が無効なDB(SQLiteのデフォルト)でも関連する行が残らないように、明示的に削除する
+	for _, query := range []string{
+		`DELETE FROM sensor_reading WHERE room_id=?`,
+		`DELETE FROM vote WHERE room_id=?`,
+		`DELETE FROM vote_event WHERE room_id=?`,
+		`DELETE FROM room_voter WHERE room_id=?`,
+		`DELETE FROM thing WHERE room_id=?`,
+		`DELETE FROM room WHERE room_id=?`,
+	} {
+		if _, err := rst.tx.ExecContext(ctx, query, id); err != nil {
+			return err
+		}
+	}
+	rst.markChanged(id)
+	rst.roomsChanged = true
+	return nil
+}
+
+// ThingInfo.Statusの値
+const (
+	// 接続中
+	ThingConnected = "connected"
+	// 状態は取得できたが、最終更新時刻が古い
+	ThingDisconnected = "disconnected"
+	// 状態を取得できなくなり、最後に取得できた値を表示している
+	ThingStale = "stale"
+	// 状態を一度も取得できていないか、最後に取得してから時間が経ちすぎている
+	ThingUnknown = "unknown"
+)
+
+// 登録されたThingと、その最新の状態。
+type ThingInfo struct {
+	RoomID    RoomID    `json:"roomId"`
+	ThingName ThingName `json:"thingName"`
+	RoomName  string    `json:"roomName"`
+	// センサーの表示名。設定されていない場合は空。
+	Label string `json:"label,omitempty"`
+	// ThingConnected, ThingDisconnected, ThingStale, ThingUnknownのいずれか
+	Status    string `json:"status"`
+	Connected bool   `json:"connected"`
+	// 最終更新時刻(UNIX時間、秒単位)と最新の測定値。状態がThingUnknownの場合と、センサーが測定していない値はnil。
+	LastUpdated *int64   `json:"lastUpdated"`
+	Temperature *float64 `json:"temperature"`
+	Humidity    *float64 `json:"humidity"`
+}
+
+// 登録されたすべてのThingを、Thing名と部屋IDの順に返す。
+// 1つのThingが複数の部屋に追加されている場合は、部屋毎に返す。
+func (rst *RoomStatusTx) ListThings(ctx context.Context) (_ []ThingInfo, err error) {
+	ctx, span := rst.startSpan(ctx, "ListThings")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := rst.tx.QueryContext(ctx, `
+		SELECT thing.room_id, thing.thing_name, room.name, thing.label
+		FROM thing JOIN room ON room.room_id=thing.room_id
+		ORDER BY thing.thing_name, thing.room_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	things := []ThingInfo{}
+	for rows.Next() {
+		var t ThingInfo
+		var label sql.NullString
+		if err := rows.Scan(&t.RoomID, (*string)(&t.ThingName), &t.RoomName, &label); err != nil {
+			return nil, err
+		}
+		t.Label = label.String
+		things = append(things, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rst.rsm.cacheLock.RLock()
+	defer rst.rsm.cacheLock.RUnlock()
+	now := time.Now()
+	for i := range things {
+		t := &things[i]
+		stat, ok := rst.rsm.sensorCache[t.RoomID][t.ThingName]
+		switch {
+		case !ok:
+			t.Status = ThingUnknown
+			continue
+		case stat.expire.After(now) && stat.IsConnected:
+			t.Status = ThingConnected
+			t.Connected = true
+		case stat.expire.After(now):
+			t.Status = ThingDisconnected
+		case stat.staleUntil.After(now):
+			t.Status = ThingStale
+		default:
+			t.Status = ThingUnknown
+			continue
+		}
+		lastUpdated := stat.LastUpdated
+		t.LastUpdated = &lastUpdated
+		t.Temperature = stat.Temperature
+		t.Humidity = stat.Humidity
+	}
+	return things, nil
+}
+
+// 部屋にThingを追加する。コミット後、すぐにThingの状態を取得してキャッシュに反映する。
+// 1つのThingを複数の部屋に追加することもできる。(部屋の境界に設置したセンサーなど)
+func (rst *RoomStatusTx) AttachThing(ctx context.Context, id RoomID, name ThingName) (err error) {
+	ctx, span := rst.startSpan(ctx, "AttachThing", attrRoomID(id), attrThingName(name))
+	defer func() { endSpan(span, err) }()
+
+	if !validThingName(name) {
+		return ErrInvalidThing
+	}
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+
+	var n int
+	if err := rst.tx.QueryRowContext(ctx,
+		`SELECT count(*) FROM thing WHERE room_id=? AND thing_name=?`,
+		id, string(name),
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrThingAttached
+	}
+
+	if _, err := rst.tx.ExecContext(ctx,
+		`INSERT INTO thing (room_id, thing_name) VALUES (?, ?)`,
+		id, string(name),
+	); err != nil {
+		return err
+	}
+	rst.attached = append(rst.attached, sensorKey{id, name})
+	return nil
+}
+
+// 部屋に追加されたThingの表示名を設定する。labelが空の場合は表示名を削除し、Thing名を表示する。
+// コミット後、すぐに部屋の状態に反映する。
+func (rst *RoomStatusTx) SetThingLabel(ctx context.Context, id RoomID, name ThingName, label string) (err error) {
+	ctx, span := rst.startSpan(ctx, "SetThingLabel", attrRoomID(id), attrThingName(name))
+	defer func() { endSpan(span, err) }()
+
+	label = strings.TrimSpace(label)
+	if utf8.RuneCountInString(label) > MAX_THING_LABEL_LENGTH {
+		return ErrInvalidLabel
+	}
+	value := sql.NullString{String: label, Valid: label != ""}
+	res, err := rst.tx.ExecContext(ctx,
+		`UPDATE thing SET label=? WHERE room_id=? AND thing_name=?`,
+		value, id, string(name),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrThingNotFound
+	}
+	if rst.labels == nil {
+		rst.labels = make(map[sensorKey]string)
+	}
+	rst.labels[sensorKey{id, name}] = label
+	rst.markChanged(id)
+	return nil
+}
+
+// Thingをすべての部屋から削除する。コミット後、キャッシュからも削除する。
+func (rst *RoomStatusTx) DetachThing(ctx context.Context, name ThingName) (err error) {
+	ctx, span := rst.startSpan(ctx, "DetachThing", attrThingName(name))
+	defer func() { endSpan(span, err) }()
+
+	res, err := rst.tx.ExecContext(ctx,
+		`DELETE FROM thing WHERE thing_name=?`,
+		string(name),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrThingNotFound
+	}
+	rst.detached = append(rst.detached, name)
+	return nil
+}
+
+// Thingの状態を取得し、キャッシュに反映する。取得に失敗した場合は、次の更新周期に任せる。
+func (rsm *RoomStatusManager) refreshSensorStatus(ctx context.Context, id RoomID, name ThingName) {
+	ctx, cancel := context.WithTimeout(ctx, rsm.readDeadline())
+	defer cancel()
+	if err := rsm.updateSensorStatus(ctx, id, name); err != nil {
+		rsm.config.Logger.Warn("failed to refresh attached thing", "error", err, "thing_name", name, "room_id", id)
+		return
+	}
+	rsm.events.Publish(id)
+}
+
+// Thingの状態をすべての部屋のキャッシュから削除する。
+func (rsm *RoomStatusManager) removeThingFromCache(name ThingName) {
+	var rooms []RoomID
+	rsm.cacheLock.Lock()
+	for id, cache := range rsm.sensorCache {
+		if _, ok := cache[name]; ok {
+			delete(cache, name)
+			rooms = append(rooms, id)
+		}
+	}
+	rsm.cacheLock.Unlock()
+	rsm.forgetConnection(name)
+
+	for _, id := range rooms {
+		rsm.events.Publish(id)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateRoom(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+		t.Fatal(err)
+	}
+	name, err := rst.GetRoomName(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "KC101" {
+		t.Errorf("should create room KC101, but name is %q", name)
+	}
+
+	if err := rst.CreateRoom(ctx, 1, "KC102", "片柳研究所棟", 1); err != ErrRoomExists {
+		t.Errorf("should return ErrRoomExists, but result is %v", err)
+	}
+
+	invalid := []struct {
+		name     string
+		building BuildingName
+		floor    FloorID
+	}{
+		{"", "片柳研究所棟", 1},
+		{" ", "片柳研究所棟", 1},
+		{"KC102", "", 1},
+		{"KC102", "片柳研究所棟", 0},
+	}
+	for _, tt := range invalid {
+		if err := rst.CreateRoom(ctx, 2, tt.name, tt.building, tt.floor); err != ErrInvalidRoom {
+			t.Errorf("CreateRoom(%q, %q, %d) should return ErrInvalidRoom, but result is %v", tt.name, tt.building, tt.floor, err)
+		}
+	}
+}
+
+func TestRenameRoom(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rst.RenameRoom(ctx, 1, "KC201"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := rst.GetRoomName(ctx, 1); name != "KC201" {
+		t.Errorf("should rename the room, but name is %q", name)
+	}
+	// 名前が変わらない場合もエラーにしない
+	if err := rst.RenameRoom(ctx, 1, "KC201"); err != nil {
+		t.Errorf("should accept the same name, but result is %v", err)
+	}
+	if err := rst.RenameRoom(ctx, 2, "KC202"); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+	if err := rst.RenameRoom(ctx, 1, ""); err != ErrInvalidRoom {
+		t.Errorf("should return ErrInvalidRoom, but result is %v", err)
+	}
+}
+
+func TestUpdateRoom(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	if err := rst.CreateRoom(ctx, 1, "KC101", "KC", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.UpdateRoom(ctx, 1, "KC201", "KC", 2); err != nil {
+		t.Fatal(err)
+	}
+	page, _, err := rst.GetRoomsPage(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Name != "KC201" || page[0].Floor != 2 {
+		t.Errorf("should update the room, but result is %+v", page)
+	}
+	if err := rst.UpdateRoom(ctx, 2, "KC202", "KC", 2); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+	if err := rst.UpdateRoom(ctx, 1, "KC201", "KC", 0); err != ErrInvalidRoom {
+		t.Errorf("should return ErrInvalidRoom, but result is %v", err)
+	}
+}
+
+func TestSetRoomTarget(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	for id := RoomID(1); id <= 3; id++ {
+		if err := rst.CreateRoom(ctx, id, fmt.Sprintf("KC10%d", id), "KC", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 部屋1は24℃、部屋2は28℃、部屋3は接続中のセンサーなし
+	for id, temp := range map[RoomID]float64{1: 24, 2: 28} {
+		rsm.sensorCache[id] = map[ThingName]SensorStatus{
+			"thing": {Temperature: float64Ptr(temp), Humidity: float64Ptr(50), IsConnected: true, expire: time.Now().Add(time.Minute)},
+		}
+	}
+
+	min, max := 20.0, 26.0
+	for id := RoomID(1); id <= 3; id++ {
+		if err := rst.SetRoomTarget(ctx, id, &min, &max); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rst.SetRoomTarget(ctx, 1, &max, &min); err != ErrInvalidTarget {
+		t.Errorf("should return ErrInvalidTarget, but result is %v", err)
+	}
+	if err := rst.SetRoomTarget(ctx, 4, &min, &max); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+
+	statuses, err := rst.GetBuildingStatus(ctx, "KC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	judge := func(b *bool) string {
+		if b == nil {
+			return "nil"
+		}
+		return fmt.Sprint(*b)
+	}
+	// 接続中のセンサーがない部屋は判定しない
+	for i, expected := range []string{"true", "false", "nil"} {
+		if result := judge(statuses[i].InTargetRange); result != expected {
+			t.Errorf("room %d: InTargetRange should be %s, but result is %s", statuses[i].RoomID, expected, result)
+		}
+	}
+
+	// 目標気温を解除する
+	if err := rst.SetRoomTarget(ctx, 2, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rst.GetStatus(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.TargetTempMin != nil || rs.TargetTempMax != nil || rs.InTargetRange != nil {
+		t.Errorf("should clear the target, but result is %v, %v, %v", rs.TargetTempMin, rs.TargetTempMax, rs.InTargetRange)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	for _, cascade := range []bool{false, true} {
+		rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+		rsm.config.CascadeRoomDelete = cascade
+		rst := newTestRoomStatusTx(t, rsm)
+		ctx := context.Background()
+		if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rst.tx.Exec(`INSERT INTO thing (room_id, thing_name) VALUES (1, 'thing')`); err != nil {
+			t.Fatal(err)
+		}
+		if err := rst.Vote(ctx, 1, Hot); err != nil {
+			t.Fatal(err)
+		}
+
+		err := rst.DeleteRoom(ctx, 1)
+		if !cascade {
+			if err != ErrRoomInUse {
+				t.Errorf("should return ErrRoomInUse, but result is %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := rst.tx.QueryRow(`SELECT (SELECT count(*) FROM room) + (SELECT count(*) FROM thing) + (SELECT count(*) FROM vote)`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("should delete the room and related rows, but %d rows remain", n)
+		}
+		if err := rst.DeleteRoom(ctx, 1); err != ErrRoomNotFound {
+			t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+		}
+	}
+}
+
+func TestAttachThing(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"rows":[{"temperature":25,"humidity":50,"lastUpdated":%d}]}`, time.Now().Unix()*1000)
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{URL: ts.URL})
+	events, unsubscribe := rsm.Subscribe(1)
+	defer unsubscribe()
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	if err := rst.AttachThing(ctx, 1, "thing"); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+	if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.AttachThing(ctx, 1, ""); err != ErrInvalidThing {
+		t.Errorf("should return ErrInvalidThing, but result is %v", err)
+	}
+	if err := rst.AttachThing(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.AttachThing(ctx, 1, "thing"); err != ErrThingAttached {
+		t.Errorf("should return ErrThingAttached, but result is %v", err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// コミット後、次の更新周期を待たずにキャッシュへ反映される
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("should publish the room after refreshing the attached thing")
+	}
+	if stats, _, ok := rsm.getSensorStatusFromCache(1); !ok || len(stats) != 1 {
+		t.Errorf("should cache the attached thing, but result is %+v", stats)
+	}
+}
+
+func TestDetachThing(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rst.tx.Exec(`INSERT INTO thing (room_id, thing_name) VALUES (1, 'thing')`); err != nil {
+		t.Fatal(err)
+	}
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"thing": {IsConnected: true, expire: time.Now().Add(time.Minute)},
+	}
+
+	if err := rst.DetachThing(ctx, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.DetachThing(ctx, "thing"); err != ErrThingNotFound {
+		t.Errorf("should return ErrThingNotFound, but result is %v", err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := rsm.getSensorStatusFromCache(1); ok {
+		t.Error("should remove the detached thing from the cache")
+	}
+}
+
+func TestListThings(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.CreateRoom(ctx, 1, "KC101", "片柳研究所棟", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rst.tx.Exec(`
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'a-connected');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'b-disconnected');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'c-stale');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'd-never-seen');
+	`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"a-connected":    {Temperature: float64Ptr(21.5), IsConnected: true, LastUpdated: now.Unix(), expire: now.Add(time.Minute)},
+		"b-disconnected": {IsConnected: false, expire: now.Add(time.Minute)},
+		"c-stale":        {IsConnected: true, expire: now.Add(-time.Minute), staleUntil: now.Add(time.Minute)},
+	}
+
+	things, err := rst.ListThings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{ThingConnected, ThingDisconnected, ThingStale, ThingUnknown}
+	if len(things) != len(expected) {
+		t.Fatalf("should return %d things, but returned %d", len(expected), len(things))
+	}
+	for i, status := range expected {
+		if things[i].Status != status {
+			t.Errorf("%s: status should be %q, but result is %q", things[i].ThingName, status, things[i].Status)
+		}
+		if things[i].RoomName != "KC101" {
+			t.Errorf("%s: room name should be KC101, but result is %q", things[i].ThingName, things[i].RoomName)
+		}
+	}
+	if !things[0].Connected || things[0].Temperature == nil || *things[0].Temperature != 21.5 {
+		t.Errorf("should return the latest reading of the connected thing, but result is %+v", things[0])
+	}
+	if things[3].LastUpdated != nil || things[3].Temperature != nil {
+		t.Errorf("should not return readings of the never-seen thing, but result is %+v", things[3])
+	}
+}
+
+func TestSetThingLabel(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'window');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'door');
+	`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"window": {Temperature: float64Ptr(24), IsConnected: true, LastUpdated: now.Unix(), expire: now.Add(time.Minute)},
+		"door":   {IsConnected: false, expire: now.Add(time.Minute)},
+	}
+	ctx := context.Background()
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.SetThingLabel(ctx, 1, "window", " 窓側 "); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.SetThingLabel(ctx, 1, "unknown", "label"); err != ErrThingNotFound {
+		t.Errorf("should return ErrThingNotFound, but result is %v", err)
+	}
+	if err := rst.SetThingLabel(ctx, 1, "door", strings.Repeat("あ", MAX_THING_LABEL_LENGTH+1)); err != ErrInvalidLabel {
+		t.Errorf("should return ErrInvalidLabel, but result is %v", err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rst = newTestRoomStatusTx(t, rsm)
+	status, err := rst.GetStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Sensors) != 2 {
+		t.Fatalf("should return 2 sensors, but result is %+v", status.Sensors)
+	}
+	// Thing名の順に並ぶ
+	if status.Sensors[0].ThingName != "door" || status.Sensors[0].Label != "" || status.Sensors[0].IsConnected {
+		t.Errorf("should return the door sensor without label, but result is %+v", status.Sensors[0])
+	}
+	if status.Sensors[1].ThingName != "window" || status.Sensors[1].Label != "窓側" {
+		t.Errorf("should return the window sensor with its label, but result is %+v", status.Sensors[1])
+	}
+
+	things, err := rst.ListThings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(things) != 2 || things[1].Label != "窓側" {
+		t.Errorf("should list the label, but result is %+v", things)
+	}
+
+	if err := rst.SetThingLabel(ctx, 1, "window", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if sensors, _, _ := rsm.getSensorStatusFromCache(1); sensors[1].Label != "" {
+		t.Errorf("should remove the label, but result is %+v", sensors[1])
+	}
+}
+
+func TestReplaceLabelsKeepsConcurrentChanges(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	window := sensorKey{1, "window"}
+	door := sensorKey{1, "door"}
+	rsm.setLabels(map[sensorKey]string{window: "窓側", door: "ドア側"})
+
+	// 読み込みを開始した後に、表示名が変更・削除された
+	gen := rsm.labelGeneration()
+	rsm.setLabels(map[sensorKey]string{window: "南側", door: ""})
+	rsm.replaceLabels(map[sensorKey]string{window: "窓側", door: "ドア側", {2, "wall"}: "壁側"}, gen)
+
+	if label := rsm.labels[window]; label != "南側" {
+		t.Errorf("should keep the label changed during the refresh, but result is %q", label)
+	}
+	if label, ok := rsm.labels[door]; ok {
+		t.Errorf("should keep the label removed during the refresh, but result is %q", label)
+	}
+	if label := rsm.labels[sensorKey{2, "wall"}]; label != "壁側" {
+		t.Errorf("should load the other labels, but result is %q", label)
+	}
+
+	// 変更の後に読み込みを開始した場合は、読み込んだ値で置き換える
+	rsm.replaceLabels(map[sensorKey]string{window: "北側"}, rsm.labelGeneration())
+	if len(rsm.labels) != 1 || rsm.labels[window] != "北側" {
+		t.Errorf("should replace the labels, but result is %v", rsm.labels)
+	}
+}
+
+func TestGetRoomsPage(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	for _, r := range []RoomInfo{
+		{3, "B201", "B", 2},
+		{1, "B101", "B", 1},
+		{4, "A101", "A", 1},
+		{2, "B102", "B", 1},
+	} {
+		if err := rst.CreateRoom(ctx, r.RoomID, r.Name, r.Building, r.Floor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rooms, total, err := rst.GetRoomsPage(ctx, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 {
+		t.Errorf("total = %d, want 4", total)
+	}
+	if len(rooms) != 2 || rooms[0].RoomID != 1 || rooms[1].RoomID != 2 {
+		t.Errorf("rooms = %+v, want rooms 1 and 2", rooms)
+	}
+
+	rooms, _, err = rst.GetRoomsPage(ctx, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 0 {
+		t.Errorf("rooms = %+v, want empty", rooms)
+	}
+}
@@ -3,29 +3,292 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	dproxy "github.com/koron/go-dproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"math"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 前回の投票からMinVoteIntervalが経過していないことを表すエラー
+var ErrVoteTooSoon = errors.New("vote is changed too soon")
+
+// セッションが必要な操作を、セッションなしで行おうとしたことを表すエラー
+var ErrNoSession = errors.New("session is required")
+
+// 投票の選択肢が不正であることを表すエラー
+var ErrInvalidChoice = errors.New("vote choice is invalid")
+
+// 部屋が、このインスタンスが担当する建物に含まれないことを表すエラー
+var ErrRoomOutOfScope = errors.New("room is not in the buildings served by this instance")
+
+// 値の範囲。MinとMaxを含む。
+type ValueRange struct {
+	Min float64
+	Max float64
+}
+
+var (
+	// センサーの気温(℃)として妥当な範囲
+	DefaultTemperatureRange = ValueRange{Min: -30, Max: 60}
+	// センサーの湿度(%)として妥当な範囲
+	DefaultHumidityRange = ValueRange{Min: 0, Max: 100}
+)
+
+func (r ValueRange) IsZero() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+func (r ValueRange) Contains(v float64) bool {
+	return r.Min <= v && v <= r.Max
+}
+
+// minとmaxのうち、nilでないものでrの境界を置き換えた範囲を返す。
+// 片方の境界だけを指定した場合も、もう片方はrの値のまま使用する。
+func (r ValueRange) Override(min, max *float64) ValueRange {
+	if min != nil {
+		r.Min = *min
+	}
+	if max != nil {
+		r.Max = *max
+	}
+	return r
+}
+
 type RoomNameMap map[RoomID]string
 type RoomGroupMap map[BuildingName]map[FloorID][]RoomID
 
 const (
-	INTERVAL     = 1 * time.Minute
-	CACHE_EXPIRE = 3 * time.Minute
+	INTERVAL        = 1 * time.Minute
+	CACHE_EXPIRE    = 3 * time.Minute
+	STALE_RETENTION = 30 * time.Minute
+	// 更新処理の終了から次の更新処理の開始までに、最低限空ける時間
+	MIN_REFRESH_GAP = 10 * time.Second
+	// 同じ部屋への投票を変更できる最短の間隔
+	MIN_VOTE_INTERVAL = 5 * time.Second
+	// 投票後、この時間が経過した投票は集計しない
+	VOTE_TTL = 30 * time.Minute
+	// 最終更新時刻からこの時間以内であれば、センサーが接続されているとみなす
+	CONNECTED_THRESHOLD = 60 * time.Second
+	// センサーの状態を同時に更新する最大数
+	MAX_CONCURRENT_UPDATES = 16
+	// DBの1つのクエリに掛けられる最大の時間
+	QUERY_TIMEOUT = 10 * time.Second
+	// 部屋毎に返すセンサーの最大数
+	MAX_SENSORS_PER_ROOM = 32
 )
 
+// RoomStatusManagerの設定。0のフィールドはデフォルト値を使用する。
+type RSMConfig struct {
+	// センサーの状態を更新する間隔。デフォルトはINTERVAL。
+	RefreshInterval time.Duration
+	// 更新処理の終了から次の更新処理の開始までに、最低限空ける時間。
+	// デフォルトはMIN_REFRESH_GAPとRefreshIntervalの短い方。
+	MinRefreshGap time.Duration
+	// センサーの状態をキャッシュしておく期間。デフォルトはCACHE_EXPIRE。
+	CacheExpire time.Duration
+	// センサーの接続が切れた後、最後の値を表示し続ける期間。デフォルトはSTALE_RETENTION。
+	StaleRetention time.Duration
+	// センサーが接続されているとみなす、最終更新時刻からの経過時間。デフォルトはCONNECTED_THRESHOLD。
+	ConnectedThreshold time.Duration
+	// ThingWorxへ同時に送信するリクエストの最大数。デフォルトはMAX_CONCURRENT_UPDATES。
+	MaxConcurrentUpdates int
+	// 部屋毎に返すセンサーの最大数。超えた場合は最終更新時刻が新しいものから返す。
+	// 誤って多数のThingが対応付けられた部屋で、レスポンスが肥大化しないようにする。デフォルトはMAX_SENSORS_PER_ROOM。
+	MaxSensorsPerRoom int
+	// trueの場合、NewRoomStatusManagerから戻る前にセンサーの状態を取得しておく。
+	WarmCache bool
+	// 投票が有効な期間。これより古い投票は集計せず、未投票として扱う。デフォルトはVOTE_TTL。
+	VoteTTL time.Duration
+	// 部屋毎に集計する投票の最大数。有効な投票のうち、新しいものからこの数だけを集計する。
+	// 0以下の場合は、有効な投票をすべて集計する。ウィンドウ関数を使用するため、MySQLは8.0以降が必要。
+	VoteWindowSize int
+	// 同じセッションから同じ部屋への投票を変更できる最短の間隔。デフォルトはMIN_VOTE_INTERVAL。
+	MinVoteInterval time.Duration
+	// 投票の履歴を保持する期間。デフォルトはVOTE_EVENT_RETENTION。
+	VoteEventRetention time.Duration
+	// trueの場合、センサーの測定値をsensor_readingテーブルに保存する。
+	RecordHistory bool
+	// センサーの測定値の履歴を保持する期間。デフォルトはHISTORY_RETENTION。
+	HistoryRetention time.Duration
+	// ログの出力先。nilの場合は標準エラー出力にテキスト形式で出力する。
+	Logger *slog.Logger
+	// DBの1つのクエリに掛けられる最大の時間。超えた場合はクエリを中断し、ErrQueryTimeoutを返す。
+	// リクエスト全体の期限とは別に、クエリ毎に適用する。デフォルトはQUERY_TIMEOUT。
+	QueryTimeout time.Duration
+	// DBのSQLの方言。デフォルトはDialectMySQL。
+	Dialect Dialect
+	// センサーの値として妥当な範囲。範囲外の値はセンサーの異常とみなし、キャッシュに反映しない。
+	// 未指定(MinとMaxがともに0)の場合は、DefaultTemperatureRangeとDefaultHumidityRangeを使用する。
+	TemperatureRange ValueRange
+	HumidityRange    ValueRange
+	// trueの場合、部屋の削除時に部屋のThing、投票、測定値の履歴も削除する。
+	// falseの場合、Thingまたは投票が残っている部屋は削除できない。
+	CascadeRoomDelete bool
+	// セッションの有効期間。デフォルトはSESSION_TTL。(10分)
+	// 有効期限はセッションの作成時と延長時にDBへ書き込まれるため、変更前に作成されたセッションにも影響しない。
+	SessionTTL time.Duration
+	// セッションのCookieの属性。ゼロ値の場合はSecure、HttpOnly、SameSite=LaxのCookieになる。
+	SessionCookie SessionCookieConfig
+	// 部屋が不快な状態のまま続いていることを通知するWebhookのURL。空の場合は通知しない。
+	AlertWebhookURL string
+	// 通知するまでに不快な状態が続く時間。デフォルトはALERT_DURATION。
+	AlertDuration time.Duration
+	// 通知の対象とする部屋の、最小の投票数。デフォルトはALERT_MIN_VOTES。
+	AlertMinVotes int
+	// 部屋の名前と建物・階の一覧をキャッシュしておく期間。デフォルトはROOM_INFO_TTL。
+	RoomInfoTTL time.Duration
+	// 存在しない部屋を参照するThingと投票を削除する間隔。デフォルトはINTEGRITY_SWEEP_INTERVAL。
+	IntegritySweepInterval time.Duration
+	// RefreshRoomで同じ部屋を更新できる最短の間隔。デフォルトはROOM_REFRESH_INTERVAL。
+	RoomRefreshInterval time.Duration
+	// このインスタンスが担当する建物。指定した建物のThingのみ更新し、他の建物の部屋の状態は返さない。
+	// 空の場合はすべての建物を担当する。
+	Buildings []BuildingName
+	// 表示する気温を平滑化する指数移動平均の係数。(0より大きく1以下) 小さいほど変化が緩やかになる。
+	// 0の場合は平滑化せず、測定値をそのまま表示する。履歴には常に測定値を保存する。
+	TemperatureSmoothing float64
+	// センサーの接続が切れたときと、復帰したときに通知するWebhookのURL。空の場合は通知しない。
+	SensorWebhookURL string
+	// 接続状態の変化を通知するまでの猶予期間。この期間内に元に戻った場合は通知しない。
+	// デフォルトはSENSOR_ALERT_GRACE_PERIOD。
+	SensorAlertGracePeriod time.Duration
+	// 0より大きい場合、この間隔でランダムなセッションからランダムな部屋へ投票する。デモと負荷試験用。
+	// 投票は通常の投票と同じ処理で行うため、実際の投票と区別できない。本番環境では設定しないこと。
+	SimulatedVoteInterval time.Duration
+	// スパンの作成に使用するTracerProvider。nilの場合はグローバルのTracerProviderを使用し、
+	// それも設定されていない場合はスパンを記録しない。
+	TracerProvider trace.TracerProvider
+}
+
+// 未設定の項目をデフォルト値で補う。
+func (c RSMConfig) withDefaults() RSMConfig {
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = INTERVAL
+	}
+	if c.MinRefreshGap <= 0 {
+		c.MinRefreshGap = MIN_REFRESH_GAP
+		if c.MinRefreshGap > c.RefreshInterval {
+			c.MinRefreshGap = c.RefreshInterval
+		}
+	}
+	if c.CacheExpire <= 0 {
+		c.CacheExpire = CACHE_EXPIRE
+	}
+	if c.StaleRetention <= 0 {
+		c.StaleRetention = STALE_RETENTION
+	}
+	if c.ConnectedThreshold <= 0 {
+		c.ConnectedThreshold = CONNECTED_THRESHOLD
+	}
+	if c.MaxConcurrentUpdates <= 0 {
+		c.MaxConcurrentUpdates = MAX_CONCURRENT_UPDATES
+	}
+	if c.MaxSensorsPerRoom <= 0 {
+		c.MaxSensorsPerRoom = MAX_SENSORS_PER_ROOM
+	}
+	if c.VoteTTL <= 0 {
+		c.VoteTTL = VOTE_TTL
+	}
+	if c.MinVoteInterval <= 0 {
+		c.MinVoteInterval = MIN_VOTE_INTERVAL
+	}
+	if c.AlertDuration <= 0 {
+		c.AlertDuration = ALERT_DURATION
+	}
+	if c.SensorAlertGracePeriod <= 0 {
+		c.SensorAlertGracePeriod = SENSOR_ALERT_GRACE_PERIOD
+	}
+	if c.AlertMinVotes <= 0 {
+		c.AlertMinVotes = ALERT_MIN_VOTES
+	}
+	if c.VoteEventRetention <= 0 {
+		c.VoteEventRetention = VOTE_EVENT_RETENTION
+	}
+	if c.HistoryRetention <= 0 {
+		c.HistoryRetention = HISTORY_RETENTION
+	}
+	if c.TemperatureRange.IsZero() {
+		c.TemperatureRange = DefaultTemperatureRange
+	}
+	if c.HumidityRange.IsZero() {
+		c.HumidityRange = DefaultHumidityRange
+	}
+	if c.IntegritySweepInterval <= 0 {
+		c.IntegritySweepInterval = INTEGRITY_SWEEP_INTERVAL
+	}
+	if c.RoomInfoTTL <= 0 {
+		c.RoomInfoTTL = ROOM_INFO_TTL
+	}
+	if c.RoomRefreshInterval <= 0 {
+		c.RoomRefreshInterval = ROOM_REFRESH_INTERVAL
+	}
+	if c.QueryTimeout <= 0 {
+		c.QueryTimeout = QUERY_TIMEOUT
+	}
+	if c.SessionTTL <= 0 {
+		c.SessionTTL = SESSION_TTL
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	if _, ok := c.Logger.Handler().(*requestIDLogHandler); !ok {
+		c.Logger = slog.New(&requestIDLogHandler{c.Logger.Handler()})
+	}
+	return c
+}
+
 type RoomStatus struct {
 	RoomID  RoomID         `json:"id"`
 	Sensors []SensorStatus `json:"sensors"`
+	// trueの場合、センサーの数がMaxSensorsPerRoomを超えたため、Sensorsは一部のセンサーのみを含む。
+	SensorsTruncated bool `json:"sensorsTruncated,omitempty"`
+
+	// 接続中のセンサーの平均値。その値を測定している接続中のセンサーがない場合はnil。
+	AvgTemperature *float64 `json:"avgTemperature,omitempty"`
+	AvgHumidity    *float64 `json:"avgHumidity,omitempty"`
+	// 平均気温と平均湿度から計算した体感温度。平均気温がない場合はnil。
+	HeatIndex *float64 `json:"heatIndex,omitempty"`
+	// trueの場合、HeatIndexは計算できなかったため平均気温をそのまま使用している。
+	HeatIndexFallback bool `json:"heatIndexFallback,omitempty"`
+	// 平均値の計算に使用した、接続中のセンサーの数
+	SensorCount int `json:"sensorCount"`
+	// 部屋の目標気温の下限と上限。設定されていない場合はnil。
+	TargetTempMin *float64 `json:"targetTempMin,omitempty"`
+	TargetTempMax *float64 `json:"targetTempMax,omitempty"`
+	// 平均気温が目標気温の範囲内であればtrue。目標気温が設定されていないか、接続中のセンサーがない場合はnil。
+	InTargetRange *bool `json:"inTargetRange,omitempty"`
+
+	VeryHot  uint64 `json:"veryHot"`
+	Hot      uint64 `json:"hot"`
+	Comfort  uint64 `json:"comfort"`
+	Cold     uint64 `json:"cold"`
+	VeryCold uint64 `json:"veryCold"`
+	// 不明な選択肢の投票数
+	Other uint64 `json:"other"`
+	// 投票数の合計
+	Total uint64 `json:"total"`
+	// 各選択肢の投票数の割合。合計が100になるように整数に丸めている。
+	Percentages VotePercentages `json:"percentages"`
+	lock        sync.RWMutex
+}
 
-	Hot     uint64 `json:"hot"`
-	Comfort uint64 `json:"comfort"`
-	Cold    uint64 `json:"cold"`
-	lock    sync.RWMutex
+type VotePercentages struct {
+	VeryHot  float64 `json:"veryHot"`
+	Hot      float64 `json:"hot"`
+	Comfort  float64 `json:"comfort"`
+	Cold     float64 `json:"cold"`
+	VeryCold float64 `json:"veryCold"`
+	Other    float64 `json:"other"`
 }
 
 type MyVote struct {
@@ -35,48 +298,224 @@ type MyVote struct {
 
 type RoomStatusManager struct {
 	db        *sql.DB
-	thingworx *ThingWorxClient
+	thingworx PropertyReader
+	config    RSMConfig
+	tracer    trace.Tracer
 
 	sensorCache map[RoomID]map[ThingName]SensorStatus
+	// 部屋が属する建物。メトリクスのラベルに使用する。cacheLockで保護する。
+	buildings map[RoomID]BuildingName
+	// センサーの表示名。表示名が設定されたセンサーのみ含む。cacheLockで保護する。
+	labels map[sensorKey]string
+	// setLabelsの度に増える世代と、センサー毎に表示名を最後に変更した世代。cacheLockで保護する。
+	labelGen     uint64
+	labelChanged map[sensorKey]uint64
+	// 最後に成功した、すべてのセンサーの状態の更新が完了した時刻。cacheLockで保護する。
+	lastRefresh time.Time
 	cacheLock   sync.RWMutex
+
+	// 部屋の状態の変化を通知する
+	events *roomEventHub
+	// センサー毎に、最後に履歴として保存した測定値の最終更新時刻。cacheUpdaterからのみアクセスする。
+	lastRecorded map[sensorKey]int64
+	// 部屋毎の不快な状態の通知の状態。cacheUpdaterからのみアクセスする。
+	alertStates map[RoomID]*roomAlertState
+	// センサー毎の接続状態。キャッシュから削除されたセンサーの状態も保持する。
+	connStates map[sensorKey]*connState
+	connLock   sync.Mutex
+
+	// 部屋の名前と建物・階の一覧のキャッシュ。roomInfoGenはキャッシュを破棄する度に増える。
+	roomInfo     *roomInfoCache
+	roomInfoGen  uint64
+	roomInfoLock sync.RWMutex
+
+	// 処理済みの投票の再送を識別するキー
+	idempotency idempotencyCache
+
+	// 部屋毎に、RefreshRoomで最後に更新を開始した時刻
+	roomRefreshes   map[RoomID]time.Time
+	roomRefreshLock sync.Mutex
+
+	// cacheUpdaterとintegritySweeperを停止する
+	cancel context.CancelFunc
+	// cacheUpdaterとintegritySweeper、goで開始した処理が終了したときにcloseされる
+	done chan struct{}
+	// バックグラウンドの処理に渡すcontextと、その終了を待つWaitGroup
+	ctx context.Context
+	wg  sync.WaitGroup
+	// ctxがキャンセルされた後はtrueになり、goで処理を開始しない
+	stopped  bool
+	stopLock sync.Mutex
 }
 
 type RoomStatusTx struct {
 	rsm *RoomStatusManager
-	tx  *sql.Tx
+	tx  *dbTx
 
 	// nilになる場合があるため、使用前に必ずnilチェックを行うこと。
 	s *Session
+
+	// このトランザクションで投票が変更された部屋。コミット後に購読者へ通知する。
+	changed map[RoomID]struct{}
+	// このトランザクションで行われた投票。コミット後にメトリクスへ記録する。
+	votes []Vote
+	// このトランザクションで処理した投票の再送を識別するキー。コミット後に記録する。
+	idempotencyKeys []idempotencyKey
+	// このトランザクションで部屋に追加・削除されたThing。コミット後にキャッシュへ反映する。
+	attached []sensorKey
+	detached []ThingName
+	// このトランザクションで変更されたセンサーの表示名。コミット後にキャッシュへ反映する。
+	labels map[sensorKey]string
+	// このトランザクションで部屋が作成・変更・削除された場合はtrue。コミット後に部屋の一覧のキャッシュを破棄する。
+	roomsChanged bool
 }
 
 type SensorStatus struct {
-	Temperature float64 `json:"temperature"`
-	Humidity    float64 `json:"humidity"`
-	IsConnected bool    `json:"isConnected"`
-	lastUpdated int64
+	// センサーのThing名と表示名。表示名が設定されていない場合、Labelは空。
+	ThingName ThingName `json:"thingName"`
+	Label     string    `json:"label,omitempty"`
+
+	// 気温と湿度。湿度のみ・気温のみを測定するセンサーなど、Thingがプロパティを持たない場合はnil。
+	Temperature *float64 `json:"temperature"`
+	Humidity    *float64 `json:"humidity"`
+	// 気温と湿度から計算した体感温度。計算できない場合は気温と同じ値になり、気温が不明な場合はnil。
+	HeatIndex *float64 `json:"heatIndex"`
+	// trueの場合、HeatIndexは計算できなかったため気温をそのまま使用している。
+	HeatIndexFallback bool `json:"heatIndexFallback"`
+	// 気温と湿度から計算した露点温度。湿度が不明な場合はnil。
+	DewPoint    *float64 `json:"dewPoint,omitempty"`
+	IsConnected bool     `json:"isConnected"`
+	// CO2濃度(ppm)と在室人数。Thingがプロパティを持たない場合はnil。
+	CO2       *float64 `json:"co2"`
+	Occupancy *int     `json:"occupancy"`
+	// 最終更新時刻(UNIX時間、秒単位)
+	LastUpdated int64 `json:"lastUpdated"`
+	// キャッシュから取り出した時点での、最終更新時刻からの経過秒数
+	AgeSeconds int64 `json:"ageSeconds"`
+	// trueの場合、キャッシュの有効期限が切れた後の、最後に取得できた値を表示している
+	Stale bool `json:"stale"`
 
 	expire time.Time
+	// この時刻までは、接続が切れた後も最後の値を表示し続ける
+	staleUntil time.Time
+	// 平滑化する前の、センサーが測定した気温
+	rawTemperature *float64
 }
 
-func NewRoomStatusManager(db *sql.DB, thingworx *ThingWorxClient, ctx context.Context) *RoomStatusManager {
+func NewRoomStatusManager(db *sql.DB, thingworx PropertyReader, config RSMConfig, ctx context.Context) *RoomStatusManager {
 	// create RSM
 	rs := &RoomStatusManager{}
 	rs.db = db
 	rs.thingworx = thingworx
+	rs.config = config.withDefaults()
+	rs.tracer = tracerFrom(rs.config.TracerProvider)
 	rs.sensorCache = make(map[RoomID]map[ThingName]SensorStatus)
+	rs.buildings = make(map[RoomID]BuildingName)
+	rs.events = newRoomEventHub()
+	rs.lastRecorded = make(map[sensorKey]int64)
+	rs.alertStates = make(map[RoomID]*roomAlertState)
+	rs.connStates = make(map[sensorKey]*connState)
+	rs.roomRefreshes = make(map[RoomID]time.Time)
+
+	if rs.config.WarmCache {
+		for _, err := range rs.WarmCache(ctx) {
+			rs.config.Logger.Error("failed to update sensor status", "error", err)
+		}
+	}
 
-	go rs.cacheUpdater(ctx)
+	ctx, rs.cancel = context.WithCancel(ctx)
+	rs.ctx = ctx
+	rs.done = make(chan struct{})
+	rs.wg.Add(3)
+	go func() {
+		defer rs.wg.Done()
+		rs.cacheUpdater(ctx, rs.config.WarmCache)
+	}()
+	go func() {
+		defer rs.wg.Done()
+		rs.integritySweeper(ctx)
+	}()
+	go func() {
+		// 停止した後にgoでWaitGroupへ追加しないように、キャンセルされるまでWaitGroupを保持する
+		defer rs.wg.Done()
+		<-ctx.Done()
+		rs.stopLock.Lock()
+		rs.stopped = true
+		rs.stopLock.Unlock()
+	}()
+	if rs.config.SimulatedVoteInterval > 0 {
+		rs.wg.Add(1)
+		go func() {
+			defer rs.wg.Done()
+			newVoteSimulator(rs, time.Now().UnixNano()).run(ctx, rs.config.SimulatedVoteInterval)
+		}()
+	}
+	go func() {
+		rs.wg.Wait()
+		close(rs.done)
+	}()
 	return rs
 }
 
+// fを別のgoroutineで実行する。fにはCloseでキャンセルされるcontextが渡され、Closeはfが戻るまで待つ。
+// 停止した後は何もしない。
+func (rsm *RoomStatusManager) goBackground(f func(ctx context.Context)) {
+	rsm.stopLock.Lock()
+	defer rsm.stopLock.Unlock()
+	if rsm.stopped || rsm.ctx == nil {
+		return
+	}
+	rsm.wg.Add(1)
+	go func() {
+		defer rsm.wg.Done()
+		f(rsm.ctx)
+	}()
+}
+
+// 部屋の状態が変化したときに、その部屋のIDが送信されるチャネルを返す。
+// 部屋を指定しなかった場合は、すべての部屋の変化を通知する。
+// 購読が不要になったら、必ず戻り値の関数を呼び出して購読を解除すること。
+func (rsm *RoomStatusManager) Subscribe(rooms ...RoomID) (<-chan RoomID, func()) {
+	return rsm.events.Subscribe(rooms...)
+}
+
+// すべての購読を終了させ、購読者が購読を解除するか、ctxがキャンセルされるまで待つ。
+// SSEやWebSocketの接続を切断するために、HTTPサーバーの停止時に呼び出す。
+func (rsm *RoomStatusManager) CloseSubscriptions(ctx context.Context) error {
+	rsm.events.Close()
+	return rsm.events.Wait(ctx)
+}
+
+// すべてのセンサーの状態を同期的に取得し、キャッシュに格納する。
+// 起動直後にセンサーの状態が空になることを防ぐために、リクエストの受付前に呼び出す。
+func (rsm *RoomStatusManager) WarmCache(ctx context.Context) []error {
+	rsm.config.Logger.Info("warm up sensor status cache")
+	return rsm.updateAllSensorStatuses(ctx)
+}
+
+// cacheUpdaterとintegritySweeper、goBackgroundで開始した処理を停止し、実行中の処理が終わるまで待つ。
+// Closeから戻った後は、RoomStatusManagerのgoroutineがDBにアクセスすることはない。
+func (rsm *RoomStatusManager) Close() error {
+	rsm.cancel()
+	<-rsm.done
+	return nil
+}
+
+// 方言に合わせてプレースホルダーを書き換えるトランザクションを開始する。
+func (rsm *RoomStatusManager) begin(ctx context.Context) (*dbTx, error) {
+	return beginTx(ctx, rsm.db, rsm.config.Dialect, rsm.config.QueryTimeout)
+}
+
+// リクエストのセッションを使用するトランザクションを開始する。
+// トランザクションはreq.Context()に紐付き、クライアントが切断するとロールバックされる。
 func (rsm *RoomStatusManager) GetTx(w http.ResponseWriter, req *http.Request, new bool) (*RoomStatusTx, error) {
-	tx, err := rsm.db.Begin()
+	tx, err := rsm.begin(req.Context())
 	if err != nil {
 		return nil, err
 	}
-	s := GetSession(w, req, tx)
+	s := GetSession(w, req, tx, rsm.config.SessionTTL, rsm.config.SessionCookie)
 	if s == nil && new {
-		s, err = NewSession(w, req, tx)
+		s, err = NewSession(w, req, tx, rsm.config.SessionTTL, rsm.config.SessionCookie)
 		if err != nil {
 			defer tx.Rollback()
 			return nil, err
@@ -89,25 +528,238 @@ func (rsm *RoomStatusManager) GetTx(w http.ResponseWriter, req *http.Request, ne
 	}, nil
 }
 
+// セッションを使用せずに、読み取りのためのトランザクションを開始する。
+// Cookieの読み書きもセッションの作成も行わないため、表示専用の端末から繰り返し呼び出されても、
+// セッションが作られたり有効期限が延長されたりすることはない。RoomStatusTxのセッションは常にnilになる。
+func (rsm *RoomStatusManager) PeekTx(ctx context.Context) (*RoomStatusTx, error) {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+	}, nil
+}
+
+// セッションIDを指定してトランザクションを開始する。
+// セッションの有効期限が切れている場合、RoomStatusTxのセッションはnilになる。
+func (rsm *RoomStatusManager) GetTxBySessionID(ctx context.Context, sessionID uint64) (*RoomStatusTx, error) {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+		s:   GetSessionByID(ctx, tx, sessionID, rsm.config.SessionTTL),
+	}, nil
+}
+
 func (rst *RoomStatusTx) Rollback() error {
 	return rst.tx.Rollback()
 }
 
 func (rst *RoomStatusTx) Commit() error {
-	return rst.tx.Commit()
+	if err := rst.tx.Commit(); err != nil {
+		return err
+	}
+	if rst.roomsChanged {
+		rst.rsm.invalidateRoomInfo()
+	}
+	for id := range rst.changed {
+		rst.rsm.events.Publish(id)
+	}
+	now := time.Now()
+	for _, key := range rst.idempotencyKeys {
+		rst.rsm.idempotency.Add(key, now)
+	}
+	for _, v := range rst.votes {
+		votesCounter.WithLabelValues(string(rst.rsm.buildingOf(v.RoomID)), string(v.Choice)).Inc()
+	}
+	if len(rst.labels) > 0 {
+		rst.rsm.setLabels(rst.labels)
+	}
+	for _, name := range rst.detached {
+		rst.rsm.removeThingFromCache(name)
+	}
+	for _, key := range rst.attached {
+		// 次の更新周期を待たずにセンサーを表示するため、すぐに状態を取得する
+		rst.rsm.goBackground(func(ctx context.Context) {
+			rst.rsm.refreshSensorStatus(ctx, key.RoomID, key.ThingName)
+		})
+	}
+	return nil
+}
+
+// 投票が変更された部屋を記録する。
+func (rst *RoomStatusTx) markChanged(id RoomID) {
+	if rst.changed == nil {
+		rst.changed = make(map[RoomID]struct{})
+	}
+	rst.changed[id] = struct{}{}
+}
+
+// これ以降に投票されたものを有効な投票として扱う。
+func (rsm *RoomStatusManager) voteValidSince() time.Time {
+	return time.Now().Add(-rsm.config.VoteTTL)
+}
+
+// 建物が、このインスタンスが担当する建物に含まれるかどうかを返す。
+func (rsm *RoomStatusManager) inScope(building BuildingName) bool {
+	if len(rsm.config.Buildings) == 0 {
+		return true
+	}
+	for _, b := range rsm.config.Buildings {
+		if b == building {
+			return true
+		}
+	}
+	return false
+}
+
+// 担当する建物に絞り込むWHERE句の条件(" AND column IN (?, ...)")と、そのプレースホルダの値を返す。
+// columnは建物名の列。すべての建物を担当する場合は、空文字列を返す。
+func (rsm *RoomStatusManager) buildingScope(column string) (string, []interface{}) {
+	if len(rsm.config.Buildings) == 0 {
+		return "", nil
+	}
+	placeholders := make([]string, len(rsm.config.Buildings))
+	args := make([]interface{}, len(rsm.config.Buildings))
+	for i, b := range rsm.config.Buildings {
+		placeholders[i] = "?"
+		args[i] = string(b)
+	}
+	return " AND " + column + " IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// 集計の対象とする投票(vote_id, room_id, choice)を返すサブクエリと、そのプレースホルダの値を返す。
+// VoteWindowSizeが設定されている場合は、部屋毎に新しいものからVoteWindowSize件に絞る。
+// condはvoteテーブルに対する追加の条件式で、空でなければ部屋毎に絞り込む前に適用する。
+// (一部の部屋だけを集計する場合に、すべての部屋の投票に番号を振らないようにするため)
+func (rsm *RoomStatusManager) countedVotes(cond string, condArgs ...interface{}) (string, []interface{}) {
+	where := `session.expire>=? AND vote.timestamp>=?`
+	args := []interface{}{time.Now(), rsm.voteValidSince()}
+	if cond != "" {
+		where += ` AND (` + cond + `)`
+		args = append(args, condArgs...)
+	}
+	query := `SELECT vote.vote_id, vote.room_id, vote.choice FROM vote NATURAL JOIN session
+		WHERE ` + where
+	if rsm.config.VoteWindowSize <= 0 {
+		return query, args
+	}
+	query = `SELECT vote_id, room_id, choice FROM (
+			SELECT vote.vote_id, vote.room_id, vote.choice,
+				ROW_NUMBER() OVER (PARTITION BY vote.room_id ORDER BY vote.timestamp DESC, vote.vote_id DESC) AS n
+			FROM vote NATURAL JOIN session
+			WHERE ` + where + `
+		) recent WHERE n<=?`
+	return query, append(args, rsm.config.VoteWindowSize)
+}
+
+// 現在のセッションのCSRFトークンを返す。セッションがない場合は空文字列を返す。
+func (rst *RoomStatusTx) CSRFToken() string {
+	if rst.s == nil {
+		return ""
+	}
+	return rst.s.CSRFToken()
+}
+
+// セッションの有効期限を、現在時刻から有効期間だけ延長する。(スライディングセッション)
+// Cookieの有効期間も更新される。セッションがない場合は何もしない。
+func (rst *RoomStatusTx) TouchSession(ctx context.Context) (err error) {
+	ctx, span := rst.startSpan(ctx, "TouchSession")
+	defer func() { endSpan(span, err) }()
+
+	if rst.s == nil {
+		return nil
+	}
+	return rst.s.ExtendExpiration(ctx)
+}
+
+// 現在のセッションと、そのセッションの投票を削除し、Cookieを消去する。
+// セッションがない場合は何もしない。削除後、このトランザクションのセッションはnilになる。
+func (rst *RoomStatusTx) DeleteSession(ctx context.Context) (err error) {
+	ctx, span := rst.startSpan(ctx, "DeleteSession")
+	defer func() { endSpan(span, err) }()
+
+	if rst.s == nil {
+		return nil
+	}
+
+	// 投票が取り消される部屋を、コミット後に通知する
+	rows, err := rst.tx.QueryContext(ctx,
+		`SELECT DISTINCT room_id FROM vote WHERE session_id=?`,
+		rst.s.SessionID,
+	)
+	if err != nil {
+		return err
+	}
+	var rooms []RoomID
+	for rows.Next() {
+		var id RoomID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		rooms = append(rooms, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// 外部キー制約が無効なDB(SQLiteのデフォルト)でも投票が残らないように、明示的に削除する
+	if _, err := rst.tx.ExecContext(ctx,
+		`DELETE FROM vote WHERE session_id=?`,
+		rst.s.SessionID,
+	); err != nil {
+		return err
+	}
+	if _, err := rst.tx.ExecContext(ctx,
+		`DELETE FROM session WHERE session_id=?`,
+		rst.s.SessionID,
+	); err != nil {
+		return err
+	}
+
+	for _, id := range rooms {
+		rst.markChanged(id)
+	}
+	rst.s.Clear()
+	rst.s = nil
+	return nil
 }
 
-func (rst *RoomStatusTx) GetRoomName(id RoomID) (name string, err error) {
-	err = rst.tx.QueryRow(
-		`SELECT name FROM room
-		WHERE room_id=?`,
+// 部屋へのすべての投票を削除し、削除した投票の数を返す。
+// 空調を調整した後など、以前の投票を集計から外したい場合に使う。
+func (rst *RoomStatusTx) ResetVotes(ctx context.Context, id RoomID) (_ int64, err error) {
+	ctx, span := rst.startSpan(ctx, "ResetVotes", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	res, err := rst.tx.ExecContext(ctx,
+		`DELETE FROM vote WHERE room_id=?`,
 		id,
-	).Scan(&name)
-	return
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		rst.markChanged(id)
+	}
+	return n, nil
 }
 
-// 投票内容を取得する。未投票の場合はnilを返す
-func (rst *RoomStatusTx) GetMyVote(id RoomID) (vote *MyVote, err error) {
+// 投票内容を取得する。未投票の場合や、投票の有効期間が過ぎている場合はnilを返す
+func (rst *RoomStatusTx) GetMyVote(ctx context.Context, id RoomID) (vote *MyVote, err error) {
+	ctx, span := rst.startSpan(ctx, "GetMyVote", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
 	var v Vote
 
 	if rst.s == nil {
@@ -115,69 +767,509 @@ func (rst *RoomStatusTx) GetMyVote(id RoomID) (vote *MyVote, err error) {
 		return nil, nil
 	}
 
-	if err = rst.tx.QueryRow(
-		`SELECT choice, timestamp FROM vote
-			WHERE session_id=? AND room_id=?`,
-		rst.s.SessionID, id,
-	).Scan((*string)(&v.Choice), &v.Timestamp); err != nil {
-		if err == sql.ErrNoRows {
-			// 未投票の状態。
-			err = nil
-			return
+	if err = rst.tx.QueryRowContext(ctx,
+		`SELECT choice, timestamp FROM vote
+			WHERE session_id=? AND room_id=? AND timestamp>=?`,
+		rst.s.SessionID, id, rst.rsm.voteValidSince(),
+	).Scan((*string)(&v.Choice), &v.Timestamp); err != nil {
+		if err == sql.ErrNoRows {
+			// 未投票の状態。
+			err = nil
+			return
+		}
+		return
+	}
+
+	vote = &MyVote{
+		Vote:      v.Choice,
+		Timestamp: v.Timestamp.Unix(),
+	}
+	return vote, err
+}
+
+// 全ての部屋への投票内容を1回のクエリで取得する。投票の有効期間が過ぎているものは含めない。
+// セッションがnilの場合は空のmapを返す。
+func (rst *RoomStatusTx) GetMyVotes(ctx context.Context) (_ map[RoomID]MyVote, err error) {
+	ctx, span := rst.startSpan(ctx, "GetMyVotes")
+	defer func() { endSpan(span, err) }()
+
+	votes := make(map[RoomID]MyVote)
+	if rst.s == nil {
+		// セッションがnilなので、未投票とみなす
+		return votes, nil
+	}
+
+	rows, err := rst.tx.QueryContext(ctx,
+		`SELECT room_id, choice, timestamp FROM vote
+			WHERE session_id=? AND timestamp>=?`,
+		rst.s.SessionID, rst.rsm.voteValidSince(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id RoomID
+		var v Vote
+		if err := rows.Scan(&id, (*string)(&v.Choice), &v.Timestamp); err != nil {
+			return nil, err
+		}
+		votes[id] = MyVote{
+			Vote:      v.Choice,
+			Timestamp: v.Timestamp.Unix(),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return votes, nil
+}
+
+func (rst *RoomStatusTx) GetStatus(ctx context.Context, id RoomID) (_ *RoomStatus, err error) {
+	ctx, span := rst.startSpan(ctx, "GetStatus", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	rs := rst.rsm.newRoomStatus(id)
+
+	var building string
+	var min, max sql.NullFloat64
+	err = rst.tx.QueryRowContext(ctx,
+		`SELECT building_name, target_temp_min, target_temp_max FROM room WHERE room_id=?`,
+		id,
+	).Scan(&building, &min, &max)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && !rst.rsm.inScope(BuildingName(building)) {
+		return nil, ErrRoomOutOfScope
+	}
+	rs.applyTarget(min, max)
+
+	votes, args := rst.rsm.countedVotes(`vote.room_id=?`, id)
+	rows, err := rst.tx.QueryContext(ctx,
+		`SELECT v.choice, count(v.vote_id) FROM (`+votes+`) v
+		GROUP BY v.choice`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var choice VoteChoice
+		var count uint64
+		if err := rows.Scan((*string)(&choice), &count); err != nil {
+			return nil, err
+		}
+		if !rs.addVotes(choice, count) {
+			rst.rsm.config.Logger.WarnContext(ctx, "unknown vote choice", "choice", choice, "room_id", id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rs.summarizeVotes()
+	return rs, nil
+}
+
+// 部屋の詳細画面に表示する情報。
+type RoomDetail struct {
+	RoomID RoomID      `json:"roomId"`
+	Name   string      `json:"name"`
+	Status *RoomStatus `json:"status"`
+	// 現在のセッションの投票。未投票の場合はnil。
+	MyVote *MyVote `json:"myvote"`
+	// 有効期間やセッションの削除に関わらず、この部屋に投票したことのあるセッションの数。GetTotalVotersを参照。
+	TotalVoters uint64 `json:"totalVoters"`
+}
+
+// 部屋の名前、状態、現在のセッションの投票をまとめて返す。
+// 部屋が存在しない場合はErrRoomNotFoundを返す。
+func (rst *RoomStatusTx) GetRoomDetail(ctx context.Context, id RoomID) (_ *RoomDetail, err error) {
+	ctx, span := rst.startSpan(ctx, "GetRoomDetail", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	name, err := rst.GetRoomName(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	status, err := rst.GetStatus(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	myVote, err := rst.GetMyVote(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	voters, err := rst.GetTotalVoters(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomDetail{
+		RoomID:      id,
+		Name:        name,
+		Status:      status,
+		MyVote:      myVote,
+		TotalVoters: voters,
+	}, nil
+}
+
+// 部屋に投票したことのあるセッションの数を返す。利用状況の分析に使用する。
+// RoomStatusの投票数は有効期間内の投票だけを集計した現在の状況を表すのに対し、
+// こちらは投票したセッションを記録するroom_voterから、有効期間を過ぎた投票や削除済みのセッションも含めて、
+// これまでに投票したセッションを重複なく数える。room_voterは部屋を削除するまで削除しない。
+func (rst *RoomStatusTx) GetTotalVoters(ctx context.Context, id RoomID) (_ uint64, err error) {
+	ctx, span := rst.startSpan(ctx, "GetTotalVoters", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	var n uint64
+	if err := rst.tx.QueryRowContext(ctx,
+		`SELECT count(*) FROM room_voter WHERE room_id=?`,
+		id,
+	).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// 指定した建物にあるすべての部屋の状態を、部屋ID順に返す。
+func (rst *RoomStatusTx) GetBuildingStatus(ctx context.Context, building BuildingName) (_ []*RoomStatus, err error) {
+	ctx, span := rst.startSpan(ctx, "GetBuildingStatus", attribute.String("room.building", string(building)))
+	defer func() { endSpan(span, err) }()
+
+	return rst.getRoomStatuses(ctx, `room.building_name=?`, string(building))
+}
+
+// 指定した階にあるすべての部屋の状態を、部屋ID順に返す。
+func (rst *RoomStatusTx) GetFloorStatus(ctx context.Context, building BuildingName, floor FloorID) (_ []*RoomStatus, err error) {
+	ctx, span := rst.startSpan(ctx, "GetFloorStatus", attribute.String("room.building", string(building)), attribute.Int64("room.floor", int64(floor)))
+	defer func() { endSpan(span, err) }()
+
+	return rst.getRoomStatuses(ctx, `room.building_name=? AND room.floor=?`, string(building), floor)
+}
+
+// 有効な投票の中で、指定した選択肢が最も多い(相対多数の)部屋の状態を部屋ID順に返す。
+// とても暑いは暑いに、とても寒いは寒いに含めて数えるため、choiceはHot、Comfort、Coldのいずれか。
+// 他の選択肢と同数で最も多い場合は、同数のどの選択肢を指定しても含める。
+// includeNoVotesがtrueの場合は、有効な投票がない部屋も含める。
+func (rst *RoomStatusTx) GetRoomsByDominantChoice(ctx context.Context, choice VoteChoice, includeNoVotes bool) (_ []*RoomStatus, err error) {
+	ctx, span := rst.startSpan(ctx, "GetRoomsByDominantChoice", attrChoice(choice))
+	defer func() { endSpan(span, err) }()
+
+	buckets := map[VoteChoice][]VoteChoice{
+		Hot:     {VeryHot, Hot},
+		Comfort: {Comfort},
+		Cold:    {Cold, VeryCold},
+	}
+	if _, ok := buckets[choice]; !ok {
+		return nil, ErrInvalidChoice
+	}
+
+	// 選択肢毎の投票数を部屋単位で集計し、指定した選択肢が他のすべての選択肢以上の部屋を選ぶ
+	count := func(c VoteChoice) string {
+		var in []string
+		for _, b := range buckets[c] {
+			in = append(in, `'`+string(b)+`'`)
+		}
+		return `sum(CASE WHEN v.choice IN (` + strings.Join(in, `, `) + `) THEN 1 ELSE 0 END)`
+	}
+	having := []string{count(choice) + `>0`}
+	for _, other := range []VoteChoice{Hot, Comfort, Cold} {
+		if other != choice {
+			having = append(having, count(choice)+`>=`+count(other))
+		}
+	}
+	votes, votesArgs := rst.rsm.countedVotes("")
+	cond := `room.room_id IN (
+		SELECT v.room_id FROM (` + votes + `) v
+		GROUP BY v.room_id
+		HAVING ` + strings.Join(having, ` AND `) + `
+	)`
+	args := votesArgs
+	if includeNoVotes {
+		cond = `(` + cond + ` OR room.room_id NOT IN (
+			SELECT v.room_id FROM (` + votes + `) v
+		))`
+		args = append(args, votesArgs...)
+	}
+	return rst.getRoomStatuses(ctx, cond, args...)
+}
+
+// roomテーブルに対する条件に一致する、すべての部屋の状態を部屋ID順に返す。
+// condはプレースホルダを含むSQLの条件式で、argsはその値。
+func (rst *RoomStatusTx) getRoomStatuses(ctx context.Context, cond string, args ...interface{}) ([]*RoomStatus, error) {
+	// 担当していない建物の部屋は含めない
+	scope, scopeArgs := rst.rsm.buildingScope("room.building_name")
+	cond = "(" + cond + ")" + scope
+	args = append(args[:len(args):len(args)], scopeArgs...)
+
+	statuses := []*RoomStatus{}
+	byID := map[RoomID]*RoomStatus{}
+	{
+		rows, err := rst.tx.QueryContext(ctx,
+			`SELECT room_id, target_temp_min, target_temp_max FROM room
+			WHERE `+cond+`
+			ORDER BY room_id`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id RoomID
+			var min, max sql.NullFloat64
+			if err := rows.Scan(&id, &min, &max); err != nil {
+				return nil, err
+			}
+			rs := rst.rsm.newRoomStatus(id)
+			rs.applyTarget(min, max)
+			statuses = append(statuses, rs)
+			byID[id] = rs
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	{
+		// 部屋毎に問い合わせず、すべての部屋の投票数を1回で集計する
+		votes, votesArgs := rst.rsm.countedVotes("")
+		rows, err := rst.tx.QueryContext(ctx,
+			`SELECT v.room_id, v.choice, count(v.vote_id) FROM (`+votes+`) v
+			INNER JOIN room ON room.room_id=v.room_id
+			WHERE `+cond+`
+			GROUP BY v.room_id, v.choice`,
+			append(votesArgs, args...)...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id RoomID
+			var choice VoteChoice
+			var count uint64
+			if err := rows.Scan(&id, (*string)(&choice), &count); err != nil {
+				return nil, err
+			}
+			if rs, ok := byID[id]; ok && !rs.addVotes(choice, count) {
+				rst.rsm.config.Logger.WarnContext(ctx, "unknown vote choice", "choice", choice, "room_id", id)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
 		}
-		return
 	}
 
-	vote = &MyVote{
-		Vote:      v.Choice,
-		Timestamp: v.Timestamp.Unix(),
+	for _, rs := range statuses {
+		rs.summarizeVotes()
 	}
-	return vote, err
+	return statuses, nil
 }
 
-func (rst *RoomStatusTx) GetStatus(id RoomID) (*RoomStatus, error) {
+// センサーの状態だけを設定したRoomStatusを作成する。
+func (rsm *RoomStatusManager) newRoomStatus(id RoomID) *RoomStatus {
 	rs := &RoomStatus{
 		RoomID: id,
 	}
 
 	var ok bool
-	rs.Sensors, ok = rst.rsm.getSensorStatusFromCache(id)
+	rs.Sensors, rs.SensorsTruncated, ok = rsm.getSensorStatusFromCache(id)
 	if !ok {
 		// センサーの状態を更新できていない状態。
 		rs.Sensors = []SensorStatus{}
 	}
 
-	rows, err := rst.tx.Query(
-		`SELECT vote.choice, count(vote.vote_id) FROM vote
-		NATURAL JOIN session
-		WHERE vote.room_id=? AND session.expire>=?
-		GROUP BY vote.choice`,
-		id, time.Now(),
-	)
+	rs.summarizeSensors()
+	return rs
+}
+
+// 選択肢毎の投票数を加算する。不明な選択肢の場合はOtherに加算し、falseを返す。
+func (rs *RoomStatus) addVotes(choice VoteChoice, count uint64) bool {
+	switch choice {
+	case VeryHot:
+		rs.VeryHot += count
+	case Hot:
+		rs.Hot += count
+	case Comfort:
+		rs.Comfort += count
+	case Cold:
+		rs.Cold += count
+	case VeryCold:
+		rs.VeryCold += count
+	default:
+		// 不明な選択肢も、合計から漏れないようにOtherとして数える
+		rs.Other += count
+		return false
+	}
+	return true
+}
+
+// 投票数の合計と割合を計算する。
+func (rs *RoomStatus) summarizeVotes() {
+	rs.Total = rs.VeryHot + rs.Hot + rs.Comfort + rs.Cold + rs.VeryCold + rs.Other
+	p := roundPercentages([]uint64{rs.VeryHot, rs.Hot, rs.Comfort, rs.Cold, rs.VeryCold, rs.Other})
+	rs.Percentages = VotePercentages{
+		VeryHot:  p[0],
+		Hot:      p[1],
+		Comfort:  p[2],
+		Cold:     p[3],
+		VeryCold: p[4],
+		Other:    p[5],
+	}
+}
+
+// 各要素の割合を、合計がちょうど100になるように整数に丸めて返す。(最大剰余方式)
+// 合計が0の場合は、すべて0を返す。
+func roundPercentages(counts []uint64) []float64 {
+	result := make([]float64, len(counts))
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return result
+	}
+
+	remainders := make([]uint64, len(counts))
+	var sum uint64
+	for i, c := range counts {
+		result[i] = float64(c * 100 / total)
+		remainders[i] = c * 100 % total
+		sum += c * 100 / total
+	}
+	// 端数の大きいものから順に1ずつ加算する。端数が同じ場合は先頭の要素を優先する。
+	for ; sum < 100; sum++ {
+		max := 0
+		for i := range remainders {
+			if remainders[i] > remainders[max] {
+				max = i
+			}
+		}
+		result[max]++
+		remainders[max] = 0
+	}
+	return result
+}
+
+// セッションを使用せずに、部屋の状態を取得する。
+func (rsm *RoomStatusManager) GetStatus(ctx context.Context, id RoomID) (*RoomStatus, error) {
+	tx, err := rsm.begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var choice VoteChoice
-		var count uint64
-		if err := rows.Scan((*string)(&choice), &count); err != nil {
-			return nil, err
+	defer tx.Rollback()
+
+	rst := &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+	}
+	return rst.GetStatus(ctx, id)
+}
+
+// 部屋の目標気温を設定し、平均気温が範囲内かどうかを判定する。summarizeSensorsの後に呼び出すこと。
+func (rs *RoomStatus) applyTarget(min, max sql.NullFloat64) {
+	rs.TargetTempMin, rs.TargetTempMax, rs.InTargetRange = nil, nil, nil
+	if min.Valid {
+		rs.TargetTempMin = &min.Float64
+	}
+	if max.Valid {
+		rs.TargetTempMax = &max.Float64
+	}
+	if (!min.Valid && !max.Valid) || rs.AvgTemperature == nil {
+		return
+	}
+	in := (!min.Valid || *rs.AvgTemperature >= min.Float64) && (!max.Valid || *rs.AvgTemperature <= max.Float64)
+	rs.InTargetRange = &in
+}
+
+// 接続中のセンサーの値から、部屋全体の温度と湿度を計算する。
+// 気温と湿度は、それぞれの値を測定しているセンサーだけで平均する。
+func (rs *RoomStatus) summarizeSensors() {
+	var temp, humidity float64
+	var tempCount, humidityCount int
+	rs.SensorCount = 0
+	for i := range rs.Sensors {
+		if !rs.Sensors[i].IsConnected {
+			continue
 		}
-		switch choice {
-		case Hot:
-			rs.Hot = count
-		case Comfort:
-			rs.Comfort = count
-		case Cold:
-			rs.Cold = count
+		if t := rs.Sensors[i].Temperature; t != nil {
+			temp += *t
+			tempCount++
 		}
+		if h := rs.Sensors[i].Humidity; h != nil {
+			humidity += *h
+			humidityCount++
+		}
+		rs.SensorCount++
 	}
-	return rs, nil
+
+	rs.AvgTemperature = nil
+	rs.AvgHumidity = nil
+	rs.HeatIndex = nil
+	rs.HeatIndexFallback = false
+	if humidityCount > 0 {
+		humidity /= float64(humidityCount)
+		rs.AvgHumidity = &humidity
+	}
+	if tempCount == 0 {
+		return
+	}
+	temp /= float64(tempCount)
+	rs.AvgTemperature = &temp
+	rs.HeatIndex, rs.HeatIndexFallback = heatIndexOf(rs.AvgTemperature, rs.AvgHumidity)
+}
+
+// 気温と湿度から体感温度を計算する。湿度が不明な場合は気温をそのまま使用し、fallbackをtrueにする。
+// 気温が不明な場合はnilを返す。
+func heatIndexOf(temperature, humidity *float64) (hi *float64, fallback bool) {
+	if temperature == nil {
+		return nil, false
+	}
+	if humidity == nil {
+		t := *temperature
+		return &t, true
+	}
+	v, ok := HeatIndex(*temperature, *humidity)
+	return &v, !ok
 }
 
-func (rst *RoomStatusTx) Vote(id RoomID, choice VoteChoice) error {
+func (rst *RoomStatusTx) Vote(ctx context.Context, id RoomID, choice VoteChoice) error {
+	return rst.VoteWithKey(ctx, id, choice, "")
+}
+
+// 再送を識別するキーを指定して投票する。同じセッションから同じ部屋へ、同じキーで
+// 最近投票済みの場合は何もしない。(投票時刻を更新しない)
+// キーはコミット後に記録するため、ロールバックされた投票のキーは再び使用できる。
+// keyが空の場合はVoteと同じ。
+func (rst *RoomStatusTx) VoteWithKey(ctx context.Context, id RoomID, choice VoteChoice, key string) (err error) {
+	ctx, span := rst.startSpan(ctx, "Vote", attrRoomID(id), attrChoice(choice))
+	defer func() { endSpan(span, err) }()
+
 	if rst.s == nil {
-		panic("session must not nil")
+		// Cookieが無効な場合などに、セッションなしでここに到達しうる
+		return ErrNoSession
+	}
+	var ikey idempotencyKey
+	if key != "" {
+		ikey = idempotencyKey{SessionID: rst.s.SessionID, RoomID: id, Key: key}
+		if rst.rsm.idempotency.Seen(ikey, time.Now()) {
+			span.SetAttributes(attribute.Bool("vote.replayed", true))
+			return nil
+		}
+	}
+	// 存在しない部屋への投票は、どこにも表示されないままvoteテーブルに残るため拒否する
+	exists, err := rst.roomExists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
 	}
 
 	vote := Vote{
@@ -185,11 +1277,12 @@ func (rst *RoomStatusTx) Vote(id RoomID, choice VoteChoice) error {
 		S:      rst.s,
 	}
 
-	if err := rst.tx.QueryRow(
-		`SELECT vote_id FROM vote
+	// 投票の間隔の確認のみに使用する。投票の追加と更新はUpdateChoiceで1文で行う。
+	if err := rst.tx.QueryRowContext(ctx,
+		`SELECT vote_id, timestamp FROM vote
 		WHERE session_id=? AND room_id=?`,
 		rst.s.SessionID, id,
-	).Scan(&vote.VoteID); err != nil {
+	).Scan(&vote.VoteID, &vote.Timestamp); err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			// 未投票であることを表す、0を代入
@@ -199,15 +1292,89 @@ func (rst *RoomStatusTx) Vote(id RoomID, choice VoteChoice) error {
 		}
 	}
 
-	return vote.UpdateChoice(rst.tx, choice)
+	if vote.VoteID != VoteID(0) && time.Since(vote.Timestamp) < rst.rsm.config.MinVoteInterval {
+		return ErrVoteTooSoon
+	}
+
+	if err := vote.UpdateChoice(ctx, rst.tx, choice); err != nil {
+		return err
+	}
+	rst.markChanged(id)
+	rst.votes = append(rst.votes, Vote{RoomID: id, Choice: choice})
+	if key != "" {
+		rst.idempotencyKeys = append(rst.idempotencyKeys, ikey)
+	}
+	return nil
+}
+
+// 投票し、同じトランザクションで再集計した部屋の状態と、現在のセッションの投票を返す。
+// 投票の前に部屋の行をロックするため、同じ部屋への同時の投票は直列化され、
+// 各投票者は自分の投票までを含む一貫した集計結果を受け取る。
+//
+// ロックの取得後に他のトランザクションがコミットした投票を集計に含めるため、
+// 分離レベルはREAD COMMITTEDでなければならない。PostgreSQLはデフォルトのままでよいが、
+// MySQLのデフォルト(REPEATABLE READ)ではトランザクション開始後の最初の読み込み時点の
+// スナップショットを集計してしまうため、DSNでtransaction_isolation='READ-COMMITTED'を指定すること。
+// SQLiteは書き込みを行うトランザクションが常に直列化されるため、設定は不要。
+// keyはVoteWithKeyと同じ。同じキーの再送の場合は、投票せずに現在の状態を返す。
+func (rst *RoomStatusTx) VoteAndStatus(ctx context.Context, id RoomID, choice VoteChoice, key string) (_ *RoomStatus, _ *MyVote, err error) {
+	ctx, span := rst.startSpan(ctx, "VoteAndStatus", attrRoomID(id), attrChoice(choice))
+	defer func() { endSpan(span, err) }()
+
+	if err := rst.lockRoom(ctx, id); err != nil {
+		return nil, nil, err
+	}
+	if err := rst.VoteWithKey(ctx, id, choice, key); err != nil {
+		return nil, nil, err
+	}
+	status, err := rst.GetStatus(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	myVote, err := rst.GetMyVote(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return status, myVote, nil
+}
+
+// 部屋の行に書き込みのロックを取得する。ロックはトランザクションの終了まで保持される。
+// SELECT ... FOR UPDATEはSQLiteが対応していないため、値を変えない更新でロックする。
+func (rst *RoomStatusTx) lockRoom(ctx context.Context, id RoomID) error {
+	_, err := rst.tx.ExecContext(ctx, `UPDATE room SET room_id=room_id WHERE room_id=?`, id)
+	return err
+}
+
+// 投票を取り消す。未投票の場合やセッションがない場合は何もしない。
+func (rst *RoomStatusTx) Unvote(ctx context.Context, id RoomID) (err error) {
+	ctx, span := rst.startSpan(ctx, "Unvote", attrRoomID(id))
+	defer func() { endSpan(span, err) }()
+
+	if rst.s == nil {
+		// セッションがnilなので、未投票とみなす
+		return nil
+	}
+
+	res, err := rst.tx.ExecContext(ctx,
+		`DELETE FROM vote WHERE session_id=? AND room_id=?`,
+		rst.s.SessionID, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		rst.markChanged(id)
+	}
+	return nil
 }
 
-func (rst *RoomStatusTx) GetAllRoomsInfo() (names RoomNameMap, groups RoomGroupMap, err error) {
+// DBからすべての部屋の名前と、建物・階毎の部屋の一覧を読み込む。
+func (rst *RoomStatusTx) loadAllRoomsInfo(ctx context.Context) (names RoomNameMap, groups RoomGroupMap, err error) {
 	// NOTE: roomテーブルの行数は少ないことを想定しているため、テーブルスキャンをしている。
 	{
 		names = make(RoomNameMap)
-		var rows *sql.Rows
-		rows, err = rst.tx.Query(`
+		var rows *dbRows
+		rows, err = rst.tx.QueryContext(ctx, `
 			SELECT room_id, name FROM room
 		`)
 		if err != nil {
@@ -226,11 +1393,14 @@ func (rst *RoomStatusTx) GetAllRoomsInfo() (names RoomNameMap, groups RoomGroupM
 
 	{
 		groups = make(RoomGroupMap)
-		var rows *sql.Rows
-		rows, err = rst.tx.Query(`
+		var rows *dbRows
+		rows, err = rst.tx.QueryContext(ctx, `
 			SELECT building_name, floor, room_id FROM room
 			GROUP BY building_name, floor, room_id
 		`)
+		if err != nil {
+			return
+		}
 		defer rows.Close()
 		for rows.Next() {
 			var bname BuildingName
@@ -252,83 +1422,381 @@ func (rst *RoomStatusTx) GetAllRoomsInfo() (names RoomNameMap, groups RoomGroupM
 	return
 }
 
-func (rsm *RoomStatusManager) getSensorStatusFromCache(id RoomID) ([]SensorStatus, bool) {
+// キャッシュから部屋のセンサーの状態を取得する。
+// センサーがMaxSensorsPerRoomを超えて省略された場合はtruncatedがtrue、センサーが1つもない場合はokがfalseになる。
+func (rsm *RoomStatusManager) getSensorStatusFromCache(id RoomID) (sensors []SensorStatus, truncated bool, ok bool) {
 	rsm.cacheLock.RLock()
 	defer rsm.cacheLock.RUnlock()
 
+	now := time.Now()
 	cache, ok := rsm.sensorCache[id]
+	observeCacheLookup(rsm.buildings[id], ok)
 	if ok {
 		array := make([]SensorStatus, 0, len(cache))
 		for i := range cache {
-			if cache[i].expire.After(time.Now()) {
-				array = append(array, cache[i])
+			stat := cache[i]
+			stat.ThingName = i
+			stat.Label = rsm.labels[sensorKey{id, i}]
+			stat.AgeSeconds = now.Unix() - stat.LastUpdated
+			if stat.AgeSeconds < 0 {
+				// センサーの時計が進んでいる場合
+				stat.AgeSeconds = 0
+			}
+			switch {
+			case stat.expire.After(now):
+				array = append(array, stat)
+			case stat.staleUntil.After(now):
+				// 更新できなくなったセンサーは、最後の値を未接続として返す
+				stat.IsConnected = false
+				stat.Stale = true
+				array = append(array, stat)
+			}
+		}
+		if max := rsm.config.MaxSensorsPerRoom; max > 0 && len(array) > max {
+			// 最終更新時刻が新しいセンサーを残す。同時刻の場合も結果が変わらないようにThing名で並べる。
+			sort.Slice(array, func(i, j int) bool {
+				if array[i].LastUpdated != array[j].LastUpdated {
+					return array[i].LastUpdated > array[j].LastUpdated
+				}
+				return array[i].ThingName < array[j].ThingName
+			})
+			array = array[:max]
+			truncated = true
+		}
+		// mapの順序は一定でないため、表示がリクエスト毎に入れ替わらないようにThing名の順に並べる
+		sort.Slice(array, func(i, j int) bool { return array[i].ThingName < array[j].ThingName })
+		return array, truncated, len(array) > 0
+	}
+	return []SensorStatus{}, false, false
+}
+
+// キャッシュの有効期限を返す。
+func (stat SensorStatus) Expire() time.Time {
+	return stat.expire
+}
+
+// 接続が切れた後も最後の値を表示し続ける期限を返す。
+func (stat SensorStatus) StaleUntil() time.Time {
+	return stat.staleUntil
+}
+
+// 診断用に、センサーの状態のキャッシュのコピーを返す。
+// 有効期限切れのエントリーも含まれる。
+func (rsm *RoomStatusManager) CacheSnapshot() map[RoomID]map[ThingName]SensorStatus {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+
+	snapshot := make(map[RoomID]map[ThingName]SensorStatus, len(rsm.sensorCache))
+	for id, cache := range rsm.sensorCache {
+		snapshot[id] = make(map[ThingName]SensorStatus, len(cache))
+		for name, stat := range cache {
+			snapshot[id][name] = stat
+		}
+	}
+	return snapshot
+}
+
+// センサーの状態を持つすべての部屋について、状態が変化したことを通知する。
+func (rsm *RoomStatusManager) publishSensorUpdates() {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+	for id := range rsm.sensorCache {
+		rsm.events.Publish(id)
+	}
+}
+
+// 保持期間を過ぎたセンサーの状態をキャッシュから削除する。
+func (rsm *RoomStatusManager) pruneSensorCache() {
+	rsm.cacheLock.Lock()
+	defer rsm.cacheLock.Unlock()
+
+	now := time.Now()
+	for id, cache := range rsm.sensorCache {
+		for name := range cache {
+			if !cache[name].expire.After(now) && !cache[name].staleUntil.After(now) {
+				delete(cache, name)
 			}
 		}
-		return array, len(array) > 0
+		if len(cache) == 0 {
+			delete(rsm.sensorCache, id)
+		}
 	}
-	return []SensorStatus{}, false
 }
 
 // すべてのセンサーの状態をキャッシュする
-func (rsm *RoomStatusManager) cacheUpdater(ctx context.Context) {
-	log.Println("starting cacheUpdater")
+// warmedがtrueの場合は、キャッシュが取得済みであるため最初の更新を省略する。
+func (rsm *RoomStatusManager) cacheUpdater(ctx context.Context, warmed bool) {
+	rsm.config.Logger.Debug("starting cacheUpdater")
+
+	for first := true; ; first = false {
+		start := time.Now()
+		if !(first && warmed) {
+			rsm.config.Logger.Debug("update all sensor statuses")
+			for _, err := range rsm.updateAllSensorStatuses(ctx) {
+				rsm.config.Logger.Error("failed to update sensor status", "error", err)
+			}
+			rsm.publishSensorUpdates()
+			rsm.updateSensorMetrics()
+		}
+
+		if rsm.config.RecordHistory {
+			if err := rsm.recordSensorReadings(ctx); err != nil {
+				rsm.config.Logger.Error("failed to record sensor readings", "error", err)
+			}
+		}
+
+		rsm.pruneSensorCache()
+
+		if err := rsm.refreshRoomInfo(ctx); err != nil {
+			rsm.config.Logger.Error("failed to refresh room info", "error", err)
+		}
+
+		if rsm.config.SensorWebhookURL != "" {
+			rsm.notifyConnectionChanges(ctx)
+		}
+
+		if rsm.config.AlertWebhookURL != "" {
+			if err := rsm.evaluateAlerts(ctx); err != nil {
+				rsm.config.Logger.Error("failed to evaluate comfort alerts", "error", err)
+			}
+		}
+
+		rsm.config.Logger.Debug("clean up expired sessions")
+		if err := rsm.cleanUpExpiredSessions(ctx); err != nil {
+			rsm.config.Logger.Error("failed to clean up expired sessions", "error", err)
+		}
 
-	tick := time.NewTicker(INTERVAL)
-	for {
-		log.Println("update all sensor statuses")
-		for _, err := range rsm.updateAllSensorStatuses() {
-			log.Println(err)
+		rsm.config.Logger.Debug("clean up old vote events")
+		if err := rsm.cleanUpOldVoteEvents(ctx); err != nil {
+			rsm.config.Logger.Error("failed to clean up old vote events", "error", err)
 		}
 
-		log.Println("clean up expired sessions")
-		if err := rsm.cleanUpExpiredSessions(); err != nil {
-			log.Println(err)
+		if rsm.config.RecordHistory {
+			rsm.config.Logger.Debug("clean up old sensor readings")
+			if err := rsm.cleanUpOldSensorReadings(ctx); err != nil {
+				rsm.config.Logger.Error("failed to clean up old sensor readings", "error", err)
+			}
 		}
 
+		elapsed := time.Since(start)
+		if elapsed > rsm.config.RefreshInterval {
+			rsm.config.Logger.Warn("refresh cycle took longer than the refresh interval",
+				"elapsed", elapsed, "interval", rsm.config.RefreshInterval)
+		}
+		// 更新処理が長引いても次の更新処理が間を空けずに始まらないように、Tickerではなく毎回待ち時間を計算する
+		wait := time.NewTimer(rsm.nextRefreshDelay(elapsed))
 		select {
 		case <-ctx.Done():
+			wait.Stop()
+			rsm.config.Logger.Debug("stopping cacheUpdater")
 			return
-		case <-tick.C:
+		case <-wait.C:
+		}
+	}
+}
+
+// elapsedだけ掛かった更新処理の後、次の更新処理を開始するまでの待ち時間を返す。
+// 更新処理の開始間隔がRefreshIntervalになるように待つが、MinRefreshGapより短くはしない。
+func (rsm *RoomStatusManager) nextRefreshDelay(elapsed time.Duration) time.Duration {
+	delay := rsm.config.RefreshInterval - elapsed
+	if delay < rsm.config.MinRefreshGap {
+		delay = rsm.config.MinRefreshGap
+	}
+	return delay
+}
+
+// センサーの表示名を更新する。空の表示名は削除する。
+func (rsm *RoomStatusManager) setLabels(labels map[sensorKey]string) {
+	rsm.cacheLock.Lock()
+	defer rsm.cacheLock.Unlock()
+	if rsm.labels == nil {
+		rsm.labels = make(map[sensorKey]string)
+	}
+	if rsm.labelChanged == nil {
+		rsm.labelChanged = make(map[sensorKey]uint64)
+	}
+	rsm.labelGen++
+	for key, label := range labels {
+		rsm.labelChanged[key] = rsm.labelGen
+		if label == "" {
+			delete(rsm.labels, key)
+		} else {
+			rsm.labels[key] = label
+		}
+	}
+}
+
+// 表示名の世代を返す。DBから表示名を読み込む前に取得し、replaceLabelsに渡す。
+func (rsm *RoomStatusManager) labelGeneration() uint64 {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+	return rsm.labelGen
+}
+
+// DBから読み込んだ表示名で、キャッシュの表示名を置き換える。
+// 読み込みを開始した後(世代がgenより後)にsetLabelsで変更された表示名は、読み込んだ値が古い可能性があるため現在の値を残す。
+func (rsm *RoomStatusManager) replaceLabels(labels map[sensorKey]string, gen uint64) {
+	rsm.cacheLock.Lock()
+	defer rsm.cacheLock.Unlock()
+	for key, changed := range rsm.labelChanged {
+		if changed <= gen {
+			continue
+		}
+		if label, ok := rsm.labels[key]; ok {
+			labels[key] = label
+		} else {
+			delete(labels, key)
+		}
+	}
+	rsm.labels = labels
+}
+
+// 部屋が属する建物の一覧を読み込む。
+func (rsm *RoomStatusManager) loadBuildings(ctx context.Context, tx *dbTx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT room_id, building_name FROM room`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	buildings := map[RoomID]BuildingName{}
+	for rows.Next() {
+		var id RoomID
+		var b BuildingName
+		if err := rows.Scan(&id, (*string)(&b)); err != nil {
+			return err
 		}
+		buildings[id] = b
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+
+	rsm.cacheLock.Lock()
+	rsm.buildings = buildings
+	rsm.cacheLock.Unlock()
+	return nil
 }
 
-func (rsm *RoomStatusManager) updateAllSensorStatuses() []error {
+// すべてのセンサーの状態を取得し、キャッシュに反映する。
+// Thingの一覧を読み込めて、1台以上のセンサーの状態を取得できた(またはThingが1つもない)場合は、
+// 一部のセンサーの取得に失敗していても成功とみなし、LastRefreshを更新する。
+func (rsm *RoomStatusManager) updateAllSensorStatuses(ctx context.Context) []error {
+	defer func(start time.Time) {
+		sensorUpdateDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	errCh := make(chan error)
 	var wg sync.WaitGroup
+	// loadedとthingCountはwg.Waitの後に読み出す
+	var loaded bool
+	var thingCount int
+	var updated int32
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		tx, err := rsm.db.Begin()
+		// トランザクションの開始前に取得し、この後にコミットされた表示名の変更を上書きしないようにする
+		labelGen := rsm.labelGeneration()
+		tx, err := rsm.begin(ctx)
 		if err != nil {
 			errCh <- err
 			return
 		}
 		defer tx.Rollback()
 
-		rows, err := tx.Query(
-			`SELECT room_id, thing_name FROM thing`,
-		)
+		if err := rsm.loadBuildings(ctx, tx); err != nil {
+			errCh <- err
+		}
+
+		query := `SELECT room_id, thing_name, label FROM thing`
+		scope, scopeArgs := rsm.buildingScope("room.building_name")
+		if scope != "" {
+			// 担当する建物の部屋に取り付けられたThingのみ更新する
+			query = `SELECT thing.room_id, thing.thing_name, thing.label FROM thing
+				INNER JOIN room ON room.room_id=thing.room_id
+				WHERE 1=1` + scope
+		}
+		rows, err := tx.QueryContext(ctx, query, scopeArgs...)
 		if err != nil {
 			errCh <- err
 			return
 		}
+		defer rows.Close()
 
+		things := map[ThingName][]RoomID{}
+		names := []ThingName{}
+		labels := map[sensorKey]string{}
 		for rows.Next() {
 			var id RoomID
 			var name ThingName
-			rows.Scan(&id, (*string)(&name))
-
-			// start async update
-			wg.Add(1)
-			go func(id RoomID, name ThingName) {
-				defer wg.Done()
-				if err := rsm.updateSensorStatus(id, name); err != nil {
-					errCh <- err
-					return
+			var label sql.NullString
+			if err := rows.Scan(&id, (*string)(&name), &label); err != nil {
+				errCh <- err
+				continue
+			}
+			if label.String != "" {
+				labels[sensorKey{id, name}] = label.String
+			}
+			if _, ok := things[name]; !ok {
+				names = append(names, name)
+			}
+			things[name] = append(things[name], id)
+		}
+		if err := rows.Err(); err != nil {
+			errCh <- err
+			return
+		}
+		rsm.replaceLabels(labels, labelGen)
+		loaded = true
+		thingCount = len(names)
+
+		if batch, ok := rsm.thingworx.(batchPropertyReader); ok && batch.useBatch(len(names)) {
+			// Thingの数が多い場合は、ThingWorxへのリクエスト数を減らすために一括で取得する
+			reqCtx, cancel := context.WithTimeout(ctx, rsm.readDeadline())
+			defer cancel()
+			props, err := batch.PropertiesBatch(reqCtx, names)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			for _, name := range names {
+				prop, ok := props[name]
+				if !ok {
+					rsm.config.Logger.Warn("thing has no data", "thing_name", name)
+					continue
 				}
-			}(id, name)
+				for _, id := range things[name] {
+					if err := rsm.applySensorStatus(id, name, prop); err != nil {
+						errCh <- err
+						continue
+					}
+					atomic.AddInt32(&updated, 1)
+				}
+			}
+			return
+		}
+
+		// 同時に送信するリクエスト数を制限する
+		sem := make(chan struct{}, rsm.config.MaxConcurrentUpdates)
+		for _, name := range names {
+			for _, id := range things[name] {
+				// start async update
+				wg.Add(1)
+				go func(id RoomID, name ThingName) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+					// 1台のセンサーの応答待ちで更新処理全体が止まらないように、リクエスト毎に期限を設ける
+					reqCtx, cancel := context.WithTimeout(ctx, rsm.readDeadline())
+					defer cancel()
+					if err := rsm.updateSensorStatus(reqCtx, id, name); err != nil {
+						errCh <- err
+						return
+					}
+					atomic.AddInt32(&updated, 1)
+				}(id, name)
+			}
 		}
 	}()
 
@@ -341,38 +1809,122 @@ func (rsm *RoomStatusManager) updateAllSensorStatuses() []error {
 	for err := range errCh {
 		errs = append(errs, err)
 	}
+	if loaded && (thingCount == 0 || atomic.LoadInt32(&updated) > 0) {
+		rsm.cacheLock.Lock()
+		rsm.lastRefresh = time.Now()
+		rsm.cacheLock.Unlock()
+	}
 	return errs
 }
 
-// センサーで測定した部屋の状態を、DBに反映する。
-func (rsm *RoomStatusManager) updateSensorStatus(id RoomID, thingName ThingName) error {
-	var stat SensorStatus
+// 最後に成功した、すべてのセンサーの状態の更新が完了した時刻を返す。一度も成功していない場合はゼロ値を返す。
+// ThingWorxの障害などで更新が止まっていることを、クライアントが判断するために使用する。
+func (rsm *RoomStatusManager) LastRefresh() time.Time {
+	rsm.cacheLock.RLock()
+	defer rsm.cacheLock.RUnlock()
+	return rsm.lastRefresh
+}
+
+// センサーの値を読み出すプロパティ名を返す。PropertyReaderが指定しない場合はDefaultPropertyMapping。
+func (rsm *RoomStatusManager) propertyMapping() PropertyMapping {
+	if m, ok := rsm.thingworx.(interface{ mapping() PropertyMapping }); ok {
+		return m.mapping()
+	}
+	return DefaultPropertyMapping
+}
+
+// 1回のプロパティの読み出しに掛けられる最大の時間を返す。
+// PropertyReaderが指定しない場合はDefaultThingWorxTimeout。
+func (rsm *RoomStatusManager) readDeadline() time.Duration {
+	if d, ok := rsm.thingworx.(interface{ deadline() time.Duration }); ok {
+		return d.deadline()
+	}
+	return DefaultThingWorxTimeout
+}
 
-	prop, err := rsm.thingworx.Properties(thingName)
+// センサーで測定した部屋の状態を、DBに反映する。
+func (rsm *RoomStatusManager) updateSensorStatus(ctx context.Context, id RoomID, thingName ThingName) error {
+	prop, err := rsm.thingworx.Properties(ctx, thingName)
+	if errors.Is(err, ErrNoThingData) {
+		rsm.config.Logger.WarnContext(ctx, "thing has no data", "thing_name", thingName, "room_id", id)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	stat.Temperature, err = prop.M("temperature").Float64()
+	return rsm.applySensorStatus(id, thingName, prop)
+}
+
+// ThingWorxから取得したプロパティを、センサーの状態としてキャッシュに反映する。
+func (rsm *RoomStatusManager) applySensorStatus(id RoomID, thingName ThingName, prop dproxy.Proxy) error {
+	var stat SensorStatus
+	var err error
+	mapping := rsm.propertyMapping()
+
+	// 気温と湿度は、片方しか測定しないセンサーもあるため、それぞれ省略できる
+	stat.Temperature, err = optionalPropertyFloat64(prop, mapping.Temperature)
 	if err != nil {
-		return err
+		return fmt.Errorf("thing %q: %w", string(thingName), err)
 	}
-	stat.Humidity, err = prop.M("humidity").Float64()
+	stat.Humidity, err = optionalPropertyFloat64(prop, mapping.Humidity)
 	if err != nil {
-		return err
+		return fmt.Errorf("thing %q: %w", string(thingName), err)
 	}
-	stat.lastUpdated, err = prop.M("lastUpdated").Int64()
+	stat.LastUpdated, err = propertyInt64(prop, mapping.LastUpdated)
 	if err != nil {
-		return err
+		return fmt.Errorf("thing %q: %w", string(thingName), err)
+	}
+	if (stat.Temperature != nil && !rsm.config.TemperatureRange.Contains(*stat.Temperature)) ||
+		(stat.Humidity != nil && !rsm.config.HumidityRange.Contains(*stat.Humidity)) {
+		// ファームウェアの不具合などによる異常値は、平均値を歪めるため反映せず、前回の値を使い続ける
+		rsm.config.Logger.Warn("sensor reading is out of range",
+			"thing_name", thingName,
+			"room_id", id,
+			"temperature", optionalValue(stat.Temperature),
+			"humidity", optionalValue(stat.Humidity),
+		)
+		return nil
+	}
+	// 省略可能なプロパティは、取得できなくてもセンサーの状態の更新を続ける
+	if co2, err := propertyFloat64(prop, mapping.CO2); err == nil {
+		stat.CO2 = &co2
+	}
+	if occupancy, err := propertyInt64(prop, mapping.Occupancy); err == nil && occupancy >= math.MinInt32 && occupancy <= math.MaxInt32 {
+		n := int(occupancy)
+		stat.Occupancy = &n
 	}
 	// ミリ秒単位から秒単位に変換
-	stat.lastUpdated /= 1000
-	// 最終更新時刻が現在時刻から60秒以内なら、接続されているとみなす
-	stat.IsConnected = math.Abs(float64(time.Now().Unix()-stat.lastUpdated)) <= 60
-	stat.expire = time.Now().Add(CACHE_EXPIRE)
+	stat.LastUpdated /= 1000
+	// 最終更新時刻が現在時刻からConnectedThreshold以内なら、接続されているとみなす
+	stat.IsConnected = math.Abs(float64(time.Now().Unix()-stat.LastUpdated)) <= rsm.config.ConnectedThreshold.Seconds()
+	stat.expire = time.Now().Add(rsm.config.CacheExpire)
+	stat.staleUntil = time.Unix(stat.LastUpdated, 0).Add(rsm.config.StaleRetention)
+	rsm.observeConnection(id, thingName, stat.IsConnected, stat.LastUpdated)
 
 	if !stat.IsConnected {
-		log.Printf("WARN: \"%s\" is not connected. now=%d, lastUpdated=%d", thingName, time.Now().Unix(), stat.lastUpdated)
-		return nil
+		rsm.config.Logger.Warn("sensor is not connected",
+			"thing_name", thingName,
+			"room_id", id,
+			"now", time.Now().Unix(),
+			"last_updated", stat.LastUpdated,
+			"threshold", rsm.config.ConnectedThreshold,
+		)
+		if !stat.staleUntil.After(time.Now()) {
+			// 保持期間を過ぎた古い値は表示しない
+			return nil
+		}
+	}
+
+	stat.rawTemperature = stat.Temperature
+	if rsm.config.TemperatureSmoothing > 0 {
+		stat.Temperature = rsm.smoothTemperature(id, thingName, stat)
+	}
+	// 体感温度と露点温度は、表示する気温と揃えるために平滑化した後の気温から計算する
+	stat.HeatIndex, stat.HeatIndexFallback = heatIndexOf(stat.Temperature, stat.Humidity)
+	if stat.Temperature != nil && stat.Humidity != nil {
+		if dp, ok := DewPoint(*stat.Temperature, *stat.Humidity); ok {
+			stat.DewPoint = &dp
+		}
 	}
 
 	rsm.cacheLock.Lock()
@@ -384,13 +1936,13 @@ func (rsm *RoomStatusManager) updateSensorStatus(id RoomID, thingName ThingName)
 	return nil
 }
 
-func (rsm *RoomStatusManager) cleanUpExpiredSessions() error {
-	tx, err := rsm.db.Begin()
+func (rsm *RoomStatusManager) cleanUpExpiredSessions(ctx context.Context) error {
+	tx, err := rsm.begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	if _, err := tx.Exec(
+	if _, err := tx.ExecContext(ctx,
 		`DELETE FROM session WHERE expire<?`,
 		time.Now(),
 	); err != nil {
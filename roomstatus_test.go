@@ -0,0 +1,1623 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	dproxy "github.com/koron/go-dproxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// テスト用のインメモリDBを使用したRoomStatusManagerを作成する。
+// cacheUpdaterは起動しないため、必要に応じてテスト内で更新処理を呼び出すこと。
+func newTestRoomStatusManager(t testing.TB, thingworx PropertyReader) *RoomStatusManager {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// インメモリDBはコネクション毎に別のDBになるため、コネクションを1つに制限する
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := ioutil.ReadFile("db.sqlite3.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rsm := &RoomStatusManager{
+		db:            db,
+		thingworx:     thingworx,
+		config:        RSMConfig{Dialect: DialectSQLite}.withDefaults(),
+		sensorCache:   make(map[RoomID]map[ThingName]SensorStatus),
+		events:        newRoomEventHub(),
+		lastRecorded:  make(map[sensorKey]int64),
+		alertStates:   make(map[RoomID]*roomAlertState),
+		connStates:    make(map[sensorKey]*connState),
+		roomRefreshes: make(map[RoomID]time.Time),
+		ctx:           ctx,
+	}
+	// DBを閉じる前に、goBackgroundで開始した処理を停止する
+	t.Cleanup(func() {
+		cancel()
+		rsm.wg.Wait()
+	})
+	return rsm
+}
+
+func TestUpdateAllSensorStatusesInvalidJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"rows":[{"temperature":`))
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{URL: ts.URL})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'broken');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := rsm.updateAllSensorStatuses(context.Background())
+	if len(errs) != 1 {
+		t.Fatalf("should return 1 error, but returned %d errors: %v", len(errs), errs)
+	}
+	if !strings.Contains(errs[0].Error(), `"broken"`) {
+		t.Errorf("error should contain the thing name, but result is %q", errs[0].Error())
+	}
+	if _, _, ok := rsm.getSensorStatusFromCache(1); ok {
+		t.Error("should not cache the status of a broken thing")
+	}
+}
+
+func TestApplySensorStatusPropertyMapping(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{
+		Mapping: PropertyMapping{
+			Temperature: "temp_c",
+			Humidity:    "rh",
+			LastUpdated: "ts",
+		},
+	})
+
+	prop := dproxy.New(map[string]interface{}{
+		"temp_c": 21.5,
+		"rh":     40.0,
+		"ts":     float64(time.Now().Unix() * 1000),
+	})
+	if err := rsm.applySensorStatus(1, "thing", prop); err != nil {
+		t.Fatal(err)
+	}
+	stats, _, ok := rsm.getSensorStatusFromCache(1)
+	if !ok || len(stats) != 1 {
+		t.Fatalf("should cache 1 sensor status, but result is %v", stats)
+	}
+	if optionalValue(stats[0].Temperature) != 21.5 || optionalValue(stats[0].Humidity) != 40.0 {
+		t.Errorf("should read mapped properties, but result is %+v", stats[0])
+	}
+}
+
+func TestRoomStatusSummarizeSensors(t *testing.T) {
+	rs := &RoomStatus{
+		Sensors: []SensorStatus{
+			{Temperature: float64Ptr(20.0), Humidity: float64Ptr(40.0), IsConnected: true},
+			{Temperature: float64Ptr(24.0), Humidity: float64Ptr(60.0), IsConnected: true},
+			{Temperature: float64Ptr(99.0), Humidity: float64Ptr(99.0), IsConnected: false},
+		},
+	}
+	rs.summarizeSensors()
+	if rs.SensorCount != 2 {
+		t.Errorf("should count 2 connected sensors, but result is %d", rs.SensorCount)
+	}
+	if rs.AvgTemperature == nil || *rs.AvgTemperature != 22.0 {
+		t.Errorf("should average temperature to 22.0, but result is %v", rs.AvgTemperature)
+	}
+	if rs.AvgHumidity == nil || *rs.AvgHumidity != 50.0 {
+		t.Errorf("should average humidity to 50.0, but result is %v", rs.AvgHumidity)
+	}
+
+	// 気温のみ・湿度のみのセンサーは、それぞれの値がある平均にだけ含める
+	rs = &RoomStatus{
+		Sensors: []SensorStatus{
+			{Temperature: float64Ptr(20.0), IsConnected: true},
+			{Humidity: float64Ptr(60.0), IsConnected: true},
+			{Temperature: float64Ptr(24.0), Humidity: float64Ptr(40.0), IsConnected: true},
+		},
+	}
+	rs.summarizeSensors()
+	if rs.SensorCount != 3 {
+		t.Errorf("should count 3 connected sensors, but result is %d", rs.SensorCount)
+	}
+	if rs.AvgTemperature == nil || *rs.AvgTemperature != 22.0 {
+		t.Errorf("should average temperature to 22.0, but result is %v", rs.AvgTemperature)
+	}
+	if rs.AvgHumidity == nil || *rs.AvgHumidity != 50.0 {
+		t.Errorf("should average humidity to 50.0, but result is %v", rs.AvgHumidity)
+	}
+
+	rs = &RoomStatus{Sensors: []SensorStatus{}}
+	rs.summarizeSensors()
+	js, err := json.Marshal(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "avgTemperature") || strings.Contains(string(js), "avgHumidity") {
+		t.Errorf("should omit averages without connected sensors, but result is %s", js)
+	}
+}
+
+func TestSensorStatusStaleReading(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+
+	// 5分前に最後の値を送信したセンサー
+	prop := dproxy.New(map[string]interface{}{
+		"temperature": 22.5,
+		"humidity":    45.0,
+		"lastUpdated": float64(time.Now().Add(-5*time.Minute).Unix() * 1000),
+	})
+	if err := rsm.applySensorStatus(1, "thing", prop); err != nil {
+		t.Fatal(err)
+	}
+	stats, _, ok := rsm.getSensorStatusFromCache(1)
+	if !ok || len(stats) != 1 {
+		t.Fatalf("should keep the last reading of a disconnected sensor, but result is %v", stats)
+	}
+	if stats[0].IsConnected || optionalValue(stats[0].Temperature) != 22.5 {
+		t.Errorf("should return the last reading as disconnected, but result is %+v", stats[0])
+	}
+
+	// 保持期間を過ぎたセンサー
+	prop = dproxy.New(map[string]interface{}{
+		"temperature": 22.5,
+		"humidity":    45.0,
+		"lastUpdated": float64(time.Now().Add(-STALE_RETENTION-time.Minute).Unix() * 1000),
+	})
+	if err := rsm.applySensorStatus(2, "thing", prop); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _, ok := rsm.getSensorStatusFromCache(2); ok {
+		t.Errorf("should not return a reading older than the retention, but result is %v", stats)
+	}
+}
+
+func TestSensorStatusConnectedThreshold(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.ConnectedThreshold = 120 * time.Second
+
+	prop := dproxy.New(map[string]interface{}{
+		"temperature": 22.5,
+		"humidity":    45.0,
+		"lastUpdated": float64(time.Now().Add(-90*time.Second).Unix() * 1000),
+	})
+	if err := rsm.applySensorStatus(1, "thing", prop); err != nil {
+		t.Fatal(err)
+	}
+	stats, _, ok := rsm.getSensorStatusFromCache(1)
+	if !ok || len(stats) != 1 || !stats[0].IsConnected {
+		t.Errorf("should consider a reading 90s old as connected, but result is %+v", stats)
+	}
+}
+
+func TestMaxSensorsPerRoom(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.MaxSensorsPerRoom = 2
+
+	// thing1が最も古く、thing3が最も新しい
+	for i, name := range []ThingName{"thing1", "thing2", "thing3"} {
+		prop := dproxy.New(map[string]interface{}{
+			"temperature": 22.5,
+			"humidity":    45.0,
+			"lastUpdated": float64(time.Now().Add(time.Duration(i-3)*time.Second).Unix() * 1000),
+		})
+		if err := rsm.applySensorStatus(1, name, prop); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs := rsm.newRoomStatus(1)
+	if !rs.SensorsTruncated || len(rs.Sensors) != 2 || rs.Sensors[0].ThingName != "thing2" || rs.Sensors[1].ThingName != "thing3" {
+		t.Errorf("should return the 2 freshest sensors, but result is %+v", rs.Sensors)
+	}
+	js, err := json.Marshal(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(js), `"sensorsTruncated":true`) {
+		t.Errorf("should include the truncation flag, but result is %s", js)
+	}
+
+	rsm.config.MaxSensorsPerRoom = 3
+	if rs := rsm.newRoomStatus(1); rs.SensorsTruncated || len(rs.Sensors) != 3 {
+		t.Errorf("should return all sensors within the limit, but result is %+v", rs.Sensors)
+	}
+}
+
+func TestUpdateAllSensorStatusesConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"rows":[{"temperature":20.0,"humidity":40.0,"lastUpdated":0}]}`))
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{URL: ts.URL})
+	rsm.config.MaxConcurrentUpdates = 2
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := rsm.db.Exec(`INSERT INTO thing (room_id, thing_name) VALUES (1, ?)`, fmt.Sprintf("thing%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if errs := rsm.updateAllSensorStatuses(context.Background()); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("should send at most 2 requests at once, but sent %d", maxInFlight)
+	}
+}
+
+func TestUpdateAllSensorStatusesScanError(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Write([]byte(`{"rows":[{"temperature":20.0,"humidity":40.0,"lastUpdated":0}]}`))
+	}))
+	defer ts.Close()
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{URL: ts.URL})
+	// NOT NULL制約のないthingテーブルに置き換えて、NULLのthing_nameを登録する
+	if _, err := rsm.db.Exec(`
+		DROP TABLE thing;
+		CREATE TABLE thing (
+			thing_id   INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id    INTEGER NOT NULL,
+			thing_name CHAR(32),
+			label      TEXT
+		);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, NULL), (1, 'thing');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := rsm.updateAllSensorStatuses(context.Background())
+	if len(errs) != 1 {
+		t.Errorf("should return 1 scan error, but returned %d errors: %v", len(errs), errs)
+	}
+	if count != 1 {
+		t.Errorf("should update only the valid thing, but sent %d requests", count)
+	}
+}
+
+func TestRoomStatusManagerClose(t *testing.T) {
+	started := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+
+	base := newTestRoomStatusManager(t, nil)
+	if _, err := base.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'thing');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	rsm := NewRoomStatusManager(base.db, &ThingWorxClient{URL: ts.URL}, RSMConfig{}, context.Background())
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		rsm.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close should cancel the in-flight refresh cycle and return")
+	}
+}
+
+func TestCloseWaitsForBackgroundTasks(t *testing.T) {
+	base := newTestRoomStatusManager(t, nil)
+	rsm := NewRoomStatusManager(base.db, &ThingWorxClient{}, RSMConfig{}, context.Background())
+
+	var finished int32
+	rsm.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		atomic.StoreInt32(&finished, 1)
+	})
+	rsm.Close()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("Close should cancel and wait for background tasks")
+	}
+
+	rsm.goBackground(func(ctx context.Context) {
+		t.Error("should not start a background task after Close")
+	})
+}
+
+func TestNewRoomStatusManagerWarmCache(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"rows":[{"temperature":20.0,"humidity":40.0,"lastUpdated":` +
+			fmt.Sprint(time.Now().Unix()*1000) + `}]}`))
+	}))
+	defer ts.Close()
+
+	base := newTestRoomStatusManager(t, nil)
+	if _, err := base.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'thing');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	rsm := NewRoomStatusManager(base.db, &ThingWorxClient{URL: ts.URL}, RSMConfig{WarmCache: true}, context.Background())
+	defer rsm.Close()
+	if _, _, ok := rsm.getSensorStatusFromCache(1); !ok {
+		t.Error("should populate the cache before returning")
+	}
+}
+
+func TestCacheSnapshotIsCopy(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"thing": {Temperature: float64Ptr(20.0)},
+	}
+
+	snapshot := rsm.CacheSnapshot()
+	snapshot[1]["thing"] = SensorStatus{Temperature: float64Ptr(30.0)}
+	delete(snapshot, 1)
+
+	if optionalValue(rsm.sensorCache[1]["thing"].Temperature) != 20.0 {
+		t.Error("modifying the snapshot should not affect the cache")
+	}
+}
+
+func TestRoundPercentages(t *testing.T) {
+	tests := []struct {
+		counts   []uint64
+		expected []float64
+	}{
+		{[]uint64{0, 0, 0}, []float64{0, 0, 0}},
+		{[]uint64{1, 1, 1}, []float64{34, 33, 33}},
+		{[]uint64{1, 2, 0}, []float64{33, 67, 0}},
+		{[]uint64{5, 0, 0}, []float64{100, 0, 0}},
+		{[]uint64{1, 1, 4}, []float64{17, 17, 66}},
+	}
+	for _, test := range tests {
+		result := roundPercentages(test.counts)
+		var sum float64
+		for i := range result {
+			sum += result[i]
+			if result[i] != test.expected[i] {
+				t.Errorf("roundPercentages(%v) should be %v, but result is %v", test.counts, test.expected, result)
+				break
+			}
+		}
+		if sum != 0 && sum != 100 {
+			t.Errorf("roundPercentages(%v) should add up to 100, but result is %v", test.counts, sum)
+		}
+	}
+}
+
+// テスト用のセッションを作成し、そのセッションを使用するRoomStatusTxを返す。
+func newTestRoomStatusTx(t *testing.T, rsm *RoomStatusManager) *RoomStatusTx {
+	t.Helper()
+
+	tx, err := rsm.begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+
+	sid, err := tx.InsertID(context.Background(), "session_id",
+		`INSERT INTO session (secret_sha256, expire) VALUES ('', ?)`,
+		time.Now().Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RoomStatusTx{
+		rsm: rsm,
+		tx:  tx,
+		s: &Session{
+			SessionID: uint64(sid),
+			tx:        tx,
+			ttl:       rsm.config.SessionTTL,
+		},
+	}
+}
+
+func TestUnvote(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+
+	// 未投票の場合は何もしない
+	if err := rst.Unvote(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Unvote(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	vote, err := rst.GetMyVote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote != nil {
+		t.Errorf("should return nil after unvote, but result is %+v", vote)
+	}
+
+	// セッションがない場合も何もしない
+	rst.s = nil
+	if err := rst.Unvote(context.Background(), 1); err != nil {
+		t.Errorf("should ignore nil session, but got error: %s", err)
+	}
+}
+
+func TestVoteTTL(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.VoteTTL = 30 * time.Minute
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	if _, err := rst.tx.Exec(
+		`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, 1, 'hot', ?)`,
+		rst.s.SessionID, time.Now().Add(-time.Hour),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Hot != 0 {
+		t.Errorf("should not count a vote older than VoteTTL, but result is %d", status.Hot)
+	}
+	vote, err := rst.GetMyVote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote != nil {
+		t.Errorf("should treat an expired vote as not voted, but result is %+v", vote)
+	}
+
+	if err := rst.Vote(context.Background(), 1, Cold); err != nil {
+		t.Fatal(err)
+	}
+	status, err = rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Cold != 1 {
+		t.Errorf("should count a re-vote, but result is %d", status.Cold)
+	}
+}
+
+func TestGetMyVotes(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.VoteTTL = 30 * time.Minute
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (3, 'room3', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Vote(context.Background(), 2, Cold); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rst.tx.Exec(
+		`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, 3, 'comfort', ?)`,
+		rst.s.SessionID, time.Now().Add(-time.Hour),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	votes, err := rst.GetMyVotes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(votes) != 2 || votes[1].Vote != Hot || votes[2].Vote != Cold {
+		t.Errorf("should return votes within VoteTTL, but result is %+v", votes)
+	}
+
+	rst.s = nil
+	votes, err = rst.GetMyVotes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if votes == nil || len(votes) != 0 {
+		t.Errorf("should return an empty map for nil session, but result is %+v", votes)
+	}
+}
+
+func TestVoteWindowSize(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.VoteWindowSize = 3
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	// 部屋1には古い順に暑い2票、寒い3票、部屋2には暑い1票
+	for i, v := range []struct {
+		room   RoomID
+		choice VoteChoice
+	}{{1, Hot}, {1, Hot}, {1, Cold}, {1, Cold}, {1, Cold}, {2, Hot}} {
+		if _, err := rsm.db.Exec(
+			`INSERT INTO session (secret_sha256, expire) VALUES ('', ?)`, now.Add(time.Hour),
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rsm.db.Exec(
+			`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, ?, ?, ?)`,
+			i+1, v.room, string(v.choice), now.Add(time.Duration(i-10)*time.Minute),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	status, err := rst.GetStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != 3 || status.Cold != 3 || status.Hot != 0 {
+		t.Errorf("should count only the latest 3 votes, but result is %+v", status)
+	}
+
+	statuses, err := rst.GetBuildingStatus(ctx, "building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Total != 3 || statuses[1].Total != 1 {
+		t.Errorf("should apply the window to each room, but result is %+v", statuses)
+	}
+
+	// 部屋の条件は番号を振る前に適用され、指定した部屋の投票だけを返す
+	votes, args := rsm.countedVotes(`vote.room_id=?`, 1)
+	var rooms []RoomID
+	rows, err := rst.tx.QueryContext(ctx, `SELECT room_id FROM (`+votes+`) v`, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id RoomID
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		rooms = append(rooms, id)
+	}
+	rows.Close()
+	if len(rooms) != 3 || rooms[0] != 1 || rooms[1] != 1 || rooms[2] != 1 {
+		t.Errorf("should return the latest 3 votes of room 1, but result is %v", rooms)
+	}
+	summaries, err := rst.GetFloorSummary(ctx, "building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summaries[1].Rooms != 2 || summaries[1].Cold != 1 || summaries[1].Hot != 1 {
+		t.Errorf("should summarize rooms in the building, but result is %+v", summaries[1])
+	}
+
+	rsm.config.VoteWindowSize = 0
+	if status, err = rst.GetStatus(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != 5 {
+		t.Errorf("should count all votes without the window, but result is %+v", status)
+	}
+}
+
+func TestGetStatusFivePointScale(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	// 投票はセッション毎に1つのため、投票毎にセッションを作成する
+	for i, choice := range []string{"very_hot", "hot", "comfort", "very_cold", "lukewarm"} {
+		if _, err := rst.tx.Exec(
+			`INSERT INTO session (session_id, secret_sha256, expire) VALUES (?, '', ?)`,
+			100+i, time.Now().Add(time.Hour),
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rst.tx.Exec(
+			`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, 1, ?, ?)`,
+			100+i, choice, time.Now(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.VeryHot != 1 || status.Hot != 1 || status.Comfort != 1 || status.Cold != 0 || status.VeryCold != 1 {
+		t.Errorf("should count each choice, but result is %+v", status)
+	}
+	if status.Other != 1 || status.Total != 5 {
+		t.Errorf("should count unknown choices as other, but other=%d, total=%d", status.Other, status.Total)
+	}
+}
+
+func TestVoteTooSoon(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.MinVoteInterval = time.Minute
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Vote(context.Background(), 1, Cold); err != ErrVoteTooSoon {
+		t.Errorf("should reject the second vote with ErrVoteTooSoon, but result is %v", err)
+	}
+	vote, err := rst.GetMyVote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote == nil || vote.Vote != Hot {
+		t.Errorf("should keep the first vote, but result is %+v", vote)
+	}
+}
+
+// 同じセッションから同時に投票され、どちらも既存の投票がないと判断した場合でも、投票は1つにまとめられる
+func TestUpdateChoiceDoesNotDuplicate(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	// 同時に投票できるように、複数のコネクションからファイルのDBを使用する
+	// (書き込みが競合したトランザクションは、エラーにせずロックが解放されるまで待つ)
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "vote.sqlite3")+"?_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(8)
+	t.Cleanup(func() { db.Close() })
+	schema, err := ioutil.ReadFile("db.sqlite3.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	rsm.db = db
+
+	var sid int64
+	if _, err := db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`INSERT INTO session (secret_sha256, expire) VALUES ('', ?) RETURNING session_id`,
+		time.Now().Add(time.Hour),
+	).Scan(&sid); err != nil {
+		t.Fatal(err)
+	}
+
+	// 最初の投票の行が、投票し直しても同じvote_idのまま更新されることを確認する
+	var voteID int64
+	if err := db.QueryRow(`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, 1, 'comfort', ?) RETURNING vote_id`,
+		sid, time.Now(),
+	).Scan(&voteID); err != nil {
+		t.Fatal(err)
+	}
+
+	choices := []VoteChoice{VeryHot, Hot, Comfort, Cold, VeryCold}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*len(choices))
+	for i := 0; i < 4*len(choices); i++ {
+		wg.Add(1)
+		go func(choice VoteChoice) {
+			defer wg.Done()
+			tx, err := rsm.begin(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback()
+			vote := &Vote{RoomID: 1, S: &Session{SessionID: uint64(sid), tx: tx}}
+			if err := vote.UpdateChoice(context.Background(), tx, choice); err != nil {
+				errs <- err
+				return
+			}
+			errs <- tx.Commit()
+		}(choices[i%len(choices)])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM vote WHERE session_id=? AND room_id=1`, sid).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("should keep a single vote per session and room, but result is %d", count)
+	}
+	var got int64
+	if err := db.QueryRow(`SELECT vote_id FROM vote WHERE session_id=? AND room_id=1`, sid).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != voteID {
+		t.Errorf("should update the vote in place, but vote_id changed from %d to %d", voteID, got)
+	}
+	if err := db.QueryRow(`SELECT count(*) FROM vote_event WHERE session_id=? AND room_id=1`, sid).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4*len(choices) {
+		t.Errorf("should record every vote in vote_event, but result is %d", count)
+	}
+}
+
+func TestVotePublishesAfterCommit(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := rsm.Subscribe(1)
+	defer unsubscribe()
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-events:
+		t.Errorf("should not publish before commit, but received %d", id)
+	default:
+	}
+
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-events:
+		if id != 1 {
+			t.Errorf("should publish room 1, but received %d", id)
+		}
+	default:
+		t.Error("should publish the voted room after commit")
+	}
+}
+
+func TestGetFloorStatus(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES
+			(1, 'room1', 'building', 1),
+			(2, 'room2', 'building', 1),
+			(3, 'room3', 'building', 2);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	for _, v := range []struct {
+		room   RoomID
+		choice string
+	}{{1, "hot"}, {2, "cold"}, {3, "hot"}} {
+		if _, err := rst.tx.Exec(
+			`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, ?, ?, ?)`,
+			rst.s.SessionID, v.room, v.choice, time.Now(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statuses, err := rst.GetFloorStatus(context.Background(), "building", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("should return 2 rooms on the floor, but returned %d", len(statuses))
+	}
+	if statuses[0].RoomID != 1 || statuses[0].Hot != 1 || statuses[0].Total != 1 {
+		t.Errorf("should return the votes of room 1, but result is %+v", statuses[0])
+	}
+	if statuses[1].RoomID != 2 || statuses[1].Cold != 1 || statuses[1].Total != 1 {
+		t.Errorf("should return the votes of room 2, but result is %+v", statuses[1])
+	}
+}
+
+func TestGetBuildingStatus(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES
+			(1, 'room1', 'building', 1),
+			(2, 'room2', 'building', 2),
+			(3, 'room3', 'other', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+
+	statuses, err := rst.GetBuildingStatus(context.Background(), "building")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].RoomID != 1 || statuses[1].RoomID != 2 {
+		t.Errorf("should return rooms 1 and 2, but result is %+v", statuses)
+	}
+}
+
+func TestRoomStatusTxCanceledContext(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rsm.GetStatus(ctx, 1); err == nil {
+		t.Error("should fail with canceled context")
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(ctx, 1, Hot); err == nil {
+		t.Error("should fail to vote with canceled context")
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	w := httptest.NewRecorder()
+	rst.s.w = w
+	sid := rst.s.SessionID
+
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.DeleteSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rst.s != nil {
+		t.Error("session should be nil after DeleteSession")
+	}
+	vote, err := rst.GetMyVote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote != nil {
+		t.Errorf("should return nil after DeleteSession, but result is %+v", vote)
+	}
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != 0 {
+		t.Errorf("should not count votes of the deleted session, but total is %d", status.Total)
+	}
+	var count int
+	if err := rst.tx.QueryRow(`SELECT count(*) FROM session WHERE session_id=?`, sid).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("should delete the session row")
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			t.Errorf("should clear cookie %s, but MaxAge is %d", c.Name, c.MaxAge)
+		}
+	}
+	if len(w.Result().Cookies()) != 3 {
+		t.Errorf("should clear 3 cookies, but cleared %d cookies", len(w.Result().Cookies()))
+	}
+
+	// セッションがない場合は何もしない
+	if err := rst.DeleteSession(context.Background()); err != nil {
+		t.Errorf("should ignore nil session, but got error: %s", err)
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.config.SessionTTL = time.Hour
+	rst := newTestRoomStatusTx(t, rsm)
+	w := httptest.NewRecorder()
+	rst.s.w = w
+
+	// 有効期限が迫っているセッション
+	if _, err := rst.tx.Exec(`UPDATE session SET expire=? WHERE session_id=?`, time.Now().Add(time.Second), rst.s.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.TouchSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var expire time.Time
+	if err := rst.tx.QueryRow(`SELECT expire FROM session WHERE session_id=?`, rst.s.SessionID).Scan(&expire); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expire); d < 59*time.Minute {
+		t.Errorf("should extend the expiration by the TTL, but expires after %s", d)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 3 {
+		t.Fatalf("should refresh 3 cookies, but refreshed %d cookies", len(cookies))
+	}
+	for _, c := range cookies {
+		if c.MaxAge != 3600 {
+			t.Errorf("cookie %s should have MaxAge 3600, but result is %d", c.Name, c.MaxAge)
+		}
+	}
+
+	// セッションがない場合は何もしない
+	rst.s = nil
+	if err := rst.TouchSession(context.Background()); err != nil {
+		t.Errorf("should ignore nil session, but got error: %s", err)
+	}
+}
+
+func TestResetVotes(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Vote(context.Background(), 2, Cold); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := rst.ResetVotes(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("should clear 1 vote, but cleared %d votes", n)
+	}
+
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != 0 || status.Hot != 0 {
+		t.Errorf("should show zero votes after reset, but result is %+v", status)
+	}
+	vote, err := rst.GetMyVote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote != nil {
+		t.Errorf("should return nil after reset, but result is %+v", vote)
+	}
+
+	// 他の部屋の投票は削除しない
+	status, err = rst.GetStatus(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Cold != 1 {
+		t.Errorf("should keep votes of other rooms, but result is %+v", status)
+	}
+}
+
+func TestSensorStatusAgeAndStale(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	now := time.Now()
+	rsm.sensorCache[1] = map[ThingName]SensorStatus{
+		"fresh": {IsConnected: true, LastUpdated: now.Unix() - 15, expire: now.Add(time.Minute)},
+		"stale": {IsConnected: true, LastUpdated: now.Unix() - 600, expire: now.Add(-time.Minute), staleUntil: now.Add(time.Minute)},
+	}
+
+	stats, _, ok := rsm.getSensorStatusFromCache(1)
+	if !ok || len(stats) != 2 {
+		t.Fatalf("should return 2 sensors, but result is %+v", stats)
+	}
+	for _, stat := range stats {
+		switch stat.LastUpdated {
+		case now.Unix() - 15:
+			if stat.Stale || stat.AgeSeconds < 15 || stat.AgeSeconds > 16 {
+				t.Errorf("fresh sensor should be 15s old and not stale, but result is %+v", stat)
+			}
+		case now.Unix() - 600:
+			if !stat.Stale || stat.IsConnected || stat.AgeSeconds < 600 {
+				t.Errorf("expired sensor should be stale, but result is %+v", stat)
+			}
+		}
+	}
+
+	js, err := json.Marshal(stats[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"lastUpdated":`, `"ageSeconds":`, `"stale":`} {
+		if !strings.Contains(string(js), key) {
+			t.Errorf("JSON should contain %s, but result is %s", key, js)
+		}
+	}
+}
+
+func TestApplySensorStatusOutOfRange(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	lastUpdated := float64(time.Now().Unix() * 1000)
+
+	good := dproxy.New(map[string]interface{}{
+		"temperature": 24.0,
+		"humidity":    50.0,
+		"lastUpdated": lastUpdated,
+	})
+	if err := rsm.applySensorStatus(1, "thing", good); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		temperature float64
+		humidity    float64
+	}{
+		{-40, 50},
+		{200, 50},
+		{24, -1},
+		{24, 120},
+	}
+	for _, tt := range tests {
+		prop := dproxy.New(map[string]interface{}{
+			"temperature": tt.temperature,
+			"humidity":    tt.humidity,
+			"lastUpdated": lastUpdated,
+		})
+		if err := rsm.applySensorStatus(1, "thing", prop); err != nil {
+			t.Fatal(err)
+		}
+		stats, _, ok := rsm.getSensorStatusFromCache(1)
+		if !ok || len(stats) != 1 {
+			t.Fatalf("should keep the previous reading, but result is %+v", stats)
+		}
+		if optionalValue(stats[0].Temperature) != 24.0 || optionalValue(stats[0].Humidity) != 50.0 {
+			t.Errorf("temperature=%v, humidity=%v: should keep the previous reading, but result is %+v", tt.temperature, tt.humidity, stats[0])
+		}
+	}
+
+	// 範囲を変更した場合
+	rsm.config.TemperatureRange = ValueRange{Min: -50, Max: 50}
+	cold := dproxy.New(map[string]interface{}{
+		"temperature": -40.0,
+		"humidity":    50.0,
+		"lastUpdated": lastUpdated,
+	})
+	if err := rsm.applySensorStatus(1, "thing", cold); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _, _ := rsm.getSensorStatusFromCache(1); len(stats) != 1 || optionalValue(stats[0].Temperature) != -40.0 {
+		t.Errorf("should accept the reading within the configured range, but result is %+v", stats)
+	}
+}
+
+func TestGetRoomsByDominantChoice(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+
+	if _, err := rst.tx.ExecContext(ctx, `
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'hot', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'tie', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (3, 'cold', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (4, 'empty', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (5, 'plurality', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	votes := []struct {
+		room   RoomID
+		choice VoteChoice
+	}{
+		{1, VeryHot}, {1, Hot}, {1, Comfort},
+		{2, Hot}, {2, Comfort},
+		{3, Cold},
+		// 過半数ではないが最も多い
+		{5, Hot}, {5, Hot}, {5, Comfort}, {5, Cold},
+	}
+	for i, v := range votes {
+		if _, err := rst.tx.ExecContext(ctx,
+			`INSERT INTO session (session_id, secret_sha256, expire) VALUES (?, '', ?)`,
+			100+i, time.Now().Add(time.Hour),
+		); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rst.tx.ExecContext(ctx,
+			`INSERT INTO vote (session_id, room_id, choice, timestamp) VALUES (?, ?, ?, ?)`,
+			100+i, v.room, string(v.choice), time.Now(),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(statuses []*RoomStatus) []RoomID {
+		ids := []RoomID{}
+		for _, rs := range statuses {
+			ids = append(ids, rs.RoomID)
+		}
+		return ids
+	}
+
+	statuses, err := rst.GetRoomsByDominantChoice(ctx, Hot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// とても暑いは暑いに含め、同数の部屋と相対多数の部屋も含める
+	if got := ids(statuses); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 5 {
+		t.Errorf("should return rooms 1, 2 and 5, but result is %v", got)
+	}
+
+	statuses, err = rst.GetRoomsByDominantChoice(ctx, Comfort, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(statuses); len(got) != 1 || got[0] != 2 {
+		t.Errorf("should return only the tied room 2, but result is %v", got)
+	}
+
+	statuses, err = rst.GetRoomsByDominantChoice(ctx, Cold, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(statuses); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("should return rooms 3 and 4, but result is %v", got)
+	}
+
+	for _, choice := range []VoteChoice{"warm", VeryHot} {
+		if _, err := rst.GetRoomsByDominantChoice(ctx, choice, false); err != ErrInvalidChoice {
+			t.Errorf("%s: should return ErrInvalidChoice, but result is %v", choice, err)
+		}
+	}
+}
+
+func TestGetRoomDetail(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.Vote(ctx, 1, Cold); err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err := rst.GetRoomDetail(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Name != "room1" || detail.Status.Cold != 1 || detail.MyVote == nil || detail.MyVote.Vote != Cold {
+		t.Errorf("should return name, status and my vote, but result is %+v", detail)
+	}
+
+	if _, err := rst.GetRoomDetail(ctx, 2); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+}
+
+func TestGetTotalVoters(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.Vote(ctx, 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	// 有効期間を過ぎた別のセッションの投票と、別の部屋への投票
+	expired := time.Now().Add(-2 * rsm.config.VoteTTL)
+	if _, err := rst.tx.ExecContext(ctx, `
+		INSERT INTO session (session_id, secret_sha256, expire) VALUES (100, '', ?)`,
+		time.Now().Add(time.Hour),
+	); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		room RoomID
+		ts   time.Time
+	}{{1, expired}, {2, time.Now()}} {
+		vote := &Vote{RoomID: v.room, S: &Session{SessionID: 100, tx: rst.tx}}
+		if err := vote.UpdateChoice(ctx, rst.tx, Cold); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rst.tx.ExecContext(ctx,
+			`UPDATE vote SET timestamp=? WHERE session_id=100 AND room_id=?`,
+			v.ts, v.room,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 期限切れのセッションの削除で、セッションと投票が削除されても投票者として数える
+	if _, err := rst.tx.ExecContext(ctx, `
+		UPDATE session SET expire=? WHERE session_id=100`,
+		time.Now().Add(-time.Hour),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rst.tx.ExecContext(ctx, `DELETE FROM session WHERE expire<?`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rst.tx.ExecContext(ctx, `DELETE FROM vote WHERE session_id=100`); err != nil {
+		t.Fatal(err)
+	}
+	// 保持期間を過ぎた投票の履歴が削除されても数える
+	if _, err := rst.tx.ExecContext(ctx, `DELETE FROM vote_event`); err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err := rst.GetRoomDetail(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 現在の投票数は有効期間内の投票のみ、投票者数は期限切れの投票や削除済みのセッション、履歴の削除に関わらず重複なく数える
+	if detail.Status.Total != 1 {
+		t.Errorf("should count 1 live vote, but result is %d", detail.Status.Total)
+	}
+	if detail.TotalVoters != 2 {
+		t.Errorf("should count 2 distinct voters, but result is %d", detail.TotalVoters)
+	}
+}
+
+func TestApplySensorStatusOptionalProperties(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	lastUpdated := float64(time.Now().Unix() * 1000)
+
+	if err := rsm.applySensorStatus(1, "full", dproxy.New(map[string]interface{}{
+		"temperature": 24.0,
+		"humidity":    50.0,
+		"lastUpdated": lastUpdated,
+		"co2":         850.0,
+		"occupancy":   12.0,
+	})); err != nil {
+		t.Fatal(err)
+	}
+	// 型が異なるプロパティも、存在しない場合と同じように扱う
+	if err := rsm.applySensorStatus(1, "basic", dproxy.New(map[string]interface{}{
+		"temperature": 24.0,
+		"humidity":    50.0,
+		"lastUpdated": lastUpdated,
+		"co2":         "n/a",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	full := rsm.sensorCache[1]["full"]
+	if full.CO2 == nil || *full.CO2 != 850 || full.Occupancy == nil || *full.Occupancy != 12 {
+		t.Errorf("should set co2 and occupancy, but result is %+v", full)
+	}
+	basic := rsm.sensorCache[1]["basic"]
+	if basic.CO2 != nil || basic.Occupancy != nil {
+		t.Errorf("should leave co2 and occupancy nil, but result is %+v", basic)
+	}
+}
+
+func TestUpdateAllSensorStatusesWithFake(t *testing.T) {
+	fake := NewFakeThingWorx()
+	now := time.Now()
+	fake.Set("a", 24, 40, now)
+	fake.Set("b", 26, 60, now)
+	fake.Set("c", 20, 50, now.Add(-5*time.Minute))
+	fake.SetError("d", errors.New("connection refused"))
+
+	rsm := newTestRoomStatusManager(t, fake)
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'a');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'b');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'c');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'd');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'e');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// エラーを返したThingだけが失敗し、データのないThingは無視される
+	if errs := rsm.updateAllSensorStatuses(context.Background()); len(errs) != 1 {
+		t.Errorf("should return 1 error, but result is %v", errs)
+	}
+	if fake.Calls("e") != 1 {
+		t.Errorf("should read thing e once, but called %d times", fake.Calls("e"))
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SensorCount != 2 || status.AvgTemperature == nil || *status.AvgTemperature != 25 || *status.AvgHumidity != 50 {
+		t.Errorf("should average both sensors, but result is %+v", status)
+	}
+
+	status, err = rst.GetStatus(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Sensors) != 1 || status.Sensors[0].IsConnected || status.SensorCount != 0 || status.AvgTemperature != nil {
+		t.Errorf("should show the old sensor as disconnected, but result is %+v", status)
+	}
+}
+
+func TestLastRefresh(t *testing.T) {
+	fake := NewFakeThingWorx()
+	fake.Set("a", 24, 40, time.Now())
+	fake.SetError("b", errors.New("connection refused"))
+
+	rsm := newTestRoomStatusManager(t, fake)
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'a');
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'b');
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if !rsm.LastRefresh().IsZero() {
+		t.Errorf("should return zero before the first refresh, but result is %v", rsm.LastRefresh())
+	}
+
+	// 一部のセンサーの取得に失敗しても、成功とみなす
+	before := time.Now()
+	rsm.updateAllSensorStatuses(context.Background())
+	last := rsm.LastRefresh()
+	if last.Before(before) {
+		t.Errorf("should record the refresh time, but result is %v", last)
+	}
+
+	// すべてのセンサーの取得に失敗した場合は更新しない
+	fake.SetError("a", errors.New("connection refused"))
+	rsm.updateAllSensorStatuses(context.Background())
+	if !rsm.LastRefresh().Equal(last) {
+		t.Errorf("should keep the last successful refresh time, but result is %v", rsm.LastRefresh())
+	}
+}
+
+func TestVoteAndStatus(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+
+	status, myVote, err := rst.VoteAndStatus(context.Background(), 1, VeryCold, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.VeryCold != 1 || status.Total != 1 {
+		t.Errorf("should include the new vote, but result is %+v", status)
+	}
+	if myVote == nil || myVote.Vote != VeryCold {
+		t.Errorf("should return my vote, but result is %+v", myVote)
+	}
+
+	if _, _, err := rst.VoteAndStatus(context.Background(), 1, Hot, ""); err != ErrVoteTooSoon {
+		t.Errorf("should return ErrVoteTooSoon, but result is %v", err)
+	}
+}
+
+func TestVoteAndStatusConcurrent(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	totals := make(chan uint64, n)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			tx, err := rsm.begin(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tx.Rollback()
+			sid, err := tx.InsertID(ctx, "session_id",
+				`INSERT INTO session (secret_sha256, expire) VALUES ('', ?)`,
+				time.Now().Add(time.Hour),
+			)
+			if err != nil {
+				errs <- err
+				return
+			}
+			rst := &RoomStatusTx{rsm: rsm, tx: tx, s: &Session{SessionID: uint64(sid), tx: tx, ttl: rsm.config.SessionTTL}}
+			status, _, err := rst.VoteAndStatus(ctx, 1, Hot, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := rst.Commit(); err != nil {
+				errs <- err
+				return
+			}
+			totals <- status.Total
+		}()
+	}
+	wg.Wait()
+	close(totals)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 投票は直列化されるため、各投票者は自分の投票までを含む、互いに異なる合計を受け取る
+	seen := map[uint64]bool{}
+	for total := range totals {
+		if total < 1 || total > n || seen[total] {
+			t.Errorf("should see a distinct total in 1..%d, but result is %d", n, total)
+		}
+		seen[total] = true
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	status, err := rst.GetStatus(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != n {
+		t.Errorf("should count %d votes from distinct sessions, but result is %d", n, status.Total)
+	}
+}
+
+func TestVoteWithoutSession(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	rst.s = nil
+
+	if err := rst.Vote(context.Background(), 1, Hot); err != ErrNoSession {
+		t.Errorf("should return ErrNoSession, but result is %v", err)
+	}
+	if _, _, err := rst.VoteAndStatus(context.Background(), 1, Hot, ""); err != ErrNoSession {
+		t.Errorf("should return ErrNoSession, but result is %v", err)
+	}
+}
+
+func TestVoteForUnknownRoom(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rst := newTestRoomStatusTx(t, rsm)
+
+	if err := rst.Vote(context.Background(), 999, Hot); err != ErrRoomNotFound {
+		t.Errorf("should return ErrRoomNotFound, but result is %v", err)
+	}
+	var n int
+	if err := rst.tx.QueryRowContext(context.Background(), `SELECT count(*) FROM vote`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("should not insert a vote, but found %d votes", n)
+	}
+}
+
+func TestNextRefreshDelay(t *testing.T) {
+	rsm := &RoomStatusManager{config: RSMConfig{
+		RefreshInterval: time.Minute,
+		MinRefreshGap:   10 * time.Second,
+	}.withDefaults()}
+
+	for _, c := range []struct {
+		elapsed  time.Duration
+		expected time.Duration
+	}{
+		{0, time.Minute},
+		{20 * time.Second, 40 * time.Second},
+		{55 * time.Second, 10 * time.Second},
+		{3 * time.Minute, 10 * time.Second},
+	} {
+		if d := rsm.nextRefreshDelay(c.elapsed); d != c.expected {
+			t.Errorf("elapsed %s: should wait %s, but result is %s", c.elapsed, c.expected, d)
+		}
+	}
+
+	// MinRefreshGapが未設定の場合、RefreshIntervalより長くはしない
+	config := RSMConfig{RefreshInterval: time.Second}.withDefaults()
+	if config.MinRefreshGap != time.Second {
+		t.Errorf("MinRefreshGap should be capped by RefreshInterval, but result is %s", config.MinRefreshGap)
+	}
+}
+
+func TestBuildingScope(t *testing.T) {
+	fake := NewFakeThingWorx()
+	rsm := newTestRoomStatusManager(t, fake)
+	rsm.config.Buildings = []BuildingName{"A", "C"}
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'A101', 'A', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'B101', 'B', 1);
+		INSERT INTO thing (room_id, thing_name) VALUES (1, 'a');
+		INSERT INTO thing (room_id, thing_name) VALUES (2, 'b');
+	`); err != nil {
+		t.Fatal(err)
+	}
+	fake.Set("a", 24, 50, time.Now())
+	fake.Set("b", 24, 50, time.Now())
+
+	ctx := context.Background()
+	if errs := rsm.updateAllSensorStatuses(ctx); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if fake.Calls("a") != 1 || fake.Calls("b") != 0 {
+		t.Errorf("should read only the things in the buildings, but read a %d times and b %d times", fake.Calls("a"), fake.Calls("b"))
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	if _, err := rst.GetStatus(ctx, 1); err != nil {
+		t.Errorf("should return the status of a room in scope, but result is %v", err)
+	}
+	if _, err := rst.GetStatus(ctx, 2); err != ErrRoomOutOfScope {
+		t.Errorf("should return ErrRoomOutOfScope, but result is %v", err)
+	}
+	if statuses, err := rst.GetBuildingStatus(ctx, "B"); err != nil || len(statuses) != 0 {
+		t.Errorf("should not return rooms out of scope, but result is %v, %v", statuses, err)
+	}
+	if statuses, err := rst.GetBuildingStatus(ctx, "A"); err != nil || len(statuses) != 1 {
+		t.Errorf("should return rooms in scope, but result is %v, %v", statuses, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	dproxy "github.com/koron/go-dproxy"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// プロパティの値を数値として読み出す。プロパティがない場合とnullの場合はエラーを返す。
+func propertyFloat64(prop dproxy.Proxy, name string) (float64, error) {
+	f, err := optionalPropertyFloat64(prop, name)
+	if err != nil {
+		return 0, err
+	}
+	if f == nil {
+		return 0, fmt.Errorf("property %q is missing or null", name)
+	}
+	return *f, nil
+}
+
+// プロパティの値を数値として読み出す。プロパティがない場合とnullの場合は、値がないものとしてnilを返す。
+// ThingWorxのSTRING型のプロパティのように、数値が文字列で返される場合も受け付ける。
+// 数値以外の型、NaNや無限大の場合は、プロパティ名を含むエラーを返す。
+func optionalPropertyFloat64(prop dproxy.Proxy, name string) (*float64, error) {
+	m, err := prop.Map()
+	if err != nil {
+		return nil, fmt.Errorf("properties are not an object: %w", err)
+	}
+
+	var f float64
+	switch v := m[name].(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	case int:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case json.Number:
+		if f, err = v.Float64(); err != nil {
+			return nil, fmt.Errorf("property %q is not a number: %w", name, err)
+		}
+	case string:
+		if f, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return nil, fmt.Errorf("property %q is not a number: %q", name, v)
+		}
+	default:
+		return nil, fmt.Errorf("property %q is not a number: %T", name, v)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("property %q is not a finite number: %v", name, f)
+	}
+	return &f, nil
+}
+
+// プロパティの値を整数として読み出す。小数部は切り捨てる。
+// int64で表せない値の場合は、変換結果が不定になるためエラーを返す。
+func propertyInt64(prop dproxy.Proxy, name string) (int64, error) {
+	f, err := propertyFloat64(prop, name)
+	if err != nil {
+		return 0, err
+	}
+	// float64(math.MaxInt64)は2^63に丸められるため、上限は含まない
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("property %q is out of range: %v", name, f)
+	}
+	return int64(f), nil
+}
+
+// ログやETagに出力するために、値がない場合はnilを、ある場合はポインタではなく値を返す。
+func optionalValue(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+// bodyをレスポンスとして返すThingWorxClientを作成する。ネットワークには接続しない。
+func newStaticThingWorxClient(body []byte) *ThingWorxClient {
+	return &ThingWorxClient{
+		URL:        "http://thingworx.invalid/Thingworx",
+		MaxRetries: -1,
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(bytes.NewReader(body)),
+					Request:    req,
+				}, nil
+			}),
+		},
+	}
+}
+
+// ThingWorxのレスポンスを取得してセンサーの状態に反映するまでの処理を、本番と同じ順序で行う。
+func applyThingWorxPayload(rsm *RoomStatusManager, body []byte) error {
+	prop, err := newStaticThingWorxClient(body).Properties(context.Background(), "thing")
+	if err != nil {
+		return err
+	}
+	return rsm.applySensorStatus(1, "thing", prop)
+}
+
+func TestApplyThingWorxPayload(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix()*1000, 10)
+
+	tests := []struct {
+		name string
+		body string
+		// エラーメッセージに含まれるべき文字列。空の場合はエラーにならないこと。
+		err string
+		// エラーにならない場合に、キャッシュされるべき温度。NaNの場合はキャッシュされないこと。
+		// nilの場合は、温度のないセンサーとしてキャッシュされること。
+		temperature *float64
+	}{
+		{"valid", `{"rows":[{"temperature":21.5,"humidity":40,"lastUpdated":` + now + `}]}`, "", float64Ptr(21.5)},
+		{"string numbers", `{"rows":[{"temperature":"21.5","humidity":" 40 ","lastUpdated":"` + now + `"}]}`, "", float64Ptr(21.5)},
+		{"missing temperature", `{"rows":[{"humidity":40,"lastUpdated":` + now + `}]}`, "", nil},
+		{"missing lastUpdated", `{"rows":[{"temperature":21.5,"humidity":40}]}`, `"lastUpdated" is missing or null`, nil},
+		{"null humidity", `{"rows":[{"temperature":21.5,"humidity":null,"lastUpdated":` + now + `}]}`, "", float64Ptr(21.5)},
+		{"null readings", `{"rows":[{"temperature":null,"humidity":null,"lastUpdated":` + now + `}]}`, "", nil},
+		{"non-numeric string", `{"rows":[{"temperature":"warm","humidity":40,"lastUpdated":` + now + `}]}`, `"temperature" is not a number`, nil},
+		{"NaN string", `{"rows":[{"temperature":"NaN","humidity":40,"lastUpdated":` + now + `}]}`, `"temperature" is not a finite number`, nil},
+		{"boolean", `{"rows":[{"temperature":true,"humidity":40,"lastUpdated":` + now + `}]}`, `"temperature" is not a number`, nil},
+		{"nested value", `{"rows":[{"temperature":{"value":21.5},"humidity":40,"lastUpdated":` + now + `}]}`, `"temperature" is not a number`, nil},
+		{"nested rows", `{"rows":[[{"temperature":21.5,"humidity":40,"lastUpdated":` + now + `}]]}`, "is not an object", nil},
+		{"null row", `{"rows":[null]}`, "is not an object", nil},
+		{"flat", `{"temperature":21.5,"humidity":40,"lastUpdated":` + now + `}`, ErrNoThingData.Error(), nil},
+		{"empty rows", `{"rows":[]}`, ErrNoThingData.Error(), nil},
+		{"huge temperature", `{"rows":[{"temperature":1e300,"humidity":40,"lastUpdated":` + now + `}]}`, "", float64Ptr(math.NaN())},
+		{"overflowing temperature", `{"rows":[{"temperature":1e400,"humidity":40,"lastUpdated":` + now + `}]}`, "can not decode", nil},
+		{"huge lastUpdated", `{"rows":[{"temperature":21.5,"humidity":40,"lastUpdated":1e30}]}`, `"lastUpdated" is out of range`, nil},
+		{"invalid JSON", `{"rows":[{"temperature":`, "can not decode", nil},
+	}
+	for _, test := range tests {
+		rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+		err := applyThingWorxPayload(rsm, []byte(test.body))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error should contain %q, but result is %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: should not return an error, but got %s", test.name, err)
+			continue
+		}
+		stats, _, ok := rsm.getSensorStatusFromCache(1)
+		if test.temperature != nil && math.IsNaN(*test.temperature) {
+			if ok {
+				t.Errorf("%s: should not cache an out of range reading, but result is %+v", test.name, stats)
+			}
+			continue
+		}
+		if !ok || len(stats) != 1 || optionalValue(stats[0].Temperature) != optionalValue(test.temperature) {
+			t.Errorf("%s: should cache temperature %v, but result is %+v", test.name, optionalValue(test.temperature), stats)
+		}
+	}
+}
+
+func TestApplyThingWorxPayloadErrorIncludesThingName(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	err := applyThingWorxPayload(rsm, []byte(`{"rows":[{"temperature":null}]}`))
+	if err == nil || !strings.Contains(err.Error(), `"thing"`) {
+		t.Errorf("error should contain the thing name, but result is %v", err)
+	}
+	if errors.Is(err, ErrNoThingData) {
+		t.Errorf("should not treat a broken row as no data, but result is %v", err)
+	}
+}
+
+// 不正なレスポンスでpanicせず、エラーの場合は内容のあるメッセージを返すことを確認する。
+// go test -fuzz=FuzzApplyThingWorxPayload で実行する。
+func FuzzApplyThingWorxPayload(f *testing.F) {
+	now := strconv.FormatInt(time.Now().Unix()*1000, 10)
+	for _, seed := range []string{
+		`{"rows":[{"temperature":21.5,"humidity":40,"lastUpdated":` + now + `,"co2":600,"occupancy":3}]}`,
+		`{"rows":[{"temperature":"21.5","humidity":"40","lastUpdated":"` + now + `"}]}`,
+		`{"rows":[{"temperature":null,"humidity":null,"lastUpdated":null}]}`,
+		`{"rows":[[{"temperature":21.5}]]}`,
+		`{"rows":[{"temperature":1e308,"humidity":-1e308,"lastUpdated":-9.3e18,"occupancy":1e20}]}`,
+		`{"rows":null}`,
+		`[]`,
+		`null`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	rsm := newTestRoomStatusManager(f, &ThingWorxClient{})
+	// 入力毎に出力される警告で、テストの出力が埋もれないようにする
+	rsm.config.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if err := applyThingWorxPayload(rsm, body); err != nil {
+			if err.Error() == "" {
+				t.Error("should return a descriptive error")
+			}
+			return
+		}
+		stats, _, _ := rsm.getSensorStatusFromCache(1)
+		for _, stat := range stats {
+			if (stat.Temperature != nil && !rsm.config.TemperatureRange.Contains(*stat.Temperature)) ||
+				(stat.Humidity != nil && !rsm.config.HumidityRange.Contains(*stat.Humidity)) {
+				t.Errorf("should not cache an out of range reading, but result is %+v", stat)
+			}
+		}
+	})
+}
@@ -4,22 +4,41 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
-	"github.com/kelseyhightower/envconfig"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
 	ServerErrorMsg = "500 Internal Server Error"
+	// Server-Sent Eventsの接続を維持するために、コメントを送信する間隔
+	SSE_KEEP_ALIVE = 30 * time.Second
+	// レディネスプローブで、依存先の応答を待つ最大の時間
+	READY_CHECK_TIMEOUT = 3 * time.Second
+	// サーバーの停止時に、処理中のリクエストの完了を待つ最大の時間
+	SHUTDOWN_TIMEOUT = 30 * time.Second
+	// フォームで受け取るリクエストのボディの最大サイズ
+	MAX_REQUEST_BODY_SIZE = 64 << 10
+	// センサーの状態の更新が最後に成功した時刻(UNIX時間、秒単位)を返すヘッダー
+	LAST_REFRESH_HEADER = "X-Sensor-Last-Refresh"
 )
 
 type RouterOption struct {
@@ -30,6 +49,182 @@ type RouterOption struct {
 	DBInitSQLFile   string `envconfig:"DB_INIT_SQL_FILE"`
 	ThingWorxURL    string `envconfig:"THINGWORX_URL"`
 	ThingWorxAppKey string `envconfig:"THINGWORX_APP_KEY"`
+	// AppKeyをクエリパラメータで送信する。ヘッダーでの送信に対応していないサーバー向け。
+	ThingWorxAppKeyInQuery bool `envconfig:"THINGWORX_APP_KEY_IN_QUERY"`
+	// Thing毎のAppKey。(ex: "thing1:key1,thing2:key2") 含まれないThingにはThingWorxAppKeyを使用する。
+	ThingWorxAppKeys map[string]string `envconfig:"THINGWORX_APP_KEYS"`
+	// Thingのプロパティのパス。"{thing}"をThing名に置き換える。(ex: "/Thingworx/Things/{thing}/Properties/")
+	// 空の場合は"/Things/{thing}/Properties/"。
+	ThingWorxPropertiesPath string `envconfig:"THINGWORX_PROPERTIES_PATH"`
+	// 複数のThingのプロパティを一括で取得するサービスのパス。空の場合は一括取得しない。
+	ThingWorxBatchService   string `envconfig:"THINGWORX_BATCH_SERVICE"`
+	ThingWorxBatchThreshold int    `envconfig:"THINGWORX_BATCH_THRESHOLD"`
+	// センサーの値を読み出すプロパティ名。空の場合はデフォルトのプロパティ名を使用する。
+	ThingWorxTemperatureProperty string `envconfig:"THINGWORX_TEMPERATURE_PROPERTY"`
+	ThingWorxHumidityProperty    string `envconfig:"THINGWORX_HUMIDITY_PROPERTY"`
+	ThingWorxLastUpdatedProperty string `envconfig:"THINGWORX_LAST_UPDATED_PROPERTY"`
+	// CO2濃度と在室人数を読み出すプロパティ名。これらのプロパティを持たないThingでは省略される。
+	ThingWorxCO2Property       string `envconfig:"THINGWORX_CO2_PROPERTY"`
+	ThingWorxOccupancyProperty string `envconfig:"THINGWORX_OCCUPANCY_PROPERTY"`
+	// センサーの状態の更新間隔とキャッシュの有効期間。(ex: "30s", "5m")
+	SensorRefreshInterval time.Duration `envconfig:"SENSOR_REFRESH_INTERVAL"`
+	SensorCacheExpire     time.Duration `envconfig:"SENSOR_CACHE_EXPIRE"`
+	// 更新処理の終了から次の更新処理の開始までに、最低限空ける時間
+	SensorMinRefreshGap time.Duration `envconfig:"SENSOR_MIN_REFRESH_GAP"`
+	// センサーの接続が切れた後、最後の値を表示し続ける期間
+	SensorStaleRetention time.Duration `envconfig:"SENSOR_STALE_RETENTION"`
+	// センサーが接続されているとみなす、最終更新時刻からの経過時間
+	SensorConnectedThreshold time.Duration `envconfig:"SENSOR_CONNECTED_THRESHOLD"`
+	// ThingWorxへ同時に送信するリクエストの最大数
+	SensorMaxConcurrentUpdates int `envconfig:"SENSOR_MAX_CONCURRENT_UPDATES"`
+	// 部屋毎に返すセンサーの最大数。超えた場合は最終更新時刻が新しいものから返す。デフォルトは32。
+	SensorMaxPerRoom int `envconfig:"SENSOR_MAX_PER_ROOM"`
+	// 起動時に、リクエストの受付を開始する前にセンサーの状態を取得する
+	SensorWarmCache bool `envconfig:"SENSOR_WARM_CACHE"`
+	// センサーの値として妥当な範囲。範囲外の値は異常値として無視する。
+	// 指定しなかった最小値・最大値は、それぞれデフォルトの範囲(気温: -30〜60℃, 湿度: 0〜100%)の値を使用する。
+	SensorMinTemperature *float64 `envconfig:"SENSOR_MIN_TEMPERATURE"`
+	SensorMaxTemperature *float64 `envconfig:"SENSOR_MAX_TEMPERATURE"`
+	SensorMinHumidity    *float64 `envconfig:"SENSOR_MIN_HUMIDITY"`
+	SensorMaxHumidity    *float64 `envconfig:"SENSOR_MAX_HUMIDITY"`
+	// 投票画面のURLのベースURL。QRコードに使用する。(ex: "https://temvote.example.com")
+	// 空の場合、リンクのAPIはリクエストのホストから組み立て、QRコードは503を返す。
+	// (クライアントが指定するHostヘッダーのURLを、印刷されるQRコードやキャッシュに含めないため)
+	PublicBaseURL string `envconfig:"PUBLIC_BASE_URL"`
+	// このインスタンスが担当する建物。カンマ区切りで複数指定できる。空の場合はすべての建物を担当する。
+	Buildings []string `envconfig:"BUILDINGS"`
+	// 表示する気温を指数移動平均で平滑化する係数。(0より大きく1以下) 0の場合は平滑化しない。
+	SensorSmoothingAlpha float64 `envconfig:"SENSOR_SMOOTHING_ALPHA"`
+	// 投票が有効な期間。これより古い投票は集計しない。
+	VoteTTL time.Duration `envconfig:"VOTE_TTL"`
+	// 部屋毎に集計する投票の最大数。新しい投票からこの数だけを集計する。0の場合は制限しない。
+	VoteWindowSize int `envconfig:"VOTE_WINDOW_SIZE"`
+	// 同じ部屋への投票を変更できる最短の間隔
+	MinVoteInterval time.Duration `envconfig:"MIN_VOTE_INTERVAL"`
+	// セッションとCookieの有効期間。デフォルトは10分。(ex: "5m", "720h")
+	SessionTTL time.Duration `envconfig:"SESSION_TTL"`
+	// セッションのCookieの属性。COOKIE_INSECUREはHTTPでローカルで開発する場合に使用する。
+	// COOKIE_SAME_SITEは"lax"(デフォルト)、"strict"、"none"のいずれか。COOKIE_PATHのデフォルトは"/"。
+	CookieInsecure bool   `envconfig:"COOKIE_INSECURE"`
+	CookieSameSite string `envconfig:"COOKIE_SAME_SITE"`
+	CookiePath     string `envconfig:"COOKIE_PATH"`
+	CookieDomain   string `envconfig:"COOKIE_DOMAIN"`
+	// 投票の推移の集計に使用する、投票の履歴を保持する期間。デフォルトは30日。
+	VoteEventRetention time.Duration `envconfig:"VOTE_EVENT_RETENTION"`
+	// センサーの測定値の履歴を保存する。保存した履歴は、保持期間を過ぎると削除される。
+	SensorRecordHistory    bool          `envconfig:"SENSOR_RECORD_HISTORY"`
+	SensorHistoryRetention time.Duration `envconfig:"SENSOR_HISTORY_RETENTION"`
+	// 管理者用APIの認証に使用するBearerトークンと、Basic認証のユーザー名・パスワード。
+	// トークンとパスワードのどちらも空の場合、管理者用APIは使用できない。
+	AdminToken    string `envconfig:"ADMIN_TOKEN"`
+	AdminUser     string `envconfig:"ADMIN_USER"`
+	AdminPassword string `envconfig:"ADMIN_PASSWORD"`
+	// 部屋の削除時に、部屋のThingと投票も削除する。falseの場合、Thingか投票が残っている部屋は削除できない。
+	CascadeRoomDelete bool `envconfig:"CASCADE_ROOM_DELETE"`
+	// ログの出力レベル。(ex: "debug", "info", "warn", "error") 空の場合は"info"。
+	LogLevel string `envconfig:"LOG_LEVEL"`
+	// リクエスト毎のアクセスログを出力する。リクエストのメトリクスは、この設定に関わらず記録する。
+	AccessLog bool `envconfig:"ACCESS_LOG"`
+	// 別オリジンからのリクエストを許可するオリジン。カンマ区切りで複数指定できる。
+	// (ex: "https://example.com,http://localhost:3000")
+	CORSAllowedOrigins []string `envconfig:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods []string `envconfig:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders []string `envconfig:"CORS_ALLOWED_HEADERS"`
+	// 別オリジンからのリクエストで、セッションのCookieの送信を許可する。
+	CORSAllowCredentials bool `envconfig:"CORS_ALLOW_CREDENTIALS"`
+	// 部屋の投票の過半数が暑いまたは寒いのまま続いたときに通知するWebhookのURL。空の場合は通知しない。
+	AlertWebhookURL string `envconfig:"ALERT_WEBHOOK_URL"`
+	// 通知するまでに不快な状態が続く時間と、通知の対象とする部屋の最小の投票数。
+	// デフォルトはそれぞれ30分と3票。
+	AlertDuration time.Duration `envconfig:"ALERT_DURATION"`
+	AlertMinVotes int           `envconfig:"ALERT_MIN_VOTES"`
+	// センサーの接続が切れたときと復帰したときに通知するWebhookのURL。(ex: SlackのIncoming Webhook)
+	// 猶予期間内に元の状態に戻った場合は通知しない。猶予期間のデフォルトは5分。
+	SensorWebhookURL       string        `envconfig:"SENSOR_WEBHOOK_URL"`
+	SensorAlertGracePeriod time.Duration `envconfig:"SENSOR_ALERT_GRACE_PERIOD"`
+	// 部屋の名前と建物・階の一覧をキャッシュしておく期間。デフォルトは5分。
+	RoomInfoTTL time.Duration `envconfig:"ROOM_INFO_TTL"`
+	// 存在しない部屋を参照するThingと投票を削除する間隔。センサーの更新間隔とは独立している。デフォルトは1時間。
+	IntegritySweepInterval time.Duration `envconfig:"INTEGRITY_SWEEP_INTERVAL"`
+	// 部屋の詳細の取得時に、refresh=trueでセンサーの状態を更新できる最短の間隔。デフォルトは5秒。
+	RoomRefreshInterval time.Duration `envconfig:"ROOM_REFRESH_INTERVAL"`
+	// DBの1つのクエリに掛けられる最大の時間。リクエスト全体の期限とは別に適用する。デフォルトは10秒。
+	DBQueryTimeout time.Duration `envconfig:"DB_QUERY_TIMEOUT"`
+	// trueの場合、ThingWorxに接続せずにセンサーの値を生成し、ランダムな投票を行う。デモと負荷試験用。
+	// 本番環境で誤って有効にしないように、THINGWORX_URLと同時には指定できない。
+	Simulate bool `envconfig:"SIMULATE"`
+	// シミュレーションで投票する間隔。デフォルトは2秒。
+	SimulateVoteInterval time.Duration `envconfig:"SIMULATE_VOTE_INTERVAL"`
+	// gzipで圧縮するレスポンスの最小サイズ(バイト)。0の場合は1024バイト。
+	GzipMinSize int `envconfig:"GZIP_MIN_SIZE"`
+}
+
+// CSRFトークンのレスポンス
+type csrfResponse struct {
+	Token string `json:"token"`
+}
+
+// 部屋の一覧のレスポンス。Totalはすべての部屋の数。
+type roomsPageResponse struct {
+	Rooms  []RoomInfo `json:"rooms"`
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+}
+
+// レディネスプローブのレスポンス。Checksには依存先毎に"ok"、"simulated"またはエラーメッセージが入る。
+type readyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+	// センサーの状態の更新が最後に成功した時刻(UNIX時間、秒単位)。一度も成功していない場合はnil。
+	LastRefresh *int64 `json:"lastRefresh"`
+}
+
+// DBとThingWorxへ到達できるかを確認するレディネスプローブのハンドラーを返す。
+// thingworxがnilの場合(シミュレーション)は、ThingWorxを"simulated"として確認しない。
+func readyHandler(db *sql.DB, thingworx *ThingWorxClient, rsm *RoomStatusManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), READY_CHECK_TIMEOUT)
+		defer cancel()
+
+		res := readyResponse{
+			Status: "ok",
+			Checks: map[string]string{},
+		}
+		check := func(name string, err error) {
+			if err != nil {
+				logRequestf(req, "WARN: readiness check %s failed: %s", name, err)
+				res.Status = "unavailable"
+				res.Checks[name] = err.Error()
+				return
+			}
+			res.Checks[name] = "ok"
+		}
+		check("db", db.PingContext(ctx))
+		if thingworx != nil {
+			check("thingworx", thingworx.Ping(ctx))
+		} else {
+			res.Checks["thingworx"] = "simulated"
+		}
+		if t := rsm.LastRefresh(); !t.IsZero() {
+			sec := t.Unix()
+			res.LastRefresh = &sec
+		}
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if res.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(200)
+		}
+		w.Write(js)
+	}
 }
 
 type StatusAPIResponse struct {
@@ -37,142 +232,1271 @@ type StatusAPIResponse struct {
 	MyVote *MyVote     `json:"myvote"`
 }
 
-func getRouter(opt RouterOption, db *sql.DB, ctx context.Context) *mux.Router {
-	if opt.StaticDir == "" {
-		opt.StaticDir = "."
-	}
-	if opt.TemplateDir == "" {
-		opt.TemplateDir = "."
-	}
-	staticHandler := http.FileServer(http.Dir(opt.StaticDir))
-	tmpl, err := template.ParseGlob(path.Join(opt.TemplateDir, "*.html"))
-	if err != nil {
-		panic(err)
-	}
+// 指定したレベル以上のログを、標準エラー出力にテキスト形式で出力するロガーを作成する。
+func newLogger(level string) *slog.Logger {
+	var lv slog.Level
+	if level != "" {
+		if err := lv.UnmarshalText([]byte(level)); err != nil {
+			log.Printf("WARN: invalid log level %q, fall back to info", level)
+			lv = slog.LevelInfo
+		}
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lv}))
+}
+
+func getRouter(opt RouterOption, db *sql.DB, ctx context.Context) (*mux.Router, *RoomStatusManager) {
+	if opt.StaticDir == "" {
+		opt.StaticDir = "."
+	}
+	if opt.TemplateDir == "" {
+		opt.TemplateDir = "."
+	}
+	staticHandler := http.FileServer(http.Dir(opt.StaticDir))
+	tmpl, err := template.ParseGlob(path.Join(opt.TemplateDir, "*.html"))
+	if err != nil {
+		panic(err)
+	}
+
+	sameSite, err := ParseSameSite(opt.CookieSameSite)
+	if err != nil {
+		log.Printf("WARN: %s, fall back to lax", err)
+	}
+	sessionCookie := SessionCookieConfig{
+		Insecure: opt.CookieInsecure,
+		SameSite: sameSite,
+		Path:     opt.CookiePath,
+		Domain:   opt.CookieDomain,
+	}
+
+	var appKeys map[ThingName]string
+	if len(opt.ThingWorxAppKeys) > 0 {
+		appKeys = make(map[ThingName]string, len(opt.ThingWorxAppKeys))
+		for name, key := range opt.ThingWorxAppKeys {
+			appKeys[ThingName(name)] = key
+		}
+	}
+	thingworx := &ThingWorxClient{
+		URL:                    opt.ThingWorxURL,
+		AppKey:                 opt.ThingWorxAppKey,
+		AppKeyInQuery:          opt.ThingWorxAppKeyInQuery,
+		AppKeys:                appKeys,
+		BatchService:           opt.ThingWorxBatchService,
+		BatchThreshold:         opt.ThingWorxBatchThreshold,
+		PropertiesPathTemplate: opt.ThingWorxPropertiesPath,
+		Mapping: PropertyMapping{
+			Temperature: opt.ThingWorxTemperatureProperty,
+			Humidity:    opt.ThingWorxHumidityProperty,
+			LastUpdated: opt.ThingWorxLastUpdatedProperty,
+			CO2:         opt.ThingWorxCO2Property,
+			Occupancy:   opt.ThingWorxOccupancyProperty,
+		},
+	}
+
+	var reader PropertyReader = thingworx
+	var simulatedVoteInterval time.Duration
+	if opt.Simulate {
+		log.Println("WARN: simulation mode is enabled, sensor values and votes are synthetic")
+		reader = NewSimulatedThingWorx(time.Now().UnixNano())
+		simulatedVoteInterval = opt.SimulateVoteInterval
+		if simulatedVoteInterval <= 0 {
+			simulatedVoteInterval = SIMULATED_VOTE_INTERVAL
+		}
+	}
+
+	var buildings []BuildingName
+	for _, b := range opt.Buildings {
+		if b = strings.TrimSpace(b); b != "" {
+			buildings = append(buildings, BuildingName(b))
+		}
+	}
+
+	rsm := NewRoomStatusManager(db, reader, RSMConfig{
+		RefreshInterval:        opt.SensorRefreshInterval,
+		MinRefreshGap:          opt.SensorMinRefreshGap,
+		CacheExpire:            opt.SensorCacheExpire,
+		StaleRetention:         opt.SensorStaleRetention,
+		ConnectedThreshold:     opt.SensorConnectedThreshold,
+		MaxConcurrentUpdates:   opt.SensorMaxConcurrentUpdates,
+		MaxSensorsPerRoom:      opt.SensorMaxPerRoom,
+		WarmCache:              opt.SensorWarmCache,
+		VoteTTL:                opt.VoteTTL,
+		VoteWindowSize:         opt.VoteWindowSize,
+		MinVoteInterval:        opt.MinVoteInterval,
+		VoteEventRetention:     opt.VoteEventRetention,
+		RecordHistory:          opt.SensorRecordHistory,
+		HistoryRetention:       opt.SensorHistoryRetention,
+		Logger:                 newLogger(opt.LogLevel),
+		Dialect:                DialectOf(opt.DBDriver),
+		QueryTimeout:           opt.DBQueryTimeout,
+		SessionTTL:             opt.SessionTTL,
+		SessionCookie:          sessionCookie,
+		RoomInfoTTL:            opt.RoomInfoTTL,
+		IntegritySweepInterval: opt.IntegritySweepInterval,
+		RoomRefreshInterval:    opt.RoomRefreshInterval,
+		CascadeRoomDelete:      opt.CascadeRoomDelete,
+		TemperatureRange:       DefaultTemperatureRange.Override(opt.SensorMinTemperature, opt.SensorMaxTemperature),
+		HumidityRange:          DefaultHumidityRange.Override(opt.SensorMinHumidity, opt.SensorMaxHumidity),
+		TemperatureSmoothing:   opt.SensorSmoothingAlpha,
+		Buildings:              buildings,
+		AlertWebhookURL:        opt.AlertWebhookURL,
+		AlertDuration:          opt.AlertDuration,
+		AlertMinVotes:          opt.AlertMinVotes,
+		SensorWebhookURL:       opt.SensorWebhookURL,
+		SensorAlertGracePeriod: opt.SensorAlertGracePeriod,
+		SimulatedVoteInterval:  simulatedVoteInterval,
+	}, ctx)
+
+	router := mux.NewRouter()
+	router.Use(accessLogRouteMiddleware)
+	router.Use(tracingMiddleware(nil))
+	router.Use(CSRFHandler)
+	router.HandleFunc("/api/v1/status", func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		var res StatusAPIResponse
+
+		// 変化がない場合に304を返せるように、保存は許可して毎回再検証させる
+		w.Header().Set("Cache-Control", "no-cache")
+
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+		// ThingWorxとの通信中にコネクションを占有しないように、トランザクションを開始する前に更新する
+		if refresh, _ := strconv.ParseBool(req.URL.Query().Get("refresh")); refresh {
+			// 更新に失敗した場合と間隔が短すぎる場合は、キャッシュされている状態を返す
+			if err := rsm.RefreshRoom(req.Context(), roomID); err != nil && err != ErrRefreshTooSoon {
+				logRequestf(req, "WARN: can not refresh room(%d): %s\n", roomID, err.Error())
+			}
+		}
+
+		tx, err := getReadTx(rsm, w, req)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+		if err := tx.TouchSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		res.Status, err = tx.GetStatus(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		res.MyVote, err = tx.GetMyVote(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		if checkETag(w, req, statusETag([]*RoomStatus{res.Status}, res.MyVote)) {
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/status", func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		var res StatusAPIResponse
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.GetTx(w, req, true)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+
+		if !parseForm(w, req) {
+			return
+		}
+		choice, err := ParseVoteChoice(req.FormValue("vote"))
+		if err != nil {
+			logRequestf(req, "WARN: vote parameter is invalid: vote=%q\n", req.FormValue("vote"))
+			writeError(w, req, http.StatusBadRequest, err)
+			return
+		}
+		// 再送された投票で投票時刻が更新されないように、クライアントが投票毎に生成したキーを受け取る
+		key := req.Header.Get(IDEMPOTENCY_KEY_HEADER)
+		if key != "" && !validIdempotencyKey(key) {
+			logRequestf(req, "WARN: %s header is invalid\n", IDEMPOTENCY_KEY_HEADER)
+			writeError(w, req, http.StatusBadRequest, errors.New(IDEMPOTENCY_KEY_HEADER+" header is invalid"))
+			return
+		}
+		res.Status, res.MyVote, err = tx.VoteAndStatus(req.Context(), roomID, choice, key)
+		if err == ErrVoteTooSoon {
+			logRequestf(req, "WARN: vote is rejected: room=%d, session=%d\n", roomID, tx.s.SessionID)
+			writeError(w, req, http.StatusTooManyRequests, err)
+			return
+		}
+		if err == ErrRoomNotFound {
+			logRequestf(req, "WARN: vote is rejected: room=%d is not found\n", roomID)
+			writeError(w, req, http.StatusNotFound, err)
+			return
+		}
+		if err == ErrNoSession {
+			logRequestf(req, "WARN: vote is rejected: room=%d, no session\n", roomID)
+			writeError(w, req, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := tx.TouchSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("POST")
+
+	router.HandleFunc("/api/v1/status", func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		var res StatusAPIResponse
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+
+		err = tx.Unvote(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.TouchSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		res.Status, err = tx.GetStatus(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		res.MyVote, err = tx.GetMyVote(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("DELETE")
+
+	router.HandleFunc("/api/v1/status/stream", func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, req, http.StatusInternalServerError, errors.New("streaming is not supported"))
+			return
+		}
+
+		var rooms []RoomID
+		for _, strRoomID := range req.URL.Query()["room"] {
+			roomID, err := StringToRoomID(strRoomID)
+			if err != nil {
+				logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+				writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+				return
+			}
+			rooms = append(rooms, roomID)
+		}
+		if len(rooms) == 0 {
+			writeError(w, req, http.StatusBadRequest, errors.New("room parameter is required"))
+			return
+		}
+
+		// 購読を開始してから現在の状態を送信することで、その間の変化を取りこぼさないようにする
+		events, unsubscribe := rsm.Subscribe(rooms...)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+
+		for _, roomID := range rooms {
+			if err := writeStatusEvent(req.Context(), w, rsm, roomID); err != nil {
+				logRequestf(req, "ERROR: %s", err)
+				return
+			}
+		}
+		flusher.Flush()
+
+		// 切断されたクライアントを検出するために、定期的にコメントを送信する
+		keepAlive := time.NewTicker(SSE_KEEP_ALIVE)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case roomID, ok := <-events:
+				if !ok {
+					// サーバーの停止
+					return
+				}
+				if err := writeStatusEvent(req.Context(), w, rsm, roomID); err != nil {
+					logRequestf(req, "ERROR: %s", err)
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/buildings/{building}/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		building := BuildingName(mux.Vars(req)["building"])
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		statuses, err := tx.GetBuildingStatus(req.Context(), building)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(statuses)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		if checkETag(w, req, statusETag(statuses, nil)) {
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+	// 建物の部屋の状態を階毎に集計する
+	router.HandleFunc("/api/v1/buildings/{building}/summary", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		building := BuildingName(mux.Vars(req)["building"])
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		summaries, err := tx.GetFloorSummary(req.Context(), building)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(summaries)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/buildings/{building}/floors/{floor}/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		vars := mux.Vars(req)
+		building := BuildingName(vars["building"])
+		floor, err := strconv.ParseInt(vars["floor"], 10, 64)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse floor(%s): %s\n", vars["floor"], err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("floor"))
+			return
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		statuses, err := tx.GetFloorStatus(req.Context(), building, FloorID(floor))
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(statuses)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		if checkETag(w, req, statusETag(statuses, nil)) {
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	// 投票などの状態を変更するリクエストに必要なCSRFトークンを返す。セッションがない場合は作成する。
+	// トークンはレスポンスのヘッダーとCookieにも含まれる。
+	router.HandleFunc("/api/v1/csrf", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.GetTx(w, req, true)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := tx.TouchSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		token := tx.CSRFToken()
+		js, err := json.Marshal(&csrfResponse{Token: token})
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set(CSRF_TOKEN_HEADER, token)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	// 読み込み時に一度だけ呼び出して、全ての部屋への投票内容を取得するためのAPI。
+	// 部屋IDをキーとしたオブジェクトを返す。
+	router.HandleFunc("/api/v1/myvotes", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		votes, err := tx.GetMyVotes(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(votes)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/rooms", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		// offsetとlimitは省略できる。limitの最大値はMAX_ROOMS_PAGE_LIMIT。
+		var offset, limit int
+		for _, p := range []struct {
+			name string
+			v    *int
+		}{{"offset", &offset}, {"limit", &limit}} {
+			str := req.URL.Query().Get(p.name)
+			if str == "" {
+				continue
+			}
+			n, err := strconv.Atoi(str)
+			if err != nil || n < 0 {
+				logRequestf(req, "WARN: can not parse %s(%s)\n", p.name, str)
+				writeError(w, req, http.StatusBadRequest, invalidParameter(p.name))
+				return
+			}
+			*p.v = n
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		offset, limit = normalizeRoomsPage(offset, limit)
+		rooms, total, err := tx.GetRoomsPage(req.Context(), offset, limit)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(&roomsPageResponse{
+			Rooms:  rooms,
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+		})
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/rooms/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		// dominantに指定した選択肢が最も多い部屋を返す。(ex: ?dominant=hot&includeNoVotes=true)
+		choice := VoteChoice(req.URL.Query().Get("dominant"))
+		if !choice.IsValid() {
+			logRequestf(req, "WARN: invalid dominant choice(%s)\n", choice)
+			writeError(w, req, http.StatusBadRequest, invalidParameter("dominant"))
+			return
+		}
+		includeNoVotes := false
+		if str := req.URL.Query().Get("includeNoVotes"); str != "" {
+			var err error
+			includeNoVotes, err = strconv.ParseBool(str)
+			if err != nil {
+				logRequestf(req, "WARN: can not parse includeNoVotes(%s): %s\n", str, err.Error())
+				writeError(w, req, http.StatusBadRequest, invalidParameter("includeNoVotes"))
+				return
+			}
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		statuses, err := tx.GetRoomsByDominantChoice(req.Context(), choice, includeNoVotes)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(statuses)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		if checkETag(w, req, statusETag(statuses, nil)) {
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/rooms/{room:[0-9]+}", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		strRoomID := mux.Vars(req)["room"]
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+
+		if refresh, _ := strconv.ParseBool(req.URL.Query().Get("refresh")); refresh {
+			// 更新に失敗した場合と間隔が短すぎる場合は、キャッシュされている状態を返す
+			if err := rsm.RefreshRoom(req.Context(), roomID); err != nil && err != ErrRefreshTooSoon {
+				logRequestf(req, "WARN: can not refresh room(%d): %s\n", roomID, err.Error())
+			}
+		}
+
+		tx, err := getReadTx(rsm, w, req)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := tx.TouchSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		detail, err := tx.GetRoomDetail(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(detail)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		setLastRefreshHeader(w, rsm)
+		if checkETag(w, req, statusETag([]*RoomStatus{detail.Status}, detail.MyVote, detail.Name, strconv.FormatUint(detail.TotalVoters, 10))) {
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/export/status.csv", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		filename := "temvote-status-" + time.Now().Format("20060102-150405") + ".csv"
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		w.WriteHeader(200)
+		if err := tx.WriteStatusCSV(req.Context(), w); err != nil {
+			// ヘッダーは送信済みのため、ステータスコードは変更できない
+			logRequestf(req, "ERROR: %s", err)
+		}
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/history", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+		// sinceはUNIX時間(秒単位)。省略した場合は直近24時間分を返す。
+		since := time.Now().Add(-24 * time.Hour)
+		if strSince := req.URL.Query().Get("since"); strSince != "" {
+			sec, err := strconv.ParseInt(strSince, 10, 64)
+			if err != nil {
+				logRequestf(req, "WARN: can not parse since(%s): %s\n", strSince, err.Error())
+				writeError(w, req, http.StatusBadRequest, invalidParameter("since"))
+				return
+			}
+			since = time.Unix(sec, 0)
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		readings, err := tx.GetSensorHistory(req.Context(), roomID, since)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(readings)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/timeline", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+		// fromとtoはUNIX時間(秒単位)、bucketは秒単位。省略した場合は直近24時間分を1時間毎に返す。
+		params := map[string]int64{
+			"to":     time.Now().Unix(),
+			"bucket": int64(time.Hour / time.Second),
+		}
+		params["from"] = params["to"] - 24*60*60
+		for _, name := range []string{"from", "to", "bucket"} {
+			str := req.URL.Query().Get(name)
+			if str == "" {
+				continue
+			}
+			v, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				logRequestf(req, "WARN: can not parse %s(%s): %s\n", name, str, err.Error())
+				writeError(w, req, http.StatusBadRequest, invalidParameter(name))
+				return
+			}
+			params[name] = v
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		buckets, err := tx.GetVoteTimeline(req.Context(), roomID,
+			time.Unix(params["from"], 0), time.Unix(params["to"], 0),
+			time.Duration(params["bucket"])*time.Second)
+		if err == ErrInvalidTimeline {
+			logRequestf(req, "WARN: timeline parameters are invalid: from=%d, to=%d, bucket=%d\n",
+				params["from"], params["to"], params["bucket"])
+			writeError(w, req, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(buckets)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+
+	router.HandleFunc("/api/v1/ws", func(w http.ResponseWriter, req *http.Request) {
+		serveRoomWebSocket(rsm, w, req)
+	}).Methods("GET")
+
+	// 管理者用API。投票やステータスのAPIとは異なり、すべて認証が必要。
+	admin := router.PathPrefix(ADMIN_API_PREFIX).Subrouter()
+	admin.Use(AdminAuthConfig{
+		Token:    opt.AdminToken,
+		User:     opt.AdminUser,
+		Password: opt.AdminPassword,
+	}.Handler)
+
+	admin.HandleFunc("/property", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
+			return
+		}
+		thingName := ThingName(req.FormValue("thing"))
+		property := req.FormValue("property")
+		if thingName == "" || property == "" {
+			writeError(w, req, http.StatusBadRequest, errors.New("thing and property parameters are required"))
+			return
+		}
+		// 数値として解釈できる場合は数値として書き込む
+		var value interface{} = req.FormValue("value")
+		if f, err := strconv.ParseFloat(req.FormValue("value"), 64); err == nil {
+			value = f
+		}
+
+		if err := thingworx.SetProperty(req.Context(), thingName, property, value); err != nil {
+			var twErr *ThingWorxError
+			if errors.As(err, &twErr) {
+				writeError(w, req, http.StatusBadGateway, err)
+				return
+			}
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
 
-	thingworx := &ThingWorxClient{
-		URL:    opt.ThingWorxURL,
-		AppKey: opt.ThingWorxAppKey,
-	}
+	admin.HandleFunc("/votes", func(w http.ResponseWriter, req *http.Request) {
+		strRoomID := req.URL.Query().Get("room")
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
 
-	rsm := NewRoomStatusManager(db, thingworx, ctx)
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
 
-	router := mux.NewRouter()
-	router.HandleFunc("/api/v1/status", func(w http.ResponseWriter, req *http.Request) {
-		var err error
-		var res StatusAPIResponse
+		cleared, err := tx.ResetVotes(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		logRequestf(req, "reset %d votes of room %d\n", cleared, roomID)
 
+		js, err := json.Marshal(&struct {
+			RoomID  RoomID `json:"roomId"`
+			Cleared int64  `json:"cleared"`
+		}{
+			RoomID:  roomID,
+			Cleared: cleared,
+		})
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
 		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("DELETE")
+
+	// 部屋を作成する
+	admin.HandleFunc("/rooms", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
+			return
+		}
+		roomID, err := StringToRoomID(req.FormValue("id"))
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, invalidParameter("id"))
+			return
+		}
+		floor, err := strconv.ParseInt(req.FormValue("floor"), 10, 64)
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, invalidParameter("floor"))
+			return
+		}
 
 		tx, err := rsm.GetTx(w, req, false)
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 		defer tx.Rollback()
 
-		strRoomID := req.URL.Query().Get("room")
-		roomID, err := StringToRoomID(strRoomID)
+		err = tx.CreateRoom(req.Context(), roomID, req.FormValue("name"), BuildingName(req.FormValue("building")), FloorID(floor))
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
+
+	// CSVから部屋とThingを一括で取り込む
+	// ファイルはmultipart/form-dataの"file"フィールドか、リクエストボディで送信する。
+	// strict=trueの場合、1行でも失敗すればすべての行を取り込まない。
+	admin.HandleFunc("/rooms/import", func(w http.ResponseWriter, req *http.Request) {
+		strict := req.URL.Query().Get("strict") == "true"
+
+		req.Body = http.MaxBytesReader(w, req.Body, MAX_IMPORT_SIZE)
+		var body io.Reader = req.Body
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				writeError(w, req, http.StatusBadRequest, invalidParameter("file"))
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+
+		tx, err := rsm.GetTx(w, req, false)
 		if err != nil {
-			log.Printf("WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
-			http.Error(w, "room parameter is invalid", http.StatusBadRequest)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
-		res.Status, err = tx.GetStatus(roomID)
+		defer tx.Rollback()
+
+		summary, err := tx.ImportRoomsCSV(req.Context(), body)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case err == ErrInvalidImport:
+			writeError(w, req, http.StatusBadRequest, err)
+			return
+		case errors.As(err, &maxBytesErr):
+			writeError(w, req, http.StatusRequestEntityTooLarge, errors.New("csv is too large"))
+			return
+		case err != nil:
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		status := http.StatusOK
+		if strict && summary.Failed > 0 {
+			// ロールバックするため、作成・更新した行はない
+			status = http.StatusUnprocessableEntity
+			summary.Created = 0
+			summary.Updated = 0
+			for i := range summary.Rows {
+				if summary.Rows[i].Result != "failed" {
+					summary.Rows[i].Result = "skipped"
+				}
+			}
+		} else if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+
+		js, err := json.Marshal(summary)
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(js)
+	}).Methods("POST")
+
+	// 部屋の名前を変更する
+	admin.HandleFunc("/rooms/{room}", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
 			return
 		}
-		res.MyVote, err = tx.GetMyVote(roomID)
+		roomID, err := StringToRoomID(mux.Vars(req)["room"])
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
 			return
 		}
 
-		js, err := json.Marshal(res)
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.RenameRoom(req.Context(), roomID, req.FormValue("name"))
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	// 部屋の目標気温を設定する。minとmaxは省略するか空にすると、その側の目標を設定しない。
+	admin.HandleFunc("/rooms/{room}/target", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
+			return
+		}
+		roomID, err := StringToRoomID(mux.Vars(req)["room"])
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+		var target [2]*float64
+		for i, name := range []string{"min", "max"} {
+			value := req.FormValue(name)
+			if value == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				writeError(w, req, http.StatusBadRequest, invalidParameter(name))
+				return
+			}
+			target[i] = &v
+		}
+
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.SetRoomTarget(req.Context(), roomID, target[0], target[1])
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	// 部屋を削除する
+	admin.HandleFunc("/rooms/{room}", func(w http.ResponseWriter, req *http.Request) {
+		roomID, err := StringToRoomID(mux.Vars(req)["room"])
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
+
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.DeleteRoom(req.Context(), roomID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// 登録されたすべてのThingと、その接続状態を返す
+	admin.HandleFunc("/things", func(w http.ResponseWriter, req *http.Request) {
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		things, err := tx.ListThings(req.Context())
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 
+		js, err := json.Marshal(things)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		w.Write(js)
 	}).Methods("GET")
-	router.HandleFunc("/api/v1/status", func(w http.ResponseWriter, req *http.Request) {
-		var err error
-		var res StatusAPIResponse
 
-		w.Header().Set("Cache-Control", "no-store")
+	// 部屋にThingを追加する
+	admin.HandleFunc("/things", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
+			return
+		}
+		roomID, err := StringToRoomID(req.FormValue("room"))
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return
+		}
 
-		tx, err := rsm.GetTx(w, req, true)
+		tx, err := rsm.GetTx(w, req, false)
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 		defer tx.Rollback()
 
-		strRoomID := req.URL.Query().Get("room")
-		roomID, err := StringToRoomID(strRoomID)
+		thingName := ThingName(req.FormValue("thing"))
+		err = tx.AttachThing(req.Context(), roomID, thingName)
+		if err == nil && req.FormValue("label") != "" {
+			err = tx.SetThingLabel(req.Context(), roomID, thingName, req.FormValue("label"))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
 		if err != nil {
-			log.Printf("WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
-			http.Error(w, "room parameter is invalid", http.StatusBadRequest)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
 
-		choice := VoteChoice(req.FormValue("vote"))
-		switch choice {
-		case Hot:
-		case Comfort:
-		case Cold:
-		default:
-			log.Printf("WARN: vote parameter is invalid: vote=%d\n", choice)
-			http.Error(w, "vote parameter is invalid", http.StatusBadRequest)
+	// 部屋に追加されたThingの表示名を設定する。labelを空にすると表示名を削除する。
+	admin.HandleFunc("/rooms/{room}/things/{thing}", func(w http.ResponseWriter, req *http.Request) {
+		if !parseForm(w, req) {
 			return
 		}
-		err = tx.Vote(roomID, choice)
+
+		roomID, err := StringToRoomID(mux.Vars(req)["room"])
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
 			return
 		}
 
-		res.Status, err = tx.GetStatus(roomID)
+		tx, err := rsm.GetTx(w, req, false)
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
-		res.MyVote, err = tx.GetMyVote(roomID)
+		defer tx.Rollback()
+
+		err = tx.SetThingLabel(req.Context(), roomID, ThingName(mux.Vars(req)["thing"]), req.FormValue("label"))
+		if err == nil {
+			err = tx.Commit()
+		}
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
 
-		js, err := json.Marshal(res)
+	// Thingをすべての部屋から削除する
+	admin.HandleFunc("/things/{thing}", func(w http.ResponseWriter, req *http.Request) {
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		err = tx.DetachThing(req.Context(), ThingName(mux.Vars(req)["thing"]))
+		if err == nil {
+			err = tx.Commit()
+		}
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	admin.HandleFunc("/cache", func(w http.ResponseWriter, req *http.Request) {
+		type cacheEntry struct {
+			SensorStatus
+			Expire     time.Time `json:"expire"`
+			StaleUntil time.Time `json:"staleUntil"`
+		}
+		res := map[RoomID]map[ThingName]cacheEntry{}
+		for id, cache := range rsm.CacheSnapshot() {
+			res[id] = map[ThingName]cacheEntry{}
+			for name, stat := range cache {
+				res[id][name] = cacheEntry{
+					SensorStatus: stat,
+					Expire:       stat.Expire(),
+					StaleUntil:   stat.StaleUntil(),
+				}
+			}
+		}
 
-		tx.s.ExtendExpiration()
-		tx.Commit()
+		js, err := json.Marshal(res)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
 		w.WriteHeader(200)
 		w.Write(js)
+	}).Methods("GET")
+
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// プロセスが動作していることだけを確認するライブネスプローブ
+	router.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(200)
+		w.Write([]byte(`{"status":"ok"}`))
+	}).Methods("GET")
+
+	// シミュレーションの場合はThingWorxに接続しないため、レディネスプローブでThingWorxを確認しない
+	pinged := thingworx
+	if opt.Simulate {
+		pinged = nil
+	}
+	router.HandleFunc("/ready", readyHandler(db, pinged, rsm)).Methods("GET")
+
+	// セッションを削除する。共用の端末で、前の利用者の投票が引き継がれないようにするために使う。
+	router.HandleFunc("/logout", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		tx, err := rsm.GetTx(w, req, false)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := tx.DeleteSession(req.Context()); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, req, "/select_room.html", http.StatusSeeOther)
 	}).Methods("POST")
 
 	router.Handle("/", http.RedirectHandler("/select_room.html", 303)).Methods("GET")
 	router.HandleFunc("/vote/{roomid}", func(w http.ResponseWriter, req *http.Request) {
-		tx, err := rsm.GetTx(w, req, false)
+		tx, err := rsm.PeekTx(req.Context())
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 		defer tx.Rollback()
@@ -181,15 +1505,14 @@ func getRouter(opt RouterOption, db *sql.DB, ctx context.Context) *mux.Router {
 		strRoomID := vars["roomid"]
 		roomID, err := StringToRoomID(strRoomID)
 		if err != nil {
-			log.Printf("WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
-			http.Error(w, "roomid parameter is invalid", http.StatusBadRequest)
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("roomid"))
 			return
 		}
 
-		roomName, err := tx.GetRoomName(roomID)
+		roomName, err := tx.GetRoomName(req.Context(), roomID)
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 
@@ -202,19 +1525,87 @@ func getRouter(opt RouterOption, db *sql.DB, ctx context.Context) *mux.Router {
 		})
 
 	}).Methods("GET")
+	// 部屋の存在を確認し、投票画面のURLを返す。部屋が存在しない場合はエラーレスポンスを書き込み、falseを返す。
+	roomLink := func(w http.ResponseWriter, req *http.Request) (RoomID, string, bool) {
+		strRoomID := mux.Vars(req)["room"]
+		roomID, err := StringToRoomID(strRoomID)
+		if err != nil {
+			logRequestf(req, "WARN: can not parse RoomID(%s): %s\n", strRoomID, err.Error())
+			writeError(w, req, http.StatusBadRequest, invalidParameter("room"))
+			return 0, "", false
+		}
+
+		tx, err := rsm.PeekTx(req.Context())
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return 0, "", false
+		}
+		defer tx.Rollback()
+		exists, err := tx.roomExists(req.Context(), roomID)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return 0, "", false
+		}
+		if !exists {
+			writeError(w, req, http.StatusNotFound, ErrRoomNotFound)
+			return 0, "", false
+		}
+		return roomID, roomVoteURL(opt.PublicBaseURL, req, roomID), true
+	}
+	router.HandleFunc("/api/v1/rooms/{room:[0-9]+}/link", func(w http.ResponseWriter, req *http.Request) {
+		roomID, voteURL, ok := roomLink(w, req)
+		if !ok {
+			return
+		}
+		js, err := json.Marshal(roomLinkResponse{RoomID: roomID, URL: voteURL})
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(js)
+	}).Methods("GET")
+	router.HandleFunc("/rooms/{room:[0-9]+}/qr", func(w http.ResponseWriter, req *http.Request) {
+		if opt.PublicBaseURL == "" {
+			writeError(w, req, http.StatusServiceUnavailable, ErrNoPublicBaseURL)
+			return
+		}
+		size := QR_CODE_SIZE
+		if s := req.URL.Query().Get("size"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > MAX_QR_CODE_SIZE {
+				writeError(w, req, http.StatusBadRequest, invalidParameter("size"))
+				return
+			}
+			size = n
+		}
+		_, voteURL, ok := roomLink(w, req)
+		if !ok {
+			return
+		}
+		png, err := roomQRCode(voteURL, size)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		// 部屋IDのみから決まるURLのため、変わることはほとんどない
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.WriteHeader(200)
+		w.Write(png)
+	}).Methods("GET")
 	router.HandleFunc("/select_room.html", func(w http.ResponseWriter, req *http.Request) {
-		tx, err := rsm.GetTx(w, req, false)
+		tx, err := rsm.PeekTx(req.Context())
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 		defer tx.Rollback()
 
-		names, groups, err := tx.GetAllRoomsInfo()
+		names, groups, err := tx.GetAllRoomsInfo(req.Context())
 		if err != nil {
-			log.Println("ERROR:", err)
-			http.Error(w, ServerErrorMsg, http.StatusInternalServerError)
+			writeError(w, req, http.StatusInternalServerError, err)
 			return
 		}
 
@@ -228,39 +1619,113 @@ func getRouter(opt RouterOption, db *sql.DB, ctx context.Context) *mux.Router {
 	}).Methods("GET")
 	router.Handle("/{name:.*}", staticHandler).Methods("GET")
 
-	return router
+	return router, rsm
+}
+
+// 部屋の状態を、Server-Sent Eventsのstatusイベントとして書き込む。
+func writeStatusEvent(ctx context.Context, w io.Writer, rsm *RoomStatusManager, id RoomID) error {
+	status, err := rsm.GetStatus(ctx, id)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", js)
+	return err
+}
+
+// 状態を取得するためのトランザクションを開始する。
+// peek=trueが指定された場合は、表示専用の端末向けにセッションを使用せずに読み取る。この場合、自分の投票は返さない。
+func getReadTx(rsm *RoomStatusManager, w http.ResponseWriter, req *http.Request) (*RoomStatusTx, error) {
+	if peek, _ := strconv.ParseBool(req.URL.Query().Get("peek")); peek {
+		return rsm.PeekTx(req.Context())
+	}
+	return rsm.GetTx(w, req, false)
+}
+
+// センサーの状態の更新が最後に成功した時刻を、レスポンスのヘッダーに付与する。
+// 一度も成功していない場合は付与しない。
+func setLastRefreshHeader(w http.ResponseWriter, rsm *RoomStatusManager) {
+	if t := rsm.LastRefresh(); !t.IsZero() {
+		w.Header().Set(LAST_REFRESH_HEADER, strconv.FormatInt(t.Unix(), 10))
+	}
+}
+
+// リクエストのボディをMAX_REQUEST_BODY_SIZEに制限して、フォームを解析する。
+// 解析できない場合はエラーのレスポンスを返し、falseを返す。
+func parseForm(w http.ResponseWriter, req *http.Request) bool {
+	req.Body = http.MaxBytesReader(w, req.Body, MAX_REQUEST_BODY_SIZE)
+	err := req.ParseForm()
+	if err == nil && strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		err = req.ParseMultipartForm(MAX_REQUEST_BODY_SIZE)
+	}
+	if err == nil {
+		return true
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		logRequestf(req, "WARN: request body is too large: %s %s\n", req.Method, req.URL.Path)
+		writeError(w, req, http.StatusRequestEntityTooLarge, errors.New("request body is too large"))
+		return false
+	}
+	logRequestf(req, "WARN: can not parse form: %s\n", err.Error())
+	writeError(w, req, http.StatusBadRequest, errors.New("form is invalid"))
+	return false
 }
 
-func startHttpServer(ctx context.Context, router *mux.Router) (err error) {
-	srv := http.Server{
+// HTTPサーバーを起動し、ctxがキャンセルされるまでリクエストを受け付ける。
+// 停止時は新しい接続の受付を止め、処理中のリクエストが完了するまでSHUTDOWN_TIMEOUTを上限に待つ。
+// SSEとWebSocketの接続は、rsmの購読を終了させて切断する。
+func startHttpServer(ctx context.Context, handler http.Handler, rsm *RoomStatusManager) error {
+	srv := &http.Server{
 		Addr:    "0.0.0.0:8080",
-		Handler: router,
+		Handler: handler,
 	}
+	serveErr := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		srv.Shutdown(ctx)
+		log.Println("start server")
+		serveErr <- srv.ListenAndServe()
 	}()
-	log.Println("start server")
-	srv.ListenAndServe()
-	return
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	// Shutdownは長時間の接続の終了を待たないため、購読の終了と並行して処理中のリクエストを待つ
+	streamsErr := make(chan error, 1)
+	go func() {
+		streamsErr <- rsm.CloseSubscriptions(shutdownCtx)
+	}()
+	err := srv.Shutdown(shutdownCtx)
+	if err2 := <-streamsErr; err == nil {
+		err = err2
+	}
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	log.Println("server stopped")
+	return nil
 }
 
 func main() {
 	// set up logger
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
-	go func() {
-		<-sig
-		log.Println("signal handled")
-		cancel()
-	}()
-
-	var opt RouterOption
-	envconfig.Process("TEMVOTE", &opt)
+	opt, err := LoadConfigFromEnv()
+	if err != nil {
+		log.Fatalln("ERROR:", err)
+	}
 
 	var requireInitDB bool
 	if opt.DBDriver == "sqlite3" {
@@ -289,8 +1754,22 @@ func main() {
 		log.Println("Initializing database ... done")
 	}
 
-	router := getRouter(opt, db, ctx)
-	if err := startHttpServer(ctx, router); err != nil {
-		panic(err)
+	// センサーの状態の更新処理は、HTTPサーバーの停止後にrsm.Closeで停止する
+	router, rsm := getRouter(opt, db, context.Background())
+	// DBを閉じる前に、センサーの状態の更新処理を停止する
+	defer rsm.Close()
+	var accessLogger *slog.Logger
+	if opt.AccessLog {
+		accessLogger = rsm.config.Logger
+	}
+	cors := CORSConfig{
+		AllowedOrigins:   opt.CORSAllowedOrigins,
+		AllowedMethods:   opt.CORSAllowedMethods,
+		AllowedHeaders:   opt.CORSAllowedHeaders,
+		AllowCredentials: opt.CORSAllowCredentials,
+	}
+	handler := RequestIDHandler(AccessLogHandler(cors.Handler(GzipHandler(router, opt.GzipMinSize)), accessLogger))
+	if err := startHttpServer(ctx, handler, rsm); err != nil {
+		log.Println("ERROR:", err)
 	}
 }
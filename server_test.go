@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseVoteChoice(t *testing.T) {
+	for _, s := range []string{"very_hot", "hot", "comfort", "cold", "very_cold"} {
+		if c, err := ParseVoteChoice(s); err != nil || string(c) != s {
+			t.Errorf("should accept %q, but result is %q, %v", s, c, err)
+		}
+	}
+	for _, s := range []string{"", "HOT", "warm", "hot "} {
+		if _, err := ParseVoteChoice(s); err != ErrInvalidVoteChoice {
+			t.Errorf("should reject %q, but result is %v", s, err)
+		}
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/v1/status?room=1", strings.NewReader(url.Values{"vote": {"hot"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	if !parseForm(w, req) {
+		t.Fatalf("should parse the form, but status is %d", w.Code)
+	}
+	if req.FormValue("vote") != "hot" || req.FormValue("room") != "1" {
+		t.Errorf("should read both body and query values, but form is %v", req.Form)
+	}
+
+	body := "vote=" + strings.Repeat("a", MAX_REQUEST_BODY_SIZE)
+	req = httptest.NewRequest("POST", "/api/v1/status?room=1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	if parseForm(w, req) {
+		t.Fatal("should reject a body larger than MAX_REQUEST_BODY_SIZE")
+	}
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("should respond with 413, but status is %d", w.Code)
+	}
+}
@@ -2,21 +2,75 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	SESSION_ID_COOKIE     = "temvote_session_id"
 	SESSION_SECRET_COOKIE = "temvote_session_secret"
-	COOKIE_MAX_AGE        = 600 // means 10 minutes
+	// セッションの有効期間のデフォルト値。Cookieの有効期間も同じ値になる。
+	SESSION_TTL = 10 * time.Minute
+	// セッションのCookieのPath属性のデフォルト値
+	SESSION_COOKIE_PATH = "/"
 )
 
+// セッションのCookieの属性。ゼロ値の場合は、Secure、HttpOnly、SameSite=Lax、Path=/のCookieになる。
+type SessionCookieConfig struct {
+	// trueの場合はSecure属性を付与しない。HTTPでローカルで開発する場合に使用する。
+	Insecure bool
+	// SameSite属性。未指定(0)かhttp.SameSiteDefaultModeの場合はLaxになる。
+	SameSite http.SameSite
+	// Path属性。空の場合はSESSION_COOKIE_PATH。
+	Path string
+	// Domain属性。空の場合は付与せず、リクエストしたホストにのみ送信させる。
+	Domain string
+}
+
+// 設定した属性のCookieを作成する。HttpOnly属性は常に付与する。
+func (c SessionCookieConfig) cookie(name, value string, maxAge int) *http.Cookie {
+	path := c.Path
+	if path == "" {
+		path = SESSION_COOKIE_PATH
+	}
+	sameSite := c.SameSite
+	if sameSite == 0 || sameSite == http.SameSiteDefaultMode {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		Secure:   !c.Insecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// "lax"、"strict"、"none"をSameSite属性の値に変換する。空の場合はhttp.SameSiteDefaultModeを返す。
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("unknown SameSite mode %q", s)
+}
+
 type SessionID uint64
 
 type Session struct {
@@ -24,12 +78,16 @@ type Session struct {
 
 	req    *http.Request
 	w      http.ResponseWriter
-	tx     *sql.Tx
+	tx     *dbTx
 	writen bool
 	secret string
+	// セッションの有効期間。有効期限の延長時とCookieの書き込み時に使用する。
+	ttl time.Duration
+	// 書き込むCookieの属性
+	cookie SessionCookieConfig
 }
 
-func GetSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) *Session {
+func GetSession(w http.ResponseWriter, req *http.Request, tx *dbTx, ttl time.Duration, cookieConfig SessionCookieConfig) *Session {
 	cookie, err := req.Cookie(SESSION_ID_COOKIE)
 	if err != nil {
 		return nil
@@ -39,7 +97,7 @@ func GetSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) *Session {
 		return nil
 	}
 
-	row := tx.QueryRow(`
+	row := tx.QueryRowContext(req.Context(), `
 		SELECT secret_sha256 FROM session
 		WHERE session_id=? AND expire>=?
 	`, id, time.Now())
@@ -73,10 +131,12 @@ func GetSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) *Session {
 		tx:        tx,
 		writen:    true,
 		secret:    secret,
+		ttl:       ttl,
+		cookie:    cookieConfig,
 	}
 }
 
-func NewSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) (*Session, error) {
+func NewSession(w http.ResponseWriter, req *http.Request, tx *dbTx, ttl time.Duration, cookieConfig SessionCookieConfig) (*Session, error) {
 	// generate secret
 	randomData := make([]byte, 32)
 	if _, err := rand.Read(randomData); err != nil {
@@ -85,23 +145,18 @@ func NewSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) (*Session,
 	secret := hex.EncodeToString(randomData)
 	secretSHA256 := sha256.Sum256([]byte(randomData))
 
-	res, err := tx.Exec(`
+	sid, err := tx.InsertID(req.Context(), "session_id", `
 		INSERT INTO session(
 			secret_sha256,
 			expire
 		) VALUES (?, ?)`,
 		hex.EncodeToString(secretSHA256[:]),
-		time.Now().Add(COOKIE_MAX_AGE*time.Second),
+		time.Now().Add(ttl),
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	sid, err := res.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
 	return &Session{
 		SessionID: uint64(sid),
 		req:       req,
@@ -109,16 +164,39 @@ func NewSession(w http.ResponseWriter, req *http.Request, tx *sql.Tx) (*Session,
 		tx:        tx,
 		writen:    false,
 		secret:    secret,
+		ttl:       ttl,
+		cookie:    cookieConfig,
 	}, nil
 }
 
+// セッションIDから、有効期限内のセッションを取得する。
+// Cookieを使用しない接続(WebSocketなど)で、ハンドシェイク時に確認済みのセッションを再取得するために使う。
+// 取得したセッションはCookieを書き込まない。
+func GetSessionByID(ctx context.Context, tx *dbTx, id uint64, ttl time.Duration) *Session {
+	var tmp string
+	if err := tx.QueryRowContext(ctx, `
+		SELECT secret_sha256 FROM session
+		WHERE session_id=? AND expire>=?
+	`, id, time.Now()).Scan(&tmp); err != nil {
+		return nil
+	}
+	return &Session{
+		SessionID: id,
+		tx:        tx,
+		writen:    true,
+		ttl:       ttl,
+	}
+}
+
 // 既存のCookieの有効期限を延長する
-func (s *Session) ExtendExpiration() error {
-	s.Save()
+func (s *Session) ExtendExpiration(ctx context.Context) error {
+	if s.w != nil {
+		s.Save()
+	}
 
-	if _, err := s.tx.Exec(`
+	if _, err := s.tx.ExecContext(ctx, `
 		UPDATE session SET expire=? WHERE session_id=?`,
-		time.Now().Add(COOKIE_MAX_AGE*time.Second),
+		time.Now().Add(s.ttl),
 		s.SessionID,
 	); err != nil {
 		return err
@@ -127,18 +205,33 @@ func (s *Session) ExtendExpiration() error {
 }
 
 func (s *Session) Save() {
-	// TODO: add secure attribute
-	http.SetCookie(s.w, &http.Cookie{
-		Name:     SESSION_ID_COOKIE,
-		Value:    strconv.FormatUint(s.SessionID, 10),
-		MaxAge:   COOKIE_MAX_AGE,
-		HttpOnly: true,
-	})
-	http.SetCookie(s.w, &http.Cookie{
-		Name:     SESSION_SECRET_COOKIE,
-		Value:    s.secret,
-		MaxAge:   COOKIE_MAX_AGE,
-		HttpOnly: true,
-	})
+	maxAge := int(s.ttl / time.Second)
+	http.SetCookie(s.w, s.cookie.cookie(SESSION_ID_COOKIE, strconv.FormatUint(s.SessionID, 10), maxAge))
+	http.SetCookie(s.w, s.cookie.cookie(SESSION_SECRET_COOKIE, s.secret, maxAge))
+	csrf := s.cookie.cookie(CSRF_TOKEN_COOKIE, s.CSRFToken(), maxAge)
+	// ダブルサブミットのため、JavaScriptから読み出してヘッダーに設定させる
+	csrf.HttpOnly = false
+	http.SetCookie(s.w, csrf)
 	s.writen = true
 }
+
+// セッションに紐付いたCSRFトークンを返す。秘密情報を持たないセッション(GetSessionByID)の場合は空文字列を返す。
+func (s *Session) CSRFToken() string {
+	if s.secret == "" {
+		return ""
+	}
+	return csrfToken(s.secret)
+}
+
+// セッションのCookieを削除する。Cookieを使用しないセッションの場合は何もしない。
+// 削除するCookieと同じPath属性とDomain属性で上書きする必要がある。
+func (s *Session) Clear() {
+	if s.w == nil {
+		return
+	}
+	http.SetCookie(s.w, s.cookie.cookie(SESSION_ID_COOKIE, "", -1))
+	http.SetCookie(s.w, s.cookie.cookie(SESSION_SECRET_COOKIE, "", -1))
+	csrf := s.cookie.cookie(CSRF_TOKEN_COOKIE, "", -1)
+	csrf.HttpOnly = false
+	http.SetCookie(s.w, csrf)
+}
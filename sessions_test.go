@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewSessionTTL(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	tx, err := rsm.begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ttl := 2 * time.Hour
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	s, err := NewSession(w, req, tx, ttl, SessionCookieConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expire time.Time
+	if err := tx.QueryRow(`SELECT expire FROM session WHERE session_id=?`, s.SessionID).Scan(&expire); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expire); d < ttl-time.Minute || d > ttl {
+		t.Errorf("session should expire after %s, but expires after %s", ttl, d)
+	}
+
+	s.Save()
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge != int(ttl/time.Second) {
+			t.Errorf("cookie %s should have MaxAge %d, but result is %d", c.Name, int(ttl/time.Second), c.MaxAge)
+		}
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	tx, err := rsm.begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// デフォルトはSecure、HttpOnly(CSRFトークン以外)、SameSite=Lax、Path=/
+	w := httptest.NewRecorder()
+	s, err := NewSession(w, httptest.NewRequest("GET", "/api/v1/status", nil), tx, SESSION_TTL, SessionCookieConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Save()
+	for _, c := range w.Result().Cookies() {
+		if !c.Secure || c.HttpOnly != (c.Name != CSRF_TOKEN_COOKIE) || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.Domain != "" {
+			t.Errorf("cookie %s should have default attributes, but result is %+v", c.Name, c)
+		}
+	}
+
+	config := SessionCookieConfig{
+		Insecure: true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/temvote",
+		Domain:   "example.com",
+	}
+	w = httptest.NewRecorder()
+	s, err = NewSession(w, httptest.NewRequest("GET", "/api/v1/status", nil), tx, SESSION_TTL, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Save()
+	s.Clear()
+	cookies := w.Result().Cookies()
+	if len(cookies) != 6 {
+		t.Fatalf("should write 6 cookies, but wrote %d cookies", len(cookies))
+	}
+	for _, c := range cookies {
+		if c.Secure || c.HttpOnly != (c.Name != CSRF_TOKEN_COOKIE) || c.SameSite != http.SameSiteStrictMode || c.Path != "/temvote" || c.Domain != "example.com" {
+			t.Errorf("cookie %s should have configured attributes, but result is %+v", c.Name, c)
+		}
+	}
+}
+
+func TestParseSameSite(t *testing.T) {
+	for s, want := range map[string]http.SameSite{
+		"":       http.SameSiteDefaultMode,
+		"lax":    http.SameSiteLaxMode,
+		"Strict": http.SameSiteStrictMode,
+		"none":   http.SameSiteNoneMode,
+	} {
+		got, err := ParseSameSite(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSameSite(%q) should return %v, but result is %v, %v", s, want, got, err)
+		}
+	}
+	if _, err := ParseSameSite("unknown"); err == nil {
+		t.Error("should return an error for an unknown mode")
+	}
+}
+
+// 表示専用の端末からの読み取りでは、セッションを作成せず、Cookieも書き込まない
+func TestPeekTx(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// 有効なセッションのCookieを持つリクエストでも、peek=trueの場合はセッションを使用しない
+	tx, err := rsm.GetTx(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tx.s.w = w
+	tx.s.Save()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/status?room=1&peek=true", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	w = httptest.NewRecorder()
+	rst, err := getReadTx(rsm, w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rst.Rollback()
+	if rst.s != nil {
+		t.Fatal("should not use the session in peek mode")
+	}
+
+	if err := rst.TouchSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, err := rst.GetStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RoomID != 1 {
+		t.Errorf("should return the status of room 1, but result is %+v", status)
+	}
+	if vote, err := rst.GetMyVote(ctx, 1); err != nil || vote != nil {
+		t.Errorf("should return no vote without the session, but result is %+v, %v", vote, err)
+	}
+	if name, err := rst.GetRoomName(ctx, 1); err != nil || name != "room" {
+		t.Errorf("should return the room name, but result is %q, %v", name, err)
+	}
+	if names, _, err := rst.GetAllRoomsInfo(ctx); err != nil || names[1] != "room" {
+		t.Errorf("should return all rooms, but result is %+v, %v", names, err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("should not write cookies, but wrote %+v", cookies)
+	}
+	var count int
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM session`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("should not create a session, but %d sessions exist", count)
+	}
+}
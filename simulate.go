@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	dproxy "github.com/koron/go-dproxy"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// シミュレーションで投票する間隔
+	SIMULATED_VOTE_INTERVAL = 2 * time.Second
+	// シミュレーションで投票するセッションの数。各セッションは同じ部屋に投票し直すこともある。
+	SIMULATED_VOTERS = 20
+)
+
+// デモと負荷試験用のPropertyReader。ThingWorxに接続せず、Thing毎にランダムに変化する気温と湿度を返す。
+// 本番環境で使用されないように、TEMVOTE_SIMULATEを指定した場合のみ使用する。
+type SimulatedThingWorx struct {
+	lock   sync.Mutex
+	rng    *rand.Rand
+	things map[ThingName]*simulatedThing
+}
+
+type simulatedThing struct {
+	temperature float64
+	humidity    float64
+}
+
+func NewSimulatedThingWorx(seed int64) *SimulatedThingWorx {
+	return &SimulatedThingWorx{
+		rng:    rand.New(rand.NewSource(seed)),
+		things: make(map[ThingName]*simulatedThing),
+	}
+}
+
+// 呼び出される度に、前回の値から少しだけ変化させた値を返す。初めてのThingは快適な範囲の値から始める。
+func (s *SimulatedThingWorx) Properties(ctx context.Context, name ThingName) (dproxy.Proxy, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	th, ok := s.things[name]
+	if !ok {
+		th = &simulatedThing{
+			temperature: 20 + s.rng.Float64()*6,
+			humidity:    40 + s.rng.Float64()*20,
+		}
+		s.things[name] = th
+	} else {
+		th.temperature = clamp(th.temperature+s.rng.NormFloat64()*0.2, 16, 32)
+		th.humidity = clamp(th.humidity+s.rng.NormFloat64(), 20, 80)
+	}
+	return dproxy.New(map[string]interface{}{
+		"temperature": math.Round(th.temperature*10) / 10,
+		"humidity":    math.Round(th.humidity*10) / 10,
+		"lastUpdated": float64(time.Now().UnixNano() / int64(time.Millisecond)),
+	}), nil
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+// 通常の投票と同じ処理でランダムな投票を行う。
+type voteSimulator struct {
+	rsm *RoomStatusManager
+	rng *rand.Rand
+	// 投票に使用するセッション。有効期限が切れたものは作り直す。
+	sessions []uint64
+}
+
+func newVoteSimulator(rsm *RoomStatusManager, seed int64) *voteSimulator {
+	return &voteSimulator{
+		rsm:      rsm,
+		rng:      rand.New(rand.NewSource(seed)),
+		sessions: make([]uint64, SIMULATED_VOTERS),
+	}
+}
+
+// interval毎に投票する。ctxがキャンセルされるまで戻らない。
+func (vs *voteSimulator) run(ctx context.Context, interval time.Duration) {
+	vs.rsm.config.Logger.Debug("starting voteSimulator")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			vs.rsm.config.Logger.Debug("stopping voteSimulator")
+			return
+		case <-ticker.C:
+		}
+		if err := vs.vote(ctx); err != nil {
+			vs.rsm.config.Logger.Error("failed to simulate a vote", "error", err)
+		}
+	}
+}
+
+// ランダムなセッションから、ランダムな部屋へ1票投票する。部屋がない場合は何もしない。
+func (vs *voteSimulator) vote(ctx context.Context) error {
+	i := vs.rng.Intn(len(vs.sessions))
+	tx, err := vs.rsm.GetTxBySessionID(ctx, vs.sessions[i])
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names, _, err := tx.GetAllRoomsInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	ids := make([]RoomID, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	// 同じシードで同じ部屋が選ばれるように、mapの順序に依存せずに並べる
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	id := ids[vs.rng.Intn(len(ids))]
+
+	if tx.s == nil {
+		// 実際のセッションと区別できるように、Cookieで使用できない空の秘密情報で作成する
+		sid, err := tx.tx.InsertID(ctx, "session_id",
+			`INSERT INTO session (secret_sha256, expire) VALUES ('', ?)`,
+			time.Now().Add(vs.rsm.config.SessionTTL),
+		)
+		if err != nil {
+			return err
+		}
+		vs.sessions[i] = uint64(sid)
+		tx.s = &Session{
+			SessionID: uint64(sid),
+			tx:        tx.tx,
+			writen:    true,
+			ttl:       vs.rsm.config.SessionTTL,
+		}
+	}
+
+	choice := simulatedChoice(vs.rng, vs.rsm.newRoomStatus(id).AvgTemperature)
+	switch err := tx.Vote(ctx, id, choice); err {
+	case nil:
+	case ErrVoteTooSoon:
+		// 直前に同じ部屋へ投票したセッション
+		return nil
+	default:
+		return err
+	}
+	if err := tx.TouchSession(ctx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 部屋の気温に応じた選択肢をランダムに選ぶ。暑いほど"暑い"側の投票が多くなる。
+// 気温が分からない場合は、快適を中心にばらつかせる。
+func simulatedChoice(rng *rand.Rand, temperature *float64) VoteChoice {
+	choices := []VoteChoice{VeryHot, Hot, Comfort, Cold, VeryCold}
+	center := 2.0
+	if temperature != nil {
+		center -= (*temperature - 23) / 3
+	}
+	i := int(math.Round(center + rng.NormFloat64()))
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(choices) {
+		i = len(choices) - 1
+	}
+	return choices[i]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSimulatedThingWorx(t *testing.T) {
+	tw := NewSimulatedThingWorx(1)
+	var prev float64
+	for i := 0; i < 100; i++ {
+		prop, err := tw.Properties(context.Background(), "thing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		temperature, err := prop.M("temperature").Float64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		humidity, err := prop.M("humidity").Float64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if temperature < 16 || temperature > 32 || humidity < 20 || humidity > 80 {
+			t.Fatalf("should return plausible values, but result is %v℃, %v%%", temperature, humidity)
+		}
+		// 急に変化しない
+		if i > 0 && (temperature-prev > 2 || prev-temperature > 2) {
+			t.Errorf("should change gradually, but changed from %v to %v", prev, temperature)
+		}
+		prev = temperature
+	}
+}
+
+func TestSimulatedChoice(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hot, cold := 35.0, 10.0
+	for i := 0; i < 20; i++ {
+		if c := simulatedChoice(rng, &hot); c != VeryHot && c != Hot {
+			t.Errorf("should vote hot in a hot room, but result is %s", c)
+		}
+		if c := simulatedChoice(rng, &cold); c != VeryCold && c != Cold {
+			t.Errorf("should vote cold in a cold room, but result is %s", c)
+		}
+	}
+}
+
+func TestVoteSimulator(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, NewSimulatedThingWorx(1))
+	vs := newVoteSimulator(rsm, 1)
+
+	// 部屋がない場合は何もしない
+	if err := vs.vote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1), (2, 'room2', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rsm.invalidateRoomInfo()
+
+	for i := 0; i < 50; i++ {
+		if err := vs.vote(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sessions, votes int
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM session`).Scan(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM vote`).Scan(&votes); err != nil {
+		t.Fatal(err)
+	}
+	// セッションは使い回し、各セッションの投票は部屋毎に1つ
+	if sessions == 0 || sessions > SIMULATED_VOTERS {
+		t.Errorf("should reuse up to %d sessions, but %d sessions exist", SIMULATED_VOTERS, sessions)
+	}
+	if votes == 0 || votes > 2*sessions {
+		t.Errorf("should record at most one vote per session and room, but %d votes exist", votes)
+	}
+}
+
+func TestLoadConfigFromEnvSimulate(t *testing.T) {
+	t.Setenv("TEMVOTE_DB_DRIVER", "sqlite3")
+	t.Setenv("TEMVOTE_DB_URL", "./temvote.db")
+	t.Setenv("TEMVOTE_SIMULATE", "true")
+
+	// シミュレーションではTHINGWORX_URLは不要
+	if _, err := LoadConfigFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEMVOTE_THINGWORX_URL", "https://example.com/Thingworx")
+	_, err := LoadConfigFromEnv()
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) || len(cerr.Invalid) != 1 || !strings.Contains(cerr.Invalid[0], "TEMVOTE_SIMULATE") {
+		t.Errorf("should reject simulation with THINGWORX_URL, but result is %v", err)
+	}
+}
+
+func TestReadyHandlerSimulated(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, NewSimulatedThingWorx(1))
+
+	// シミュレーションではTHINGWORX_URLが空のため、ThingWorxを確認すると準備完了にならない
+	w := httptest.NewRecorder()
+	readyHandler(rsm.db, &ThingWorxClient{}, rsm).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("should be unavailable without ThingWorx, but status is %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	readyHandler(rsm.db, nil, rsm).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	var res readyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || res.Status != "ok" || res.Checks["db"] != "ok" || res.Checks["thingworx"] != "simulated" {
+		t.Errorf("should be ready in simulation, but status is %d and result is %+v", w.Code, res)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// 気温の測定値と、前回キャッシュした気温の指数移動平均を返す。
+// 初回と、接続が切れていたセンサーが再接続した場合は、間の値と平均しないように測定値をそのまま返す。
+func (rsm *RoomStatusManager) smoothTemperature(id RoomID, name ThingName, stat SensorStatus) *float64 {
+	if stat.Temperature == nil || !stat.IsConnected {
+		return stat.Temperature
+	}
+
+	rsm.cacheLock.RLock()
+	prev, ok := rsm.sensorCache[id][name]
+	rsm.cacheLock.RUnlock()
+	if !ok || !prev.IsConnected || !prev.expire.After(time.Now()) || prev.Temperature == nil {
+		return stat.Temperature
+	}
+	if stat.LastUpdated == prev.LastUpdated {
+		// センサーが新しい値を送信していない場合は、同じ測定値を重ねて平均しない
+		return prev.Temperature
+	}
+
+	alpha := rsm.config.TemperatureSmoothing
+	t := alpha*(*stat.Temperature) + (1-alpha)*(*prev.Temperature)
+	return &t
+}
+
+// 平滑化する前の気温を返す。履歴の保存に使用する。
+func (stat SensorStatus) measuredTemperature() *float64 {
+	if stat.rawTemperature != nil {
+		return stat.rawTemperature
+	}
+	return stat.Temperature
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTemperatureSmoothing(t *testing.T) {
+	fake := NewFakeThingWorx()
+	rsm := newTestRoomStatusManager(t, fake)
+	rsm.config.TemperatureSmoothing = 0.5
+	ctx := context.Background()
+
+	temperature := func() interface{} {
+		t.Helper()
+		stats, _, ok := rsm.getSensorStatusFromCache(1)
+		if !ok || len(stats) != 1 {
+			t.Fatalf("should cache 1 sensor status, but result is %+v", stats)
+		}
+		return optionalValue(stats[0].Temperature)
+	}
+
+	now := time.Now()
+	fake.Set("thing", 20, 50, now.Add(-2*time.Second))
+	if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if v := temperature(); v != 20.0 {
+		t.Errorf("should start from the first reading, but result is %v", v)
+	}
+
+	fake.Set("thing", 22, 50, now.Add(-time.Second))
+	if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if v := temperature(); v != 21.0 {
+		t.Errorf("should smooth the temperature to 21.0, but result is %v", v)
+	}
+	stats, _, _ := rsm.getSensorStatusFromCache(1)
+	if optionalValue(stats[0].measuredTemperature()) != 22.0 {
+		t.Errorf("should keep the raw reading for the history, but result is %v", optionalValue(stats[0].measuredTemperature()))
+	}
+
+	// 同じ測定値を再度取得しても、平均を重ねない
+	if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if v := temperature(); v != 21.0 {
+		t.Errorf("should not blend the same reading twice, but result is %v", v)
+	}
+
+	// 接続が切れた後に再接続した場合は、新しい測定値から始める
+	fake.Set("thing", 25, 50, now.Add(-10*time.Minute))
+	if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	fake.Set("thing", 30, 50, now)
+	if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+		t.Fatal(err)
+	}
+	if v := temperature(); v != 30.0 {
+		t.Errorf("should reset to the first reading after reconnecting, but result is %v", v)
+	}
+}
+
+func TestTemperatureSmoothingDisabled(t *testing.T) {
+	fake := NewFakeThingWorx()
+	rsm := newTestRoomStatusManager(t, fake)
+	ctx := context.Background()
+
+	now := time.Now()
+	for i, temp := range []float64{20, 22} {
+		fake.Set("thing", temp, 50, now.Add(time.Duration(i-2)*time.Second))
+		if err := rsm.updateSensorStatus(ctx, 1, "thing"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, _, _ := rsm.getSensorStatusFromCache(1)
+	if len(stats) != 1 || optionalValue(stats[0].Temperature) != 22.0 {
+		t.Errorf("should display the raw reading, but result is %+v", stats)
+	}
+}
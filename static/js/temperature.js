@@ -15,9 +15,10 @@
         searchParams[kv[0]] = kv[1];
     }
 
-    function getCurrentStatus(success, error) {
+    // refreshがtrueの場合は、サーバーのキャッシュを待たずにセンサーの最新の値を取得する。
+    function getCurrentStatus(success, error, refresh) {
         var xhr = new XMLHttpRequest();
-        xhr.open('GET', '/api/v1/status?room=' + roomId);
+        xhr.open('GET', '/api/v1/status?room=' + roomId + (refresh ? '&refresh=true' : ''));
         xhr.responseType = 'json';
         xhr.onload = function () {
             if (xhr.status === 200 || xhr.status === 302) {
@@ -31,23 +32,41 @@
         xhr.send();
     }
 
-    function vote(hotOrCold, success, error) {
-        var params = new FormData();
-        params.append('vote', hotOrCold);
-
+    // 投票に必要なCSRFトークンを取得する。セッションがない場合はサーバーが作成する。
+    function getCsrfToken(success, error) {
         var xhr = new XMLHttpRequest();
-        xhr.open('POST', '/api/v1/status?room=' + roomId);
+        xhr.open('GET', '/api/v1/csrf');
         xhr.responseType = 'json';
         xhr.onload = function () {
-            if (xhr.status === 200 || xhr.status === 302) {
-                status = xhr.response.status;
-                myvote = xhr.response.myvote;
-                success();
+            if (xhr.status === 200) {
+                success(xhr.response.token);
             } else {
                 error();
             }
         };
-        xhr.send(params);
+        xhr.send();
+    }
+
+    function vote(hotOrCold, success, error) {
+        var params = new FormData();
+        params.append('vote', hotOrCold);
+
+        getCsrfToken(function (token) {
+            var xhr = new XMLHttpRequest();
+            xhr.open('POST', '/api/v1/status?room=' + roomId);
+            xhr.setRequestHeader('X-CSRF-Token', token);
+            xhr.responseType = 'json';
+            xhr.onload = function () {
+                if (xhr.status === 200 || xhr.status === 302) {
+                    status = xhr.response.status;
+                    myvote = xhr.response.myvote;
+                    success();
+                } else {
+                    error();
+                }
+            };
+            xhr.send(params);
+        }, error);
     }
 
     function showErrorMessage() {
@@ -60,44 +79,46 @@
         statusMsg.classList.remove('active');
         errorMsg.classList.remove('active');
 
-        if(status.sensors.length > 0 && status.sensors[0].isConnected) {
+        if(status.sensorCount > 0 && status.avgTemperature != null) {
             // 不快指数の求め方はWikipediaより。
             // https://ja.wikipedia.org/wiki/%E4%B8%8D%E5%BF%AB%E6%8C%87%E6%95%B0
 
-            // 温度と湿度の平均値を出す
-            var t = 0.0;
-            var h = 0.0;
-            for(var s of status.sensors){
-                t += s.temperature;
-                h += s.humidity;
-            }
-            t /= status.sensors.length;
-            h /= status.sensors.length;
+            // 接続中のセンサーの温度と湿度の平均値 (未接続のセンサーの古い値は含まない)
+            var t = status.avgTemperature;
+            var h = status.avgHumidity;
 
-            var discomfortIndex = 0.81 * t + 0.01 * h * (0.99 * t - 14.3) + 46.3;
             statusMsg.classList.add('active');
             statusMsg.querySelector('.temperature').innerText = parseInt(t, 0);
-            statusMsg.querySelector('.discomfort').innerText = parseInt(discomfortIndex, 0);
-
-            // 不快指数の背景色を更新する
-            var discomfortClasses = statusMsg.querySelector('.discomfort').classList;
-            discomfortClasses.remove('level0');
-            discomfortClasses.remove('level1');
-            discomfortClasses.remove('level2');
-            discomfortClasses.remove('level3');
-
-            discomfortClasses.add(
-                discomfortIndex <= 75 ? 'level0' :
-                discomfortIndex <= 78 ? 'level1' :
-                discomfortIndex <= 80 ? 'level2' : 'level3'
-            );
-
-            // メーターの位置を更新する
-            var diMin = 60;
-            var diMax = 80;
-            var diMeterArrow = statusMsg.querySelector('.meter .arrow');
-            diMeterArrow.style.marginLeft =
-                (90 * Math.min(Math.max(0.0, (discomfortIndex - diMin) / (diMax - diMin)), 1.0)) + '%';
+
+            // 湿度の平均値がない場合は不快指数を表示しない
+            var humidityOnly = statusMsg.querySelectorAll('.humidity_only');
+            for (var i = 0; i < humidityOnly.length; i++) {
+                humidityOnly[i].style.display = h == null ? 'none' : '';
+            }
+            if (h != null) {
+                var discomfortIndex = 0.81 * t + 0.01 * h * (0.99 * t - 14.3) + 46.3;
+                statusMsg.querySelector('.discomfort').innerText = parseInt(discomfortIndex, 0);
+
+                // 不快指数の背景色を更新する
+                var discomfortClasses = statusMsg.querySelector('.discomfort').classList;
+                discomfortClasses.remove('level0');
+                discomfortClasses.remove('level1');
+                discomfortClasses.remove('level2');
+                discomfortClasses.remove('level3');
+
+                discomfortClasses.add(
+                    discomfortIndex <= 75 ? 'level0' :
+                    discomfortIndex <= 78 ? 'level1' :
+                    discomfortIndex <= 80 ? 'level2' : 'level3'
+                );
+
+                // メーターの位置を更新する
+                var diMin = 60;
+                var diMax = 80;
+                var diMeterArrow = statusMsg.querySelector('.meter .arrow');
+                diMeterArrow.style.marginLeft =
+                    (90 * Math.min(Math.max(0.0, (discomfortIndex - diMin) / (diMax - diMin)), 1.0)) + '%';
+            }
         }else{
             errorMsg.classList.add('active');
         }
@@ -133,7 +154,7 @@
         }
     }
 
-    getCurrentStatus(update, showErrorMessage);
+    getCurrentStatus(update, showErrorMessage, true);
     setInterval(function () {
         getCurrentStatus(update, showErrorMessage);
     }, updateInterval);
@@ -1,4 +1,4 @@
-INSERT INTO `room` VALUES
+INSERT INTO `room` (room_id, name, building_name, floor) VALUES
   (1, 'テストルーム1', '片柳研究所棟', 11),
   (2, '講義棟201', '講義棟', 2),
   (3, '講義棟202', '講義棟', 2),
@@ -1,43 +1,564 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	dproxy "github.com/koron/go-dproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ThingWorxClient.Timeoutが未設定の場合に使用するタイムアウト
+	DefaultThingWorxTimeout = 10 * time.Second
+	// ThingWorxClient.MaxRetriesが未設定の場合に使用するリトライ回数
+	DefaultThingWorxMaxRetries = 2
+	// ThingWorxClient.BaseBackoffが未設定の場合に使用する待ち時間
+	DefaultThingWorxBaseBackoff = 500 * time.Millisecond
+
+	// ThingWorxClient.BatchThresholdが未設定の場合に使用する閾値
+	DefaultThingWorxBatchThreshold = 20
+
+	// プロパティのパスのテンプレートで、Thing名に置き換えるプレースホルダー
+	ThingNamePlaceholder = "{thing}"
+	// ThingWorxClient.PropertiesPathTemplateが未設定の場合に使用するテンプレート
+	DefaultThingWorxPropertiesPathTemplate = "/Things/" + ThingNamePlaceholder + "/Properties/"
+
+	// エラーメッセージに含めるレスポンスボディの最大バイト数
+	maxErrorBodySnippet = 256
+	// バッチ取得のレスポンスで、Thing名が格納されている列の名前
+	batchThingNameField = "name"
 )
 
 type ThingName string
 
+// ThingWorxClient.HTTPClientが未設定の場合に使用するクライアント。
+// リクエスト毎にクライアントを作成せず共有することで、コネクションを再利用する。
+var defaultThingWorxHTTPClient = &http.Client{}
+
+// プロパティのパスのテンプレートにプレースホルダーが含まれていないことを表すエラー
+var ErrInvalidPathTemplate = errors.New("thingworx: properties path template must contain " + ThingNamePlaceholder)
+
+// Thingにプロパティの値が存在しないことを表すエラー。
+// 作成直後や削除済みのThingに対してProperties()を呼び出した場合に返される。
+var ErrNoThingData = errors.New("thingworx: thing has no data")
+
+// センサーの値が格納されているThingWorxのプロパティ名。
+// 空のフィールドはDefaultPropertyMappingの値を使用する。
+type PropertyMapping struct {
+	Temperature string
+	Humidity    string
+	// 最終更新時刻(UNIX時間、ミリ秒単位)
+	LastUpdated string
+	// CO2濃度(ppm)と在室人数。これらのプロパティを持たないThingもある。
+	CO2       string
+	Occupancy string
+}
+
+var DefaultPropertyMapping = PropertyMapping{
+	Temperature: "temperature",
+	Humidity:    "humidity",
+	LastUpdated: "lastUpdated",
+	CO2:         "co2",
+	Occupancy:   "occupancy",
+}
+
+// Thingのプロパティを読み出すインターフェース。RoomStatusManagerはこれを通してセンサーの値を取得する。
+// ThingWorxClientが実装し、テストでは偽物に差し替える。
+type PropertyReader interface {
+	// Thingのプロパティを返す。Thingにデータがない場合はErrNoThingDataを返す。
+	Properties(ctx context.Context, name ThingName) (dproxy.Proxy, error)
+}
+
+// 複数のThingのプロパティを一括で読み出せるPropertyReader。
+type batchPropertyReader interface {
+	PropertyReader
+	PropertiesBatch(ctx context.Context, names []ThingName) (map[ThingName]dproxy.Proxy, error)
+	useBatch(n int) bool
+}
+
 type ThingWorxClient struct {
 	URL    string
 	AppKey string
+	// trueの場合、AppKeyをヘッダーではなくクエリパラメータで送信する。
+	// アクセスログにAppKeyが残るため、ヘッダーを受け付けないサーバーでのみ使用すること。
+	AppKeyInQuery bool
+	// Thing毎のAppKey。別のテナントに属するThingなど、AppKeyが異なるThingを指定する。
+	// 含まれないThingにはAppKeyを使用する。
+	AppKeys map[ThingName]string
+	// 1リクエストあたりのタイムアウト。0の場合はDefaultThingWorxTimeoutを使用する。
+	Timeout time.Duration
+	// 一時的なエラーに対するリトライ回数。0の場合はDefaultThingWorxMaxRetriesを使用し、
+	// 負の値の場合はリトライしない。
+	MaxRetries int
+	// リトライ間隔の基準値。n回目のリトライはBaseBackoff*2^(n-1)にジッターを加えた時間だけ待つ。
+	// 0の場合はDefaultThingWorxBaseBackoffを使用する。
+	BaseBackoff time.Duration
+	// Thingのプロパティのパス。URLからの相対パスで、"{thing}"はThing名に置き換える。
+	// (ex: "/Thingworx/Things/{thing}/Properties/") 空の場合はDefaultThingWorxPropertiesPathTemplateを使用する。
+	PropertiesPathTemplate string
+	// 複数のThingのプロパティを一括で取得するサービスのパス。(ex: "Things/TemVote/Services/GetProperties")
+	// 空の場合、一括取得は行わない。
+	BatchService string
+	// 登録されたThingの数がこの値を超えた場合に一括取得を行う。
+	// 0の場合はDefaultThingWorxBatchThresholdを使用する。
+	BatchThreshold int
+	// センサーの値を読み出すプロパティ名
+	Mapping PropertyMapping
+	// リクエストの送信に使用するクライアント。nilの場合は共有のクライアントを使用する。
+	HTTPClient *http.Client
+	// スパンの作成に使用するTracerProvider。nilの場合はグローバルのTracerProviderを使用する。
+	TracerProvider trace.TracerProvider
+
+	// 同じThingのプロパティへの同時のリクエストをまとめる
+	inflight singleflight.Group
+}
+
+// リトライしても成功する見込みのないエラー
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// まとめられたリクエストが、送信した呼び出し元のcontextの終了によって中断されたことを表す。
+type inflightCanceledError struct {
+	err error
+}
+
+func (e *inflightCanceledError) Error() string { return e.err.Error() }
+func (e *inflightCanceledError) Unwrap() error { return e.err }
+
+// ThingWorxが2xx以外のステータスを返したことを表すエラー
+type ThingWorxError struct {
+	StatusCode int
+	// リクエスト先の説明。(ex: `thing "foo"`)
+	Target string
+	// レスポンスボディの先頭部分
+	Body string
+}
+
+func (e *ThingWorxError) Error() string {
+	return fmt.Sprintf("thingworx: unexpected status %d for %s: %s", e.StatusCode, e.Target, e.Body)
+}
+
+func (tw *ThingWorxClient) timeout() time.Duration {
+	if tw.Timeout <= 0 {
+		return DefaultThingWorxTimeout
+	}
+	return tw.Timeout
+}
+
+func (tw *ThingWorxClient) httpClient() *http.Client {
+	if tw.HTTPClient == nil {
+		return defaultThingWorxHTTPClient
+	}
+	return tw.HTTPClient
+}
+
+func (tw *ThingWorxClient) maxRetries() int {
+	switch {
+	case tw.MaxRetries < 0:
+		return 0
+	case tw.MaxRetries == 0:
+		return DefaultThingWorxMaxRetries
+	}
+	return tw.MaxRetries
 }
 
-func (tw *ThingWorxClient) Properties(name ThingName) (dproxy.Proxy, error) {
-	url := fmt.Sprintf("%s/Things/%s/Properties/", tw.URL, string(name))
-	if tw.AppKey != "" {
-		url += "?appKey=" + tw.AppKey
+func (tw *ThingWorxClient) baseBackoff() time.Duration {
+	if tw.BaseBackoff <= 0 {
+		return DefaultThingWorxBaseBackoff
 	}
+	return tw.BaseBackoff
+}
+
+// n回目(1始まり)のリトライ前に待つ時間を返す。
+func (tw *ThingWorxClient) backoff(n int) time.Duration {
+	d := tw.baseBackoff() << uint(n-1)
+	// 複数のリクエストが同時にリトライしないように、最大50%のジッターを加える
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// 未設定の項目をデフォルト値で補ったプロパティ名を返す。
+func (tw *ThingWorxClient) mapping() PropertyMapping {
+	m := tw.Mapping
+	if m.Temperature == "" {
+		m.Temperature = DefaultPropertyMapping.Temperature
+	}
+	if m.Humidity == "" {
+		m.Humidity = DefaultPropertyMapping.Humidity
+	}
+	if m.LastUpdated == "" {
+		m.LastUpdated = DefaultPropertyMapping.LastUpdated
+	}
+	if m.CO2 == "" {
+		m.CO2 = DefaultPropertyMapping.CO2
+	}
+	if m.Occupancy == "" {
+		m.Occupancy = DefaultPropertyMapping.Occupancy
+	}
+	return m
+}
+
+// Thingへのリクエストに使用するAppKeyを返す。
+func (tw *ThingWorxClient) appKey(name ThingName) string {
+	if key, ok := tw.AppKeys[name]; ok {
+		return key
+	}
+	return tw.AppKey
+}
+
+// n個のThingのプロパティを取得する際に、一括取得を使うべきかどうかを返す。
+func (tw *ThingWorxClient) useBatch(n int) bool {
+	threshold := tw.BatchThreshold
+	if threshold <= 0 {
+		threshold = DefaultThingWorxBatchThreshold
+	}
+	return tw.BatchService != "" && n > threshold
+}
+
+// リトライを含めて、1回のProperties呼び出しに掛かりうる最大の時間を返す。
+func (tw *ThingWorxClient) deadline() time.Duration {
+	d := tw.timeout()
+	for n := 1; n <= tw.maxRetries(); n++ {
+		d += tw.timeout() + (tw.baseBackoff()<<uint(n-1))*3/2
+	}
+	return d
+}
+
+// プロパティのパスのテンプレートとして使用できるかどうかを検証する。空の場合はデフォルトを使用するため有効とする。
+func ValidatePropertiesPathTemplate(tmpl string) error {
+	if tmpl != "" && !strings.Contains(tmpl, ThingNamePlaceholder) {
+		return ErrInvalidPathTemplate
+	}
+	return nil
+}
+
+// Thingのプロパティの"<URL><PropertiesPathTemplate>[<property>]"形式のURLを返す。
+// Thing名などに空白や"/"が含まれていても正しいパスになるように、各要素をエスケープする。
+func (tw *ThingWorxClient) propertiesURL(name ThingName, property string) (string, error) {
+	tmpl := tw.PropertiesPathTemplate
+	if tmpl == "" {
+		tmpl = DefaultThingWorxPropertiesPathTemplate
+	}
+	if err := ValidatePropertiesPathTemplate(tmpl); err != nil {
+		return "", err
+	}
+	endpoint := tw.URL + strings.ReplaceAll(tmpl, ThingNamePlaceholder, url.PathEscape(string(name)))
+	if property != "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(property)
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return "", fmt.Errorf("thingworx: invalid URL for thing %q: %w", string(name), err)
+	}
+	return endpoint, nil
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// Thingのプロパティの最初の行を返す。行がない場合はErrNoThingDataを返す。
+func (tw *ThingWorxClient) Properties(ctx context.Context, name ThingName) (dproxy.Proxy, error) {
+	rows, err := tw.PropertiesRows(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Accept", "application/json")
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrNoThingData, string(name))
+	}
+	return rows[0], nil
+}
 
-	client := http.Client{}
-	//client := http.Client{Timeout: 10}
-	res, err := client.Do(req)
+// Thingのプロパティのすべての行を返す。履歴や複数チャネルのプロパティを持つThing向け。
+// 行が空の場合は空のスライスを返し、レスポンスに"rows"がない場合はErrNoThingDataを返す。
+//
+// 同じThingへの同時の呼び出しは1つのリクエストにまとめ、結果とエラーを共有する。
+// 共有された行は他の呼び出し元も参照しているため、変更しないこと。
+// リクエストは最初の呼び出し元のcontextで送信し、そのcontextの終了で中断された場合は、
+// 待っていた他の呼び出し元が改めてリクエストを送信する。
+func (tw *ThingWorxClient) PropertiesRows(ctx context.Context, name ThingName) ([]dproxy.Proxy, error) {
+	for {
+		ch := tw.inflight.DoChan(string(name), func() (interface{}, error) {
+			rows, err := tw.propertiesRows(ctx, name)
+			if err != nil && ctx.Err() != nil {
+				return nil, &inflightCanceledError{err}
+			}
+			return rows, err
+		})
+		select {
+		case res := <-ch:
+			var canceled *inflightCanceledError
+			if errors.As(res.Err, &canceled) {
+				if ctx.Err() == nil {
+					// 他の呼び出し元のcontextで中断されたため、送信し直す
+					continue
+				}
+				return nil, canceled.err
+			}
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			return res.Val.([]dproxy.Proxy), nil
+		case <-ctx.Done():
+			return nil, tw.wrapContextError(ctx, fmt.Sprintf("thing %q", string(name)), ctx.Err())
+		}
+	}
+}
+
+func (tw *ThingWorxClient) propertiesRows(ctx context.Context, name ThingName) (_ []dproxy.Proxy, err error) {
+	ctx, span := tracerFrom(tw.TracerProvider).Start(ctx, "ThingWorxClient.Properties", trace.WithAttributes(attrThingName(name)))
+	defer func() { endSpan(span, err) }()
+
+	endpoint, err := tw.propertiesURL(name, "")
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	js, err := ioutil.ReadAll(res.Body)
+
+	target := fmt.Sprintf("thing %q", string(name))
+	js, err := tw.doWithRetry(ctx, target, "GET", endpoint, tw.appKey(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(js, &v); err != nil {
+		return nil, fmt.Errorf("thingworx: can not decode properties of thing %q: %w", string(name), err)
+	}
+
+	rows, err := dproxy.New(v).M("rows").Array()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoThingData, string(name))
+	}
+	props := make([]dproxy.Proxy, len(rows))
+	for i := range rows {
+		// InfoTableの行はオブジェクトのため、それ以外(nullや配列の入れ子など)は不正なレスポンスとして扱う
+		if _, ok := rows[i].(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("thingworx: row %d of thing %q is not an object: %T", i, string(name), rows[i])
+		}
+		props[i] = dproxy.New(rows[i])
+	}
+	return props, nil
+}
+
+// Thingのプロパティに値を書き込む。
+// ステータスコードが2xx以外の場合は*ThingWorxErrorを返す。
+func (tw *ThingWorxClient) SetProperty(ctx context.Context, name ThingName, property string, value interface{}) (err error) {
+	ctx, span := tracerFrom(tw.TracerProvider).Start(ctx, "ThingWorxClient.SetProperty", trace.WithAttributes(
+		attrThingName(name),
+		attribute.String("thingworx.property", property),
+	))
+	defer func() { endSpan(span, err) }()
+
+	endpoint, err := tw.propertiesURL(name, property)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		property: value,
+	})
+	if err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf("property %q of thing %q", property, string(name))
+	_, err = tw.doWithRetry(ctx, target, "PUT", endpoint, tw.appKey(name), body)
+	return err
+}
+
+// 複数のThingのプロパティを、BatchServiceへの1回のリクエストで取得する。
+// サービスは {"thingNames": [...]} を受け取り、各行に"name"列を持つInfoTableを返すこと。
+// AppKeysでAppKeyが異なるThingを指定した場合は、AppKey毎にリクエストを分ける。
+// レスポンスに含まれなかったThingは、戻り値のmapにも含まれない。
+func (tw *ThingWorxClient) PropertiesBatch(ctx context.Context, names []ThingName) (_ map[ThingName]dproxy.Proxy, err error) {
+	ctx, span := tracerFrom(tw.TracerProvider).Start(ctx, "ThingWorxClient.PropertiesBatch", trace.WithAttributes(
+		attribute.Int("thingworx.things", len(names)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if tw.BatchService == "" {
+		return nil, errors.New("thingworx: BatchService is not configured")
+	}
+
+	var keys []string
+	groups := make(map[string][]ThingName)
+	for _, name := range names {
+		key := tw.appKey(name)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], name)
+	}
+
+	props := make(map[ThingName]dproxy.Proxy, len(names))
+	for _, key := range keys {
+		if err := tw.propertiesBatch(ctx, groups[key], key, props); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// 同じAppKeyを使用するThingのプロパティを一括で取得し、propsに格納する。
+func (tw *ThingWorxClient) propertiesBatch(ctx context.Context, names []ThingName, appKey string, props map[ThingName]dproxy.Proxy) error {
+	endpoint := fmt.Sprintf("%s/%s", tw.URL, strings.TrimPrefix(tw.BatchService, "/"))
+
+	body, err := json.Marshal(&struct {
+		ThingNames []ThingName `json:"thingNames"`
+	}{
+		ThingNames: names,
+	})
+	if err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf("service %q", tw.BatchService)
+	js, err := tw.doWithRetry(ctx, target, "POST", endpoint, appKey, body)
+	if err != nil {
+		return err
+	}
 
 	var v interface{}
-	json.Unmarshal(js, &v)
+	if err := json.Unmarshal(js, &v); err != nil {
+		return fmt.Errorf("thingworx: can not decode response of service %q: %w", tw.BatchService, err)
+	}
+	rows, err := dproxy.New(v).M("rows").Array()
+	if err != nil {
+		return fmt.Errorf("thingworx: invalid response of service %q: %w", tw.BatchService, err)
+	}
+
+	for i := range rows {
+		row := dproxy.New(rows[i])
+		name, err := row.M(batchThingNameField).String()
+		if err != nil {
+			return fmt.Errorf("thingworx: invalid response of service %q: %w", tw.BatchService, err)
+		}
+		props[ThingName(name)] = row
+	}
+	return nil
+}
+
+// ThingWorxのサーバーへ到達できるかを確認する。リトライは行わない。
+// 4xxのレスポンスはサーバーが応答しているため到達可能とみなし、5xxや通信エラーの場合にエラーを返す。
+func (tw *ThingWorxClient) Ping(ctx context.Context) error {
+	_, err := tw.do(ctx, "server", "HEAD", tw.URL, tw.AppKey, nil)
+	var twErr *ThingWorxError
+	if errors.As(err, &twErr) && twErr.StatusCode < 500 {
+		return nil
+	}
+	return err
+}
+
+// リトライ可能なエラーの間、リクエストを繰り返し送信する。
+// targetはエラーメッセージに使用するリクエスト先の説明。(ex: `thing "foo"`)
+// appKeyが空の場合、AppKeyは送信しない。
+func (tw *ThingWorxClient) doWithRetry(ctx context.Context, target, method, endpoint, appKey string, body []byte) ([]byte, error) {
+	var js []byte
+	var err error
+	for n := 0; ; n++ {
+		js, err = tw.do(ctx, target, method, endpoint, appKey, body)
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) || n >= tw.maxRetries() || ctx.Err() != nil {
+			break
+		}
+
+		timer := time.NewTimer(tw.backoff(n + 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, tw.wrapContextError(ctx, target, err)
+		case <-timer.C:
+		}
+	}
+	return js, err
+}
+
+// リクエストを1回だけ送信し、レスポンスボディを返す。
+// リトライしても無駄なエラーはpermanentErrorとして返す。
+func (tw *ThingWorxClient) do(ctx context.Context, target, method, endpoint, appKey string, body []byte) (_ []byte, err error) {
+	// AppKeyを記録しないように、クエリパラメータを付与する前のURLを属性にする
+	ctx, span := tracerFrom(tw.TracerProvider).Start(ctx, "ThingWorx "+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("url.full", endpoint),
+	))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, tw.timeout())
+	defer cancel()
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	req.Header.Add("Accept", "application/json")
+	// ThingWorx側のログと照合できるように、リクエストIDを引き継ぐ
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(REQUEST_ID_HEADER, id)
+	}
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if appKey != "" {
+		if tw.AppKeyInQuery {
+			q := req.URL.Query()
+			q.Set("appKey", appKey)
+			req.URL.RawQuery = q.Encode()
+		} else {
+			req.Header.Set("appKey", appKey)
+		}
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	res, err := tw.httpClient().Do(req)
+	if err != nil {
+		return nil, tw.wrapContextError(ctx, target, err)
+	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		// AppKeyの設定ミスや存在しないThingを特定しやすいように、ボディの先頭をエラーに含める
+		snippet, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySnippet))
+		err := &ThingWorxError{
+			StatusCode: res.StatusCode,
+			Target:     target,
+			Body:       strings.TrimSpace(string(snippet)),
+		}
+		if res.StatusCode >= 500 {
+			return nil, err
+		}
+		return nil, &permanentError{err}
+	}
 
-	return dproxy.New(v).M("rows").A(0), nil
+	js, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, tw.wrapContextError(ctx, target, err)
+	}
+	return js, nil
+}
+
+// contextがタイムアウトまたはキャンセルされていた場合、その旨が分かるエラーに変換する。
+func (tw *ThingWorxClient) wrapContextError(ctx context.Context, target string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("thingworx: request for %s timed out: %w", target, ctx.Err())
+	case context.Canceled:
+		return fmt.Errorf("thingworx: request for %s canceled: %w", target, ctx.Err())
+	}
+	return err
 }
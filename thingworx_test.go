@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThingWorxPropertiesRetry(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&count, 1) <= 2 {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"rows":[{"temperature":25.5}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:         ts.URL,
+		MaxRetries:  3,
+		BaseBackoff: time.Millisecond,
+	}
+	prop, err := tw.Properties(context.Background(), "thing")
+	if err != nil {
+		t.Fatalf("should succeed after retries, but got error: %s", err)
+	}
+	if temp, err := prop.M("temperature").Float64(); err != nil || temp != 25.5 {
+		t.Errorf("should return temperature 25.5, but result is %f (err=%v)", temp, err)
+	}
+	if count != 3 {
+		t.Errorf("should send 3 requests, but sent %d", count)
+	}
+}
+
+func TestThingWorxPropertiesNoRetryOnClientError(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&count, 1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:         ts.URL,
+		MaxRetries:  3,
+		BaseBackoff: time.Millisecond,
+	}
+	if _, err := tw.Properties(context.Background(), "thing"); err == nil {
+		t.Error("should fail with 404 status")
+	}
+	if count != 1 {
+		t.Errorf("should not retry on 404, but sent %d requests", count)
+	}
+}
+
+func TestThingWorxPropertiesRetryAbortsOnCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:         ts.URL,
+		MaxRetries:  10,
+		BaseBackoff: time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := tw.Properties(ctx, "thing"); err == nil {
+		t.Error("should fail when context is done")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("should abort promptly, but took %s", elapsed)
+	}
+}
+
+func TestThingWorxPropertiesStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "invalid appKey", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{URL: ts.URL}
+	_, err := tw.Properties(context.Background(), "thing")
+	if err == nil {
+		t.Fatal("should fail with 401 status")
+	}
+	expected := `thingworx: unexpected status 401 for thing "thing": invalid appKey`
+	if err.Error() != expected {
+		t.Errorf("should return %q, but result is %q", expected, err.Error())
+	}
+}
+
+func TestThingWorxPropertiesBatch(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&count, 1)
+		if req.Method != "POST" || req.URL.Path != "/Things/TemVote/Services/GetProperties" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"rows":[
+			{"name":"thing1","temperature":20.5},
+			{"name":"thing2","temperature":22.0}
+		]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:          ts.URL,
+		BatchService: "Things/TemVote/Services/GetProperties",
+	}
+	props, err := tw.PropertiesBatch(context.Background(), []ThingName{"thing1", "thing2", "thing3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("should send only 1 request, but sent %d", count)
+	}
+	if len(props) != 2 {
+		t.Errorf("should return 2 things, but returned %d", len(props))
+	}
+	if temp, err := props["thing2"].M("temperature").Float64(); err != nil || temp != 22.0 {
+		t.Errorf("should return temperature 22.0 for thing2, but result is %f (err=%v)", temp, err)
+	}
+}
+
+func TestThingWorxSetProperty(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || req.URL.Path != "/Things/thing/Properties/setpoint" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{URL: ts.URL}
+	if err := tw.SetProperty(context.Background(), "thing", "setpoint", 24.5); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"setpoint":24.5}` {
+		t.Errorf("should send the property as JSON, but sent %q", body)
+	}
+
+	err := tw.SetProperty(context.Background(), "thing", "unknown", 1)
+	var twErr *ThingWorxError
+	if !errors.As(err, &twErr) || twErr.StatusCode != http.StatusNotFound {
+		t.Errorf("should return ThingWorxError with status 404, but result is %v", err)
+	}
+}
+
+func TestThingWorxPropertiesNoData(t *testing.T) {
+	for _, body := range []string{`{"rows":[]}`, `{}`} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(body))
+		}))
+
+		tw := &ThingWorxClient{URL: ts.URL}
+		_, err := tw.Properties(context.Background(), "thing")
+		if !errors.Is(err, ErrNoThingData) {
+			t.Errorf("should return ErrNoThingData for %s, but result is %v", body, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestThingWorxPropertiesRows(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/Things/multi/Properties/":
+			w.Write([]byte(`{"rows":[{"channel":1},{"channel":2}]}`))
+		default:
+			w.Write([]byte(`{"rows":[]}`))
+		}
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{URL: ts.URL}
+	rows, err := tw.PropertiesRows(context.Background(), "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("should return 2 rows, but returned %d", len(rows))
+	}
+	for i, row := range rows {
+		if ch, err := row.M("channel").Int64(); err != nil || ch != int64(i+1) {
+			t.Errorf("row %d should have channel %d, but result is %d (err=%v)", i, i+1, ch, err)
+		}
+	}
+
+	rows, err = tw.PropertiesRows(context.Background(), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows == nil || len(rows) != 0 {
+		t.Errorf("should return an empty slice, but result is %#v", rows)
+	}
+}
+
+func TestThingWorxCustomHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Test") != "custom" {
+			http.Error(w, "missing header", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"rows":[{"temperature":20.0}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL: ts.URL,
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("X-Test", "custom")
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		},
+	}
+	if _, err := tw.Properties(context.Background(), "thing"); err != nil {
+		t.Errorf("should use the custom client, but got error: %s", err)
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestThingWorxAppKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("appKey") != "" && req.URL.Query().Get("appKey") != "" {
+			http.Error(w, "appKey is sent twice", http.StatusBadRequest)
+			return
+		}
+		if req.Header.Get("appKey") != "secret" && req.URL.Query().Get("appKey") != "secret" {
+			http.Error(w, "invalid appKey", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"rows":[{"inQuery":` + strconv.FormatBool(req.URL.Query().Get("appKey") != "") + `}]}`))
+	}))
+	defer ts.Close()
+
+	for _, inQuery := range []bool{false, true} {
+		tw := &ThingWorxClient{URL: ts.URL, AppKey: "secret", AppKeyInQuery: inQuery}
+		prop, err := tw.Properties(context.Background(), "thing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := prop.M("inQuery").Bool(); result != inQuery {
+			t.Errorf("AppKeyInQuery=%t: appKey should be sent in query=%t, but result is %t", inQuery, inQuery, result)
+		}
+	}
+}
+
+func TestThingWorxPerThingAppKey(t *testing.T) {
+	var batchKeys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("appKey")
+		if req.Method == "POST" {
+			var body struct {
+				ThingNames []string `json:"thingNames"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			batchKeys = append(batchKeys, key)
+			var rows []string
+			for _, name := range body.ThingNames {
+				rows = append(rows, `{"name":"`+name+`","appKey":"`+key+`"}`)
+			}
+			w.Write([]byte(`{"rows":[` + strings.Join(rows, ",") + `]}`))
+			return
+		}
+		w.Write([]byte(`{"rows":[{"appKey":"` + key + `"}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:            ts.URL,
+		AppKey:         "default",
+		AppKeys:        map[ThingName]string{"other": "tenant"},
+		BatchService:   "Things/TemVote/Services/GetProperties",
+		BatchThreshold: 1,
+	}
+	for name, expected := range map[ThingName]string{"thing": "default", "other": "tenant"} {
+		prop, err := tw.Properties(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, _ := prop.M("appKey").String(); key != expected {
+			t.Errorf("%s: should be requested with appKey %q, but was %q", name, expected, key)
+		}
+	}
+
+	props, err := tw.PropertiesBatch(context.Background(), []ThingName{"thing", "other", "thing2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batchKeys) != 2 {
+		t.Errorf("should send 1 request per appKey, but sent %d (%v)", len(batchKeys), batchKeys)
+	}
+	for name, expected := range map[ThingName]string{"thing": "default", "thing2": "default", "other": "tenant"} {
+		if key, _ := props[name].M("appKey").String(); key != expected {
+			t.Errorf("%s: should be requested with appKey %q in batch, but was %q", name, expected, key)
+		}
+	}
+}
+
+func TestThingWorxThingNameEscape(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"rows":[{"path":"` + req.URL.EscapedPath() + `"}]}`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     ThingName
+		expected string
+	}{
+		{"Room Sensor 1", "/Things/Room%20Sensor%201/Properties/"},
+		{"building/room", "/Things/building%2Froom/Properties/"},
+	}
+	tw := &ThingWorxClient{URL: ts.URL}
+	for _, test := range tests {
+		prop, err := tw.Properties(context.Background(), test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path, _ := prop.M("path").String(); path != test.expected {
+			t.Errorf("should request %q for thing %q, but requested %q", test.expected, test.name, path)
+		}
+	}
+}
+
+func TestThingWorxPropertiesPathTemplate(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath())
+		w.Write([]byte(`{"rows":[{"temperature":20.0}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{
+		URL:                    ts.URL,
+		PropertiesPathTemplate: "/gateway/Thingworx/Things/{thing}/Properties/",
+	}
+	if _, err := tw.Properties(context.Background(), "Room Sensor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.SetProperty(context.Background(), "Room Sensor", "target", 25.0); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/gateway/Thingworx/Things/Room%20Sensor/Properties/",
+		"/gateway/Thingworx/Things/Room%20Sensor/Properties/target",
+	}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("should request %v, but requested %v", expected, paths)
+	}
+
+	// プレースホルダーがないテンプレートは使用しない
+	tw.PropertiesPathTemplate = "/Things/Properties/"
+	if _, err := tw.Properties(context.Background(), "Room Sensor"); !errors.Is(err, ErrInvalidPathTemplate) {
+		t.Errorf("should return ErrInvalidPathTemplate, but result is %v", err)
+	}
+	if err := ValidatePropertiesPathTemplate(""); err != nil {
+		t.Errorf("should accept an empty template as the default, but result is %v", err)
+	}
+}
+
+func TestThingWorxPing(t *testing.T) {
+	tests := []struct {
+		status  int
+		success bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "HEAD" {
+				t.Errorf("should send HEAD request, but method is %s", req.Method)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		tw := &ThingWorxClient{URL: ts.URL}
+		if err := tw.Ping(context.Background()); (err == nil) != tt.success {
+			t.Errorf("status=%d: unexpected result %v", tt.status, err)
+		}
+		ts.Close()
+	}
+
+	// サーバーが停止している場合
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	tw := &ThingWorxClient{URL: ts.URL}
+	if err := tw.Ping(context.Background()); err == nil {
+		t.Error("should fail when the server is down")
+	}
+}
+
+func TestThingWorxPropertiesSingleflight(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		w.Write([]byte(`{"rows":[{"temperature":25.5}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{URL: ts.URL}
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := tw.Properties(context.Background(), "thing")
+			errs <- err
+		}()
+	}
+	// すべての呼び出しが待ち始めるまで待つ
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("should share the result, but got error: %s", err)
+		}
+	}
+	if count != 1 {
+		t.Errorf("should send 1 request for concurrent calls, but sent %d", count)
+	}
+}
+
+func TestThingWorxPropertiesSingleflightCanceled(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			<-req.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"rows":[{"temperature":25.5}]}`))
+	}))
+	defer ts.Close()
+
+	tw := &ThingWorxClient{URL: ts.URL, MaxRetries: -1}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := tw.Properties(ctx, "thing")
+		first <- err
+	}()
+	for atomic.LoadInt32(&count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan error, 1)
+	go func() {
+		_, err := tw.Properties(context.Background(), "thing")
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("should return context.Canceled to the canceled caller, but result is %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("should retry for the other caller, but got error: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("should send 2 requests, but sent %d", count)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+)
+
+// トレーサーの名前。スパンの計装ライブラリ名として記録される。
+const tracerName = "github.com/namazu510/temvote"
+
+// リクエストのヘッダーでトレースコンテキストを受け渡す形式。(W3C Trace Context)
+var tracePropagator = propagation.TraceContext{}
+
+// tpがnilの場合は、グローバルのTracerProviderを使用する。
+// グローバルのTracerProviderが設定されていない場合、スパンは記録されない。
+func tracerFrom(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// errがnilでなければスパンにエラーを記録し、スパンを終了する。
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func attrRoomID(id RoomID) attribute.KeyValue {
+	return attribute.Int64("room.id", int64(id))
+}
+
+func attrThingName(name ThingName) attribute.KeyValue {
+	return attribute.String("thing.name", string(name))
+}
+
+func attrChoice(choice VoteChoice) attribute.KeyValue {
+	return attribute.String("vote.choice", string(choice))
+}
+
+// RoomStatusTxのメソッドのスパンを開始する。
+func (rst *RoomStatusTx) startSpan(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := rst.rsm.tracer
+	if tracer == nil {
+		tracer = tracerFrom(rst.rsm.config.TracerProvider)
+	}
+	return tracer.Start(ctx, "RoomStatusTx."+method, trace.WithAttributes(attrs...))
+}
+
+// リクエストのトレースコンテキストを引き継いで、リクエスト毎のスパンを開始するミドルウェアを返す。
+// スパン名にはパスではなくルートのテンプレートを使用する。(ex: "GET /api/v1/status")
+func tracingMiddleware(tp trace.TracerProvider) mux.MiddlewareFunc {
+	tracer := tracerFrom(tp)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			route := routeTemplate(req)
+			if route == "" {
+				route = req.URL.Path
+			}
+			ctx, span := tracer.Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", route),
+				),
+			)
+			defer span.End()
+			if id := RequestIDFromContext(ctx); id != "" {
+				span.SetAttributes(attribute.String("request.id", id))
+			}
+
+			sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, req.WithContext(ctx))
+			span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+			if sw.status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(sw.status))
+			}
+		})
+	}
+}
+
+// リクエストにマッチしたルートのテンプレートを返す。(ex: "/api/v1/status/{id}")
+// ルートにマッチしていない場合は空文字列を返す。
+func routeTemplate(req *http.Request) string {
+	if r := mux.CurrentRoute(req); r != nil {
+		if tmpl, err := r.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return ""
+}
+
+// レスポンスのステータスコードと、ボディのバイト数を記録するResponseWriter。
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// SSEで使用するため、元のResponseWriterのFlushを呼び出す。
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WebSocketのハンドシェイクで使用するため、元のResponseWriterのHijackを呼び出す。
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
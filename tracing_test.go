@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 記録したスパンの中から、名前が一致するスパンを返す。
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, s := range spans {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingRoomStatusTx(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	rsm.tracer = tracerFrom(tp)
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+
+	if err := rst.Vote(context.Background(), 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Vote(context.Background(), 2, Hot); err != ErrRoomNotFound {
+		t.Fatalf("should return ErrRoomNotFound, but result is %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("should record 2 spans, but recorded %d", len(spans))
+	}
+	if id := spanAttr(spans[0], "room.id").AsInt64(); id != 1 {
+		t.Errorf("room.id should be 1, but result is %d", id)
+	}
+	if choice := spanAttr(spans[0], "vote.choice").AsString(); choice != string(Hot) {
+		t.Errorf("vote.choice should be %q, but result is %q", Hot, choice)
+	}
+	if spans[0].Status().Code == spans[1].Status().Code {
+		t.Errorf("only the failed vote should have error status, but both are %v", spans[0].Status().Code)
+	}
+}
+
+func TestTracingPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		w.Write([]byte(`{"rows":[{}]}`))
+	}))
+	defer ts.Close()
+	tw := &ThingWorxClient{URL: ts.URL, TracerProvider: tp}
+
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware(tp))
+	router.HandleFunc("/things/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := tw.Properties(req.Context(), ThingName(mux.Vars(req)["name"])); err != nil {
+			t.Error(err)
+		}
+	})
+
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest("GET", "/things/thing1", nil)
+	req.Header.Set("traceparent", parent)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	server := findSpan(spans, "GET /things/{name}")
+	if server == nil {
+		t.Fatalf("should record a span for the route, but recorded %d spans", len(spans))
+	}
+	if id := server.SpanContext().TraceID().String(); id != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("should continue the incoming trace, but trace id is %s", id)
+	}
+	props := findSpan(spans, "ThingWorxClient.Properties")
+	if props == nil {
+		t.Fatal("should record a span for Properties")
+	}
+	if props.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("Properties span should be a child of the request span")
+	}
+	if name := spanAttr(props, "thing.name").AsString(); name != "thing1" {
+		t.Errorf("thing.name should be thing1, but result is %q", name)
+	}
+	sc := trace.SpanContextFromContext(tracePropagator.Extract(context.Background(), propagation.HeaderCarrier(http.Header{"Traceparent": {traceparent}})))
+	if sc.TraceID() != server.SpanContext().TraceID() {
+		t.Errorf("should propagate the trace to ThingWorx, but traceparent is %q", traceparent)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+const (
+	// 投票の履歴を保持する期間
+	VOTE_EVENT_RETENTION = 30 * 24 * time.Hour
+	// 投票の推移として一度に返す区間の最大数
+	MAX_VOTE_TIMELINE_BUCKETS = 1000
+)
+
+// 投票の推移の範囲や区間の長さが不正であることを表すエラー
+var ErrInvalidTimeline = errors.New("timeline range or bucket is invalid")
+
+// 投票の推移の1区間分の、選択肢毎の投票数。
+// 集計するのはその区間に行われた投票で、区間の開始時点の集計結果ではない。
+type VoteBucket struct {
+	// 区間の開始時刻。区間はStartを含み、次の区間のStartを含まない。
+	Start    time.Time `json:"start"`
+	VeryHot  int       `json:"veryHot"`
+	Hot      int       `json:"hot"`
+	Comfort  int       `json:"comfort"`
+	Cold     int       `json:"cold"`
+	VeryCold int       `json:"veryCold"`
+	Total    int       `json:"total"`
+}
+
+func (b *VoteBucket) add(choice VoteChoice) {
+	switch choice {
+	case VeryHot:
+		b.VeryHot++
+	case Hot:
+		b.Hot++
+	case Comfort:
+		b.Comfort++
+	case Cold:
+		b.Cold++
+	case VeryCold:
+		b.VeryCold++
+	default:
+		return
+	}
+	b.Total++
+}
+
+// fromからtoまでの部屋への投票を、bucket毎に区切って集計する。
+// 推移をグラフにしやすいように、投票がない区間も含めて古い順に返す。
+func (rst *RoomStatusTx) GetVoteTimeline(ctx context.Context, id RoomID, from, to time.Time, bucket time.Duration) (_ []VoteBucket, err error) {
+	ctx, span := rst.startSpan(ctx, "GetVoteTimeline", attrRoomID(id),
+		attribute.String("timeline.bucket", bucket.String()))
+	defer func() { endSpan(span, err) }()
+
+	if bucket <= 0 || !to.After(from) {
+		return nil, ErrInvalidTimeline
+	}
+	n := to.Sub(from) / bucket
+	if to.Sub(from)%bucket != 0 {
+		n++
+	}
+	if n > MAX_VOTE_TIMELINE_BUCKETS {
+		return nil, ErrInvalidTimeline
+	}
+
+	buckets := make([]VoteBucket, n)
+	for i := range buckets {
+		buckets[i].Start = from.Add(time.Duration(i) * bucket)
+	}
+
+	rows, err := rst.tx.QueryContext(ctx,
+		`SELECT choice, timestamp FROM vote_event
+		WHERE room_id=? AND timestamp>=? AND timestamp<?`,
+		id, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var choice string
+		var ts time.Time
+		if err := rows.Scan(&choice, &ts); err != nil {
+			return nil, err
+		}
+		i := int(ts.Sub(from) / bucket)
+		if i < 0 || i >= len(buckets) {
+			// DBの時刻の精度の違いで、範囲の境界の投票が含まれる場合がある
+			continue
+		}
+		buckets[i].add(VoteChoice(choice))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// 保持期間を過ぎた投票の履歴を削除する。
+func (rsm *RoomStatusManager) cleanUpOldVoteEvents(ctx context.Context) error {
+	tx, err := rsm.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM vote_event WHERE timestamp<?`,
+		time.Now().Add(-rsm.config.VoteEventRetention),
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGetVoteTimeline(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	from := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	if _, err := rsm.db.Exec(`
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room1', 'building', 1);
+		INSERT INTO room (room_id, name, building_name, floor) VALUES (2, 'room2', 'building', 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		room   RoomID
+		choice VoteChoice
+		at     time.Duration
+	}{
+		{1, Hot, 0},
+		{1, Hot, 30 * time.Minute},
+		{1, Cold, 2*time.Hour + time.Minute},
+		{1, Hot, -time.Minute},      // 範囲外
+		{1, Hot, 3 * time.Hour},     // 範囲外
+		{2, Cold, 10 * time.Minute}, // 別の部屋
+	} {
+		if _, err := rsm.db.Exec(
+			`INSERT INTO vote_event (session_id, room_id, choice, timestamp) VALUES (1, ?, ?, ?)`,
+			e.room, string(e.choice), from.Add(e.at),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	buckets, err := rst.GetVoteTimeline(ctx, 1, from, from.Add(3*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("should return 3 buckets including the empty one, but result is %+v", buckets)
+	}
+	if !buckets[1].Start.Equal(from.Add(time.Hour)) {
+		t.Errorf("should start each bucket at the bucket boundary, but result is %v", buckets[1].Start)
+	}
+	if buckets[0].Hot != 2 || buckets[0].Total != 2 || buckets[1].Total != 0 || buckets[2].Cold != 1 || buckets[2].Total != 1 {
+		t.Errorf("should count the votes in each bucket, but result is %+v", buckets)
+	}
+
+	if _, err := rst.GetVoteTimeline(ctx, 1, from, from, time.Hour); err != ErrInvalidTimeline {
+		t.Errorf("should reject an empty range, but result is %v", err)
+	}
+	if _, err := rst.GetVoteTimeline(ctx, 1, from, from.Add(time.Hour), time.Second); err != ErrInvalidTimeline {
+		t.Errorf("should reject too many buckets, but result is %v", err)
+	}
+}
+
+func TestVoteRecordsEvent(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	rst := newTestRoomStatusTx(t, rsm)
+	ctx := context.Background()
+	if err := rst.Vote(ctx, 1, Hot); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rsm.db.Exec(`UPDATE vote SET timestamp=?`, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	rst = newTestRoomStatusTx(t, rsm)
+	rst.s.SessionID = 1
+	if err := rst.Vote(ctx, 1, Cold); err != nil {
+		t.Fatal(err)
+	}
+	if err := rst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM vote_event WHERE room_id=1`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("should keep every vote in the event log, but %d events are recorded", n)
+	}
+
+	if _, err := rsm.db.Exec(`UPDATE vote_event SET timestamp=?`, time.Now().Add(-2*rsm.config.VoteEventRetention)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.cleanUpOldVoteEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsm.db.QueryRow(`SELECT count(*) FROM vote_event`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("should delete events older than the retention, but %d events remain", n)
+	}
+}
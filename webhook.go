@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Webhookへの1回の送信に掛けられる最大の時間
+	WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+// payloadをJSONとしてWebhookへPOSTする。ステータスコードが2xx以外の場合はエラーを返す。
+func postWebhook(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, WEBHOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		snippet, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySnippet))
+		return fmt.Errorf("webhook: unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	return nil
+}
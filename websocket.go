@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// クライアントへ送信待ちのメッセージを保持する数。
+	// 溢れた場合、部屋の状態の通知は破棄する。(次の通知で最新の状態が送信される)
+	WS_SEND_BUFFER = 16
+	// 1メッセージの書き込みに掛けられる最大の時間
+	WS_WRITE_TIMEOUT = 10 * time.Second
+	// 接続を維持するためにpingを送信する間隔
+	WS_PING_INTERVAL = 30 * time.Second
+	// クライアントから受け取るメッセージの最大サイズ
+	WS_MAX_MESSAGE_SIZE = 4096
+)
+
+// WebSocketでやり取りするメッセージ
+//
+// クライアントから送信するメッセージ:
+//
+//	{"type": "subscribe", "payload": {"rooms": [1, 2]}}  通知を受け取る部屋を指定する
+//	{"type": "vote", "roomId": 1, "payload": {"vote": "hot"}}  投票する
+//	{"type": "unvote", "roomId": 1}  投票を取り消す
+//
+// サーバーから送信するメッセージ:
+//
+//	{"type": "status", "roomId": 1, "payload": StatusAPIResponse}  部屋の状態
+//	{"type": "error", "roomId": 1, "payload": {"message": "..."}}  エラー
+type WSMessage struct {
+	Type    string          `json:"type"`
+	RoomID  RoomID          `json:"roomId,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type wsSubscribePayload struct {
+	Rooms []RoomID `json:"rooms"`
+}
+
+type wsVotePayload struct {
+	Vote VoteChoice `json:"vote"`
+	// 再送を識別するキー。省略できる。
+	Key string `json:"key,omitempty"`
+}
+
+type wsErrorPayload struct {
+	Message string `json:"message"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WebSocket接続1つ分の状態
+type wsConn struct {
+	rsm       *RoomStatusManager
+	conn      *websocket.Conn
+	sessionID uint64
+	send      chan *WSMessage
+
+	// 通知を受け取る部屋
+	rooms     map[RoomID]struct{}
+	roomsLock sync.RWMutex
+}
+
+// WebSocketで部屋の状態の購読と投票を行うハンドラー。
+// セッションはハンドシェイク時にCookieから取得し、存在しなければ作成する。
+func serveRoomWebSocket(rsm *RoomStatusManager, w http.ResponseWriter, req *http.Request) {
+	tx, err := rsm.GetTx(w, req, true)
+	if err != nil {
+		rsm.config.Logger.ErrorContext(req.Context(), "websocket handshake failed", "error", err)
+		writeError(w, req, http.StatusInternalServerError, nil)
+		return
+	}
+	defer tx.Rollback()
+	if err := tx.s.ExtendExpiration(req.Context()); err != nil {
+		rsm.config.Logger.ErrorContext(req.Context(), "websocket handshake failed", "error", err)
+		writeError(w, req, http.StatusInternalServerError, nil)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		rsm.config.Logger.ErrorContext(req.Context(), "websocket handshake failed", "error", err)
+		writeError(w, req, http.StatusInternalServerError, nil)
+		return
+	}
+
+	// セッションのCookieをハンドシェイクのレスポンスに含める
+	conn, err := wsUpgrader.Upgrade(w, req, w.Header())
+	if err != nil {
+		rsm.config.Logger.WarnContext(req.Context(), "websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	c := &wsConn{
+		rsm:       rsm,
+		conn:      conn,
+		sessionID: tx.s.SessionID,
+		send:      make(chan *WSMessage, WS_SEND_BUFFER),
+		rooms:     make(map[RoomID]struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	events, unsubscribe := rsm.Subscribe()
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.writeLoop(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		c.eventLoop(ctx, events)
+		// サーバーの停止により購読が終了した場合は、接続を閉じる
+		cancel()
+	}()
+
+	c.readLoop(ctx)
+	cancel()
+	wg.Wait()
+}
+
+// クライアントからのメッセージを処理する。接続が切れるまで戻らない。
+func (c *wsConn) readLoop(ctx context.Context) {
+	c.conn.SetReadLimit(WS_MAX_MESSAGE_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(2 * WS_PING_INTERVAL))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(2 * WS_PING_INTERVAL))
+	})
+
+	for {
+		var msg WSMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.rsm.config.Logger.WarnContext(ctx, "websocket read failed", "error", err, "session_id", c.sessionID)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			var payload wsSubscribePayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				c.sendError(msg.RoomID, "payload is invalid")
+				continue
+			}
+			c.subscribe(ctx, payload.Rooms)
+		case "vote":
+			var payload wsVotePayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				c.sendError(msg.RoomID, "payload is invalid")
+				continue
+			}
+			if _, err := ParseVoteChoice(string(payload.Vote)); err != nil {
+				c.sendError(msg.RoomID, err.Error())
+				continue
+			}
+			if payload.Key != "" && !validIdempotencyKey(payload.Key) {
+				c.sendError(msg.RoomID, "key parameter is invalid")
+				continue
+			}
+			c.vote(ctx, msg.RoomID, func(tx *RoomStatusTx) error {
+				return tx.VoteWithKey(ctx, msg.RoomID, payload.Vote, payload.Key)
+			})
+		case "unvote":
+			c.vote(ctx, msg.RoomID, func(tx *RoomStatusTx) error {
+				return tx.Unvote(ctx, msg.RoomID)
+			})
+		default:
+			c.sendError(msg.RoomID, "unknown message type")
+		}
+	}
+}
+
+// 送信待ちのメッセージをクライアントに書き込む。
+// 書き込みはこのgoroutineからのみ行う。
+func (c *wsConn) writeLoop(ctx context.Context) {
+	ping := time.NewTicker(WS_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(WS_WRITE_TIMEOUT),
+			)
+			// 読み込み中のreadLoopを終了させる
+			c.conn.Close()
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.rsm.config.Logger.WarnContext(ctx, "websocket write failed", "error", err, "session_id", c.sessionID)
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// 購読中の部屋の状態が変化したら、最新の状態を送信する。
+func (c *wsConn) eventLoop(ctx context.Context, events <-chan RoomID) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id, ok := <-events:
+			if !ok {
+				return
+			}
+			if !c.isSubscribed(id) {
+				continue
+			}
+			c.sendStatus(ctx, id, false)
+		}
+	}
+}
+
+func (c *wsConn) subscribe(ctx context.Context, rooms []RoomID) {
+	c.roomsLock.Lock()
+	c.rooms = make(map[RoomID]struct{}, len(rooms))
+	for _, id := range rooms {
+		c.rooms[id] = struct{}{}
+	}
+	c.roomsLock.Unlock()
+
+	// 購読を開始した部屋の現在の状態を送信する
+	for _, id := range rooms {
+		c.sendStatus(ctx, id, true)
+	}
+}
+
+func (c *wsConn) isSubscribed(id RoomID) bool {
+	c.roomsLock.RLock()
+	defer c.roomsLock.RUnlock()
+	_, ok := c.rooms[id]
+	return ok
+}
+
+// 投票内容を変更し、変更後の部屋の状態を送信する。
+func (c *wsConn) vote(ctx context.Context, id RoomID, update func(tx *RoomStatusTx) error) {
+	tx, err := c.rsm.GetTxBySessionID(ctx, c.sessionID)
+	if err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		c.sendError(id, ServerErrorMsg)
+		return
+	}
+	defer tx.Rollback()
+	if tx.s == nil {
+		c.sendError(id, "session is expired")
+		return
+	}
+
+	switch err := update(tx); err {
+	case nil:
+	case ErrVoteTooSoon:
+		c.sendError(id, "vote is changed too soon")
+		return
+	case ErrRoomNotFound:
+		c.sendError(id, "room is not found")
+		return
+	default:
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		c.sendError(id, ServerErrorMsg)
+		return
+	}
+	if err := tx.TouchSession(ctx); err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		c.sendError(id, ServerErrorMsg)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		c.sendError(id, ServerErrorMsg)
+		return
+	}
+	c.sendStatus(ctx, id, true)
+}
+
+// 部屋の状態を送信する。mustがfalseの場合、送信待ちのメッセージが溢れていれば破棄する。
+func (c *wsConn) sendStatus(ctx context.Context, id RoomID, must bool) {
+	tx, err := c.rsm.GetTxBySessionID(ctx, c.sessionID)
+	if err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		return
+	}
+	defer tx.Rollback()
+
+	var res StatusAPIResponse
+	if res.Status, err = tx.GetStatus(ctx, id); err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		return
+	}
+	if res.MyVote, err = tx.GetMyVote(ctx, id); err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		return
+	}
+	js, err := json.Marshal(res)
+	if err != nil {
+		c.rsm.config.Logger.ErrorContext(ctx, "websocket request failed", "error", err, "room_id", id)
+		return
+	}
+	c.enqueue(&WSMessage{Type: "status", RoomID: id, Payload: js}, must)
+}
+
+func (c *wsConn) sendError(id RoomID, message string) {
+	js, _ := json.Marshal(wsErrorPayload{Message: message})
+	c.enqueue(&WSMessage{Type: "error", RoomID: id, Payload: js}, true)
+}
+
+// メッセージを送信待ちに追加する。
+// 遅いクライアントが通知元を止めないように、mustがfalseのメッセージは溢れた場合に破棄する。
+func (c *wsConn) enqueue(msg *WSMessage, must bool) {
+	if must {
+		select {
+		case c.send <- msg:
+		case <-time.After(WS_WRITE_TIMEOUT):
+			c.rsm.config.Logger.Warn("websocket client is too slow, closing", "session_id", c.sessionID)
+			c.conn.Close()
+		}
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		c.rsm.config.Logger.Warn("websocket send buffer is full, drop status", "room_id", msg.RoomID, "session_id", c.sessionID)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomWebSocket(t *testing.T) {
+	rsm := newTestRoomStatusManager(t, &ThingWorxClient{})
+	if _, err := rsm.db.Exec(`INSERT INTO room (room_id, name, building_name, floor) VALUES (1, 'room', 'building', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveRoomWebSocket(rsm, w, req)
+	}))
+	defer ts.Close()
+
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(res.Cookies()) == 0 {
+		t.Error("should set the session cookie at handshake")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := conn.WriteJSON(&WSMessage{Type: "subscribe", Payload: []byte(`{"rooms":[1]}`)}); err != nil {
+		t.Fatal(err)
+	}
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "status" || msg.RoomID != 1 {
+		t.Errorf("should receive the current status of room 1, but received %+v", msg)
+	}
+
+	if err := conn.WriteJSON(&WSMessage{Type: "vote", RoomID: 1, Payload: []byte(`{"vote":"hot"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "status" || !strings.Contains(string(msg.Payload), `"hot":1`) {
+		t.Errorf("should receive the status after voting, but received %s", msg.Payload)
+	}
+}